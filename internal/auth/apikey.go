@@ -0,0 +1,83 @@
+package auth
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/hex"
+    "strings"
+)
+
+// Scopes that can be granted to an API key
+const (
+    ScopeRead   = "read"
+    ScopeUpload = "upload"
+    ScopeShare  = "share"
+
+    // ScopeManageKeys guards API key management. It is never granted to an
+    // API key, so keys cannot be used to mint further keys.
+    ScopeManageKeys = "manage_keys"
+
+    // ScopeAdmin guards the admin endpoints, which are only reachable with a
+    // JWT even when the key's owner is an admin
+    ScopeAdmin = "admin"
+
+    // ScopeAccount guards account security settings such as two-factor
+    // authentication and is never granted to an API key either
+    ScopeAccount = "account"
+)
+
+// APIKeyScopes lists every scope an API key may be created with
+var APIKeyScopes = []string{ScopeRead, ScopeUpload, ScopeShare}
+
+const apiKeyPrefix = "tmk"
+
+// GenerateAPIKey creates a new API key of the form tmk_<prefix>_<secret>.
+// The prefix is stored in clear text so the key can be looked up; only the
+// SHA-256 hash of the whole key is persisted.
+func GenerateAPIKey() (key string, prefix string, hash string, err error) {
+    prefixBytes := make([]byte, 6)
+    if _, err = rand.Read(prefixBytes); err != nil {
+        return "", "", "", err
+    }
+    secretBytes := make([]byte, 32)
+    if _, err = rand.Read(secretBytes); err != nil {
+        return "", "", "", err
+    }
+
+    prefix = hex.EncodeToString(prefixBytes)
+    key = apiKeyPrefix + "_" + prefix + "_" + base64.RawURLEncoding.EncodeToString(secretBytes)
+    return key, prefix, HashAPIKey(key), nil
+}
+
+// HashAPIKey returns the hex encoded SHA-256 hash of an API key. API keys
+// carry 256 bits of entropy, so a fast hash is sufficient here.
+func HashAPIKey(key string) string {
+    sum := sha256.Sum256([]byte(key))
+    return hex.EncodeToString(sum[:])
+}
+
+// APIKeyPrefix extracts the lookup prefix from an API key
+func APIKeyPrefix(key string) (string, bool) {
+    parts := strings.SplitN(key, "_", 3)
+    if len(parts) != 3 || parts[0] != apiKeyPrefix || parts[1] == "" || parts[2] == "" {
+        return "", false
+    }
+    return parts[1], true
+}
+
+// CheckAPIKeyHash compares a presented key with a stored hash in constant time
+func CheckAPIKeyHash(key, hash string) bool {
+    return subtle.ConstantTimeCompare([]byte(HashAPIKey(key)), []byte(hash)) == 1
+}
+
+// ValidScope reports whether scope may be granted to an API key
+func ValidScope(scope string) bool {
+    for _, s := range APIKeyScopes {
+        if s == scope {
+            return true
+        }
+    }
+    return false
+}
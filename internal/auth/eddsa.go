@@ -0,0 +1,56 @@
+package auth
+
+import (
+    "crypto/ed25519"
+    "errors"
+
+    "github.com/dgrijalva/jwt-go"
+)
+
+// SigningMethodEdDSA implements the EdDSA (Ed25519) JWS algorithm, which
+// jwt-go v3 does not ship with
+type SigningMethodEdDSA struct{}
+
+var (
+    EdDSA              = &SigningMethodEdDSA{}
+    errEdDSAInvalidKey = errors.New("key is not a valid Ed25519 key")
+    errEdDSAVerifyFail = errors.New("EdDSA signature verification failed")
+)
+
+func init() {
+    jwt.RegisterSigningMethod(EdDSA.Alg(), func() jwt.SigningMethod {
+        return EdDSA
+    })
+}
+
+func (m *SigningMethodEdDSA) Alg() string {
+    return "EdDSA"
+}
+
+// Verify checks the signature using an ed25519.PublicKey
+func (m *SigningMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+    publicKey, ok := key.(ed25519.PublicKey)
+    if !ok || len(publicKey) != ed25519.PublicKeySize {
+        return errEdDSAInvalidKey
+    }
+
+    sig, err := jwt.DecodeSegment(signature)
+    if err != nil {
+        return err
+    }
+
+    if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+        return errEdDSAVerifyFail
+    }
+    return nil
+}
+
+// Sign signs the string using an ed25519.PrivateKey
+func (m *SigningMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+    privateKey, ok := key.(ed25519.PrivateKey)
+    if !ok || len(privateKey) != ed25519.PrivateKeySize {
+        return "", errEdDSAInvalidKey
+    }
+
+    return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
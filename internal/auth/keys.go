@@ -0,0 +1,301 @@
+package auth
+
+import (
+    "crypto"
+    "crypto/ed25519"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "log"
+    "math/big"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "trademarkia/config"
+
+    "github.com/dgrijalva/jwt-go"
+)
+
+// Keys is the key set used to sign and verify every token issued by the server
+var Keys *KeySet
+
+// SigningKey is a single key identified by its kid. Keys loaded from a public
+// key file can only verify tokens; they are kept around while a rotated key's
+// tokens are still live.
+type SigningKey struct {
+    ID        string
+    Method    jwt.SigningMethod
+    signKey   interface{}
+    verifyKey interface{}
+}
+
+// CanSign reports whether the key holds private material
+func (k *SigningKey) CanSign() bool {
+    return k.signKey != nil
+}
+
+// KeySet holds the key new tokens are signed with plus every key that is
+// still accepted for verification
+type KeySet struct {
+    active *SigningKey
+    keys   map[string]*SigningKey
+}
+
+// JSONWebKey is the public part of a signing key in RFC 7517 format
+type JSONWebKey struct {
+    KeyType   string `json:"kty"`
+    KeyID     string `json:"kid"`
+    Use       string `json:"use"`
+    Algorithm string `json:"alg"`
+    Curve     string `json:"crv,omitempty"`
+    X         string `json:"x,omitempty"`
+    N         string `json:"n,omitempty"`
+    E         string `json:"e,omitempty"`
+}
+
+// JSONWebKeySet is the document served at /.well-known/jwks.json
+type JSONWebKeySet struct {
+    Keys []JSONWebKey `json:"keys"`
+}
+
+const devSecret = "my_secret_key"
+
+// InitKeys loads the signing keys from configuration:
+//
+//	JWT_SECRET            HS256 secret, registered under JWT_SECRET_ID (default "default")
+//	JWT_PREVIOUS_SECRETS  comma separated kid=secret pairs still accepted for verification
+//	JWT_KEYS_DIR          directory of PEM encoded RSA/Ed25519 keys, the file name is the kid
+//	JWT_ACTIVE_KEY_ID     kid used to sign new tokens
+func InitKeys() error {
+    ks := NewKeySet()
+
+    secret := config.GetEnv("JWT_SECRET", "")
+    secretID := config.GetEnv("JWT_SECRET_ID", "default")
+    keysDir := config.GetEnv("JWT_KEYS_DIR", "")
+
+    if secret == "" && keysDir == "" {
+        log.Println("JWT_SECRET is not set, falling back to the development signing secret")
+        secret = devSecret
+    }
+
+    if secret != "" {
+        if err := ks.AddHMAC(secretID, []byte(secret)); err != nil {
+            return err
+        }
+    }
+
+    previous := config.GetEnv("JWT_PREVIOUS_SECRETS", "")
+    for _, pair := range strings.Split(previous, ",") {
+        pair = strings.TrimSpace(pair)
+        if pair == "" {
+            continue
+        }
+        kid, value, ok := strings.Cut(pair, "=")
+        if !ok || kid == "" || value == "" {
+            return fmt.Errorf("invalid entry in JWT_PREVIOUS_SECRETS: expected kid=secret")
+        }
+        if err := ks.AddHMAC(kid, []byte(value)); err != nil {
+            return err
+        }
+    }
+
+    if keysDir != "" {
+        if err := ks.LoadDir(keysDir); err != nil {
+            return err
+        }
+    }
+
+    activeID := config.GetEnv("JWT_ACTIVE_KEY_ID", "")
+    if activeID == "" && secret != "" {
+        activeID = secretID
+    }
+    if err := ks.SetActive(activeID); err != nil {
+        return err
+    }
+
+    Keys = ks
+    log.Printf("Loaded %d signing key(s), active key: %s (%s)", len(ks.keys), ks.active.ID, ks.active.Method.Alg())
+    return nil
+}
+
+// NewKeySet returns an empty key set
+func NewKeySet() *KeySet {
+    return &KeySet{keys: make(map[string]*SigningKey)}
+}
+
+// AddHMAC registers an HS256 secret
+func (ks *KeySet) AddHMAC(kid string, secret []byte) error {
+    return ks.add(&SigningKey{ID: kid, Method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret})
+}
+
+// AddPrivateKey registers an RSA or Ed25519 private key, picking RS256 or EdDSA from its type
+func (ks *KeySet) AddPrivateKey(kid string, key crypto.PrivateKey) error {
+    switch k := key.(type) {
+    case *rsa.PrivateKey:
+        return ks.add(&SigningKey{ID: kid, Method: jwt.SigningMethodRS256, signKey: k, verifyKey: &k.PublicKey})
+    case ed25519.PrivateKey:
+        return ks.add(&SigningKey{ID: kid, Method: EdDSA, signKey: k, verifyKey: k.Public()})
+    default:
+        return fmt.Errorf("key %s: unsupported private key type %T", kid, key)
+    }
+}
+
+// AddPublicKey registers a verification-only RSA or Ed25519 key
+func (ks *KeySet) AddPublicKey(kid string, key crypto.PublicKey) error {
+    switch k := key.(type) {
+    case *rsa.PublicKey:
+        return ks.add(&SigningKey{ID: kid, Method: jwt.SigningMethodRS256, verifyKey: k})
+    case ed25519.PublicKey:
+        return ks.add(&SigningKey{ID: kid, Method: EdDSA, verifyKey: k})
+    default:
+        return fmt.Errorf("key %s: unsupported public key type %T", kid, key)
+    }
+}
+
+func (ks *KeySet) add(key *SigningKey) error {
+    if key.ID == "" {
+        return errors.New("signing key id must not be empty")
+    }
+    if _, exists := ks.keys[key.ID]; exists {
+        return fmt.Errorf("duplicate signing key id: %s", key.ID)
+    }
+    ks.keys[key.ID] = key
+    return nil
+}
+
+// LoadDir loads every *.pem file in dir, using the file name without extension as the kid
+func (ks *KeySet) LoadDir(dir string) error {
+    paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+    if err != nil {
+        return err
+    }
+
+    for _, path := range paths {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return fmt.Errorf("reading key file %s: %v", path, err)
+        }
+
+        kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+        if err := ks.addPEM(kid, data); err != nil {
+            return fmt.Errorf("loading key file %s: %v", path, err)
+        }
+    }
+    return nil
+}
+
+func (ks *KeySet) addPEM(kid string, data []byte) error {
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return errors.New("no PEM block found")
+    }
+
+    switch block.Type {
+    case "RSA PRIVATE KEY":
+        key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+        if err != nil {
+            return err
+        }
+        return ks.AddPrivateKey(kid, key)
+    case "PRIVATE KEY":
+        key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+        if err != nil {
+            return err
+        }
+        return ks.AddPrivateKey(kid, key)
+    case "PUBLIC KEY":
+        key, err := x509.ParsePKIXPublicKey(block.Bytes)
+        if err != nil {
+            return err
+        }
+        return ks.AddPublicKey(kid, key)
+    default:
+        return fmt.Errorf("unsupported PEM block type %q", block.Type)
+    }
+}
+
+// SetActive selects the key new tokens are signed with
+func (ks *KeySet) SetActive(kid string) error {
+    if kid == "" {
+        return errors.New("no active signing key configured, set JWT_ACTIVE_KEY_ID")
+    }
+    key, ok := ks.keys[kid]
+    if !ok {
+        return fmt.Errorf("active signing key %s not found", kid)
+    }
+    if !key.CanSign() {
+        return fmt.Errorf("active signing key %s has no private key", kid)
+    }
+    ks.active = key
+    return nil
+}
+
+// Sign signs the claims with the active key and stamps its kid in the header
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+    token := jwt.NewWithClaims(ks.active.Method, claims)
+    token.Header["kid"] = ks.active.ID
+    return token.SignedString(ks.active.signKey)
+}
+
+// Keyfunc resolves the verification key for a token from its kid. Tokens
+// issued before kids were introduced are checked against the active key.
+// The token's alg must match the key's, so an RSA public key can never be
+// used as an HMAC secret.
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+    key := ks.active
+    if kid, ok := token.Header["kid"].(string); ok && kid != "" {
+        key, ok = ks.keys[kid]
+        if !ok {
+            return nil, fmt.Errorf("unknown signing key: %s", kid)
+        }
+    }
+
+    if token.Method.Alg() != key.Method.Alg() {
+        return nil, fmt.Errorf("unexpected signing method %s for key %s", token.Method.Alg(), key.ID)
+    }
+    return key.verifyKey, nil
+}
+
+// Parse verifies tokenString and decodes it into claims
+func (ks *KeySet) Parse(tokenString string, claims jwt.Claims) error {
+    token, err := jwt.ParseWithClaims(tokenString, claims, ks.Keyfunc)
+    if err != nil {
+        return err
+    }
+    if !token.Valid {
+        return errors.New("invalid token")
+    }
+    return nil
+}
+
+// JWKS returns the public keys other services can verify tokens with.
+// HMAC secrets are never published.
+func (ks *KeySet) JWKS() JSONWebKeySet {
+    set := JSONWebKeySet{Keys: []JSONWebKey{}}
+
+    for _, key := range ks.keys {
+        jwk := JSONWebKey{KeyID: key.ID, Use: "sig", Algorithm: key.Method.Alg()}
+
+        switch k := key.verifyKey.(type) {
+        case *rsa.PublicKey:
+            jwk.KeyType = "RSA"
+            jwk.N = base64.RawURLEncoding.EncodeToString(k.N.Bytes())
+            jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+        case ed25519.PublicKey:
+            jwk.KeyType = "OKP"
+            jwk.Curve = "Ed25519"
+            jwk.X = base64.RawURLEncoding.EncodeToString(k)
+        default:
+            continue
+        }
+
+        set.Keys = append(set.Keys, jwk)
+    }
+
+    sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].KeyID < set.Keys[j].KeyID })
+    return set
+}
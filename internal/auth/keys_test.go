@@ -0,0 +1,84 @@
+package auth
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/rsa"
+    "testing"
+
+    "github.com/dgrijalva/jwt-go"
+)
+
+func TestKeySetRotation(t *testing.T) {
+    rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatalf("Failed to generate RSA key: %v", err)
+    }
+    _, edKey, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatalf("Failed to generate Ed25519 key: %v", err)
+    }
+
+    ks := NewKeySet()
+    if err := ks.AddHMAC("old", []byte("old_secret")); err != nil {
+        t.Fatal(err)
+    }
+    if err := ks.AddPrivateKey("rsa-1", rsaKey); err != nil {
+        t.Fatal(err)
+    }
+    if err := ks.AddPrivateKey("ed-1", edKey); err != nil {
+        t.Fatal(err)
+    }
+
+    // Tokens signed before the rotation must still verify afterwards
+    var issued []string
+    for _, kid := range []string{"old", "rsa-1", "ed-1"} {
+        if err := ks.SetActive(kid); err != nil {
+            t.Fatal(err)
+        }
+        token, err := ks.Sign(&jwt.StandardClaims{Subject: kid})
+        if err != nil {
+            t.Fatalf("Failed to sign with %s: %v", kid, err)
+        }
+        issued = append(issued, token)
+    }
+
+    for i, token := range issued {
+        claims := &jwt.StandardClaims{}
+        if err := ks.Parse(token, claims); err != nil {
+            t.Errorf("Token %d failed to verify: %v", i, err)
+        }
+    }
+
+    jwks := ks.JWKS()
+    if len(jwks.Keys) != 2 {
+        t.Fatalf("JWKS returned %d keys, want 2 (HMAC secrets must not be published)", len(jwks.Keys))
+    }
+    if jwks.Keys[0].KeyID != "ed-1" || jwks.Keys[0].KeyType != "OKP" || jwks.Keys[1].KeyType != "RSA" {
+        t.Errorf("Unexpected JWKS contents: %+v", jwks.Keys)
+    }
+}
+
+func TestKeySetRejectsAlgorithmMismatch(t *testing.T) {
+    rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatalf("Failed to generate RSA key: %v", err)
+    }
+
+    ks := NewKeySet()
+    if err := ks.AddPrivateKey("rsa-1", rsaKey); err != nil {
+        t.Fatal(err)
+    }
+
+    // An HS256 token keyed with the RSA kid must not be accepted
+    forged := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.StandardClaims{Subject: "attacker"})
+    forged.Header["kid"] = "rsa-1"
+    tokenString, err := forged.SignedString([]byte("anything"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if err := ks.Parse(tokenString, &jwt.StandardClaims{}); err == nil {
+        t.Error("Token with mismatched algorithm was accepted")
+    }
+}
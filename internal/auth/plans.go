@@ -0,0 +1,14 @@
+package auth
+
+// Plans a user account can be on. The plan selects the rate limits and
+// bandwidth the account gets.
+const (
+    PlanFree       = "free"
+    PlanPro        = "pro"
+    PlanEnterprise = "enterprise"
+)
+
+// ValidPlan reports whether plan is a known plan
+func ValidPlan(plan string) bool {
+    return plan == PlanFree || plan == PlanPro || plan == PlanEnterprise
+}
@@ -0,0 +1,13 @@
+package auth
+
+// Roles a user account can hold
+const (
+    RoleUser    = "user"
+    RoleAdmin   = "admin"
+    RoleAuditor = "auditor"
+)
+
+// ValidRole reports whether role is a known role
+func ValidRole(role string) bool {
+    return role == RoleUser || role == RoleAdmin || role == RoleAuditor
+}
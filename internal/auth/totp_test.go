@@ -0,0 +1,52 @@
+package auth
+
+import (
+    "encoding/base32"
+    "testing"
+    "time"
+)
+
+// Test vectors from RFC 6238 Appendix B (SHA-1), truncated to 6 digits
+func TestTOTPCodeRFC6238(t *testing.T) {
+    secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+    vectors := []struct {
+        unix int64
+        code string
+    }{
+        {59, "287082"},
+        {1111111109, "081804"},
+        {1111111111, "050471"},
+        {1234567890, "005924"},
+        {2000000000, "279037"},
+        {20000000000, "353130"},
+    }
+
+    for _, v := range vectors {
+        code, err := TOTPCode(secret, time.Unix(v.unix, 0))
+        if err != nil {
+            t.Fatalf("TOTPCode returned error: %v", err)
+        }
+        if code != v.code {
+            t.Errorf("TOTPCode at %d: got %s want %s", v.unix, code, v.code)
+        }
+    }
+}
+
+func TestValidateTOTPSkew(t *testing.T) {
+    secret, err := GenerateTOTPSecret()
+    if err != nil {
+        t.Fatal(err)
+    }
+    now := time.Unix(1700000000, 0)
+
+    previous, _ := TOTPCode(secret, now.Add(-30*time.Second))
+    if _, ok := ValidateTOTP(secret, previous, now); !ok {
+        t.Error("Code from the previous step should be accepted")
+    }
+
+    stale, _ := TOTPCode(secret, now.Add(-90*time.Second))
+    if _, ok := ValidateTOTP(secret, stale, now); ok {
+        t.Error("Code from three steps ago should be rejected")
+    }
+}
@@ -0,0 +1,155 @@
+package background
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// CronSchedule is a parsed five field cron expression:
+// minute, hour, day of month, month and day of week
+type CronSchedule struct {
+    minute, hour, dom, month, dow uint64
+    // As in cron, when both day fields are restricted a time matches if
+    // either of them does
+    domAny, dowAny bool
+}
+
+var cronMacros = map[string]string{
+    "@hourly":  "0 * * * *",
+    "@daily":   "0 0 * * *",
+    "@weekly":  "0 0 * * 0",
+    "@monthly": "0 0 1 * *",
+}
+
+// ParseCron parses an expression such as "*/20 * * * *" or "30 3 * * 1-5".
+// Fields accept *, numbers, ranges, lists and steps; day of week runs from
+// 0 (Sunday) to 6, with 7 also meaning Sunday. @hourly, @daily, @weekly and
+// @monthly are accepted as well.
+func ParseCron(expression string) (*CronSchedule, error) {
+    expression = strings.TrimSpace(expression)
+    if macro, ok := cronMacros[expression]; ok {
+        expression = macro
+    }
+
+    fields := strings.Fields(expression)
+    if len(fields) != 5 {
+        return nil, fmt.Errorf("cron expression %q must have 5 fields", expression)
+    }
+
+    var schedule CronSchedule
+    var err error
+    if schedule.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+        return nil, fmt.Errorf("minute: %v", err)
+    }
+    if schedule.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+        return nil, fmt.Errorf("hour: %v", err)
+    }
+    if schedule.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+        return nil, fmt.Errorf("day of month: %v", err)
+    }
+    if schedule.month, err = parseCronField(fields[3], 1, 12); err != nil {
+        return nil, fmt.Errorf("month: %v", err)
+    }
+    if schedule.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+        return nil, fmt.Errorf("day of week: %v", err)
+    }
+    if schedule.dow&(1<<7) != 0 {
+        schedule.dow |= 1
+    }
+    schedule.domAny = fields[2] == "*"
+    schedule.dowAny = fields[4] == "*"
+    return &schedule, nil
+}
+
+// parseCronField returns the values a field matches as a bit set
+func parseCronField(field string, min, max int) (uint64, error) {
+    var bits uint64
+    for _, part := range strings.Split(field, ",") {
+        step := 1
+        if i := strings.Index(part, "/"); i >= 0 {
+            var err error
+            step, err = strconv.Atoi(part[i+1:])
+            if err != nil || step <= 0 {
+                return 0, fmt.Errorf("invalid step in %q", part)
+            }
+            part = part[:i]
+        }
+
+        low, high := min, max
+        switch {
+        case part == "*":
+        case strings.Contains(part, "-"):
+            bounds := strings.SplitN(part, "-", 2)
+            var err1, err2 error
+            low, err1 = strconv.Atoi(bounds[0])
+            high, err2 = strconv.Atoi(bounds[1])
+            if err1 != nil || err2 != nil {
+                return 0, fmt.Errorf("invalid range %q", part)
+            }
+        default:
+            value, err := strconv.Atoi(part)
+            if err != nil {
+                return 0, fmt.Errorf("invalid value %q", part)
+            }
+            low, high = value, value
+            if step > 1 {
+                // "5/15" means every 15 starting at 5
+                high = max
+            }
+        }
+        if low < min || high > max || low > high {
+            return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+        }
+
+        for value := low; value <= high; value += step {
+            bits |= 1 << uint(value)
+        }
+    }
+    return bits, nil
+}
+
+// Next returns the first time after t that matches the schedule, in t's
+// location. It returns the zero time if nothing matches within five years,
+// such as for February 30th.
+func (s *CronSchedule) Next(t time.Time) time.Time {
+    t = t.Truncate(time.Minute).Add(time.Minute)
+    limit := t.AddDate(5, 0, 0)
+
+    for t.Before(limit) {
+        if s.month&(1<<uint(t.Month())) == 0 {
+            t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+            continue
+        }
+        if !s.matchesDay(t) {
+            t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+            continue
+        }
+        if s.hour&(1<<uint(t.Hour())) == 0 {
+            t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+            continue
+        }
+        if s.minute&(1<<uint(t.Minute())) == 0 {
+            t = t.Add(time.Minute)
+            continue
+        }
+        return t
+    }
+    return time.Time{}
+}
+
+func (s *CronSchedule) matchesDay(t time.Time) bool {
+    dom := s.dom&(1<<uint(t.Day())) != 0
+    dow := s.dow&(1<<uint(t.Weekday())) != 0
+    switch {
+    case s.domAny && s.dowAny:
+        return true
+    case s.domAny:
+        return dow
+    case s.dowAny:
+        return dom
+    default:
+        return dom || dow
+    }
+}
@@ -0,0 +1,55 @@
+package background
+
+import (
+    "testing"
+    "time"
+)
+
+func TestCronNext(t *testing.T) {
+    start := time.Date(2024, time.March, 15, 10, 7, 30, 0, time.UTC) // a Friday
+
+    tests := []struct {
+        expression string
+        want       time.Time
+    }{
+        {"*/20 * * * *", time.Date(2024, time.March, 15, 10, 20, 0, 0, time.UTC)},
+        {"0 * * * *", time.Date(2024, time.March, 15, 11, 0, 0, 0, time.UTC)},
+        {"@daily", time.Date(2024, time.March, 16, 0, 0, 0, 0, time.UTC)},
+        {"30 3 * * 1-5", time.Date(2024, time.March, 18, 3, 30, 0, 0, time.UTC)},
+        {"0 0 1 * *", time.Date(2024, time.April, 1, 0, 0, 0, 0, time.UTC)},
+        {"15,45 9 * * *", time.Date(2024, time.March, 16, 9, 15, 0, 0, time.UTC)},
+        {"0 12 29 2 *", time.Date(2028, time.February, 29, 12, 0, 0, 0, time.UTC)},
+        {"0 0 * * 7", time.Date(2024, time.March, 17, 0, 0, 0, 0, time.UTC)},
+        // Both day fields restricted: the 20th or any Monday
+        {"0 0 20 * 1", time.Date(2024, time.March, 18, 0, 0, 0, 0, time.UTC)},
+    }
+
+    for _, test := range tests {
+        schedule, err := ParseCron(test.expression)
+        if err != nil {
+            t.Errorf("ParseCron(%q) failed: %v", test.expression, err)
+            continue
+        }
+        if got := schedule.Next(start); !got.Equal(test.want) {
+            t.Errorf("Next(%q) = %v, want %v", test.expression, got, test.want)
+        }
+    }
+}
+
+func TestParseCronRejectsInvalidExpressions(t *testing.T) {
+    for _, expression := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+        if _, err := ParseCron(expression); err == nil {
+            t.Errorf("ParseCron(%q) succeeded", expression)
+        }
+    }
+}
+
+func TestCronNextWithoutMatch(t *testing.T) {
+    schedule, err := ParseCron("0 0 30 2 *")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if next := schedule.Next(time.Now()); !next.IsZero() {
+        t.Errorf("Next() = %v for February 30th", next)
+    }
+}
@@ -0,0 +1,433 @@
+package background
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "math/rand"
+    "strconv"
+    "sync"
+    "time"
+    "trademarkia/config"
+    "trademarkia/internal/db"
+
+    "github.com/lib/pq"
+)
+
+// Job statuses stored in jobs.status. A job that fails on its last attempt
+// is dead and stays in the table until an admin retries it.
+const (
+    JobQueued    = "queued"
+    JobRunning   = "running"
+    JobSucceeded = "succeeded"
+    JobDead      = "dead"
+)
+
+// Job is a unit of background work stored in the jobs table
+type Job struct {
+    ID          int64           `json:"id"`
+    Type        string          `json:"type"`
+    Payload     json.RawMessage `json:"payload"`
+    Status      string          `json:"status"`
+    Attempts    int             `json:"attempts"`
+    MaxAttempts int             `json:"max_attempts"`
+    RunAt       time.Time       `json:"run_at"`
+    LastError   *string         `json:"last_error,omitempty"`
+    CreatedAt   time.Time       `json:"created_at"`
+    UpdatedAt   time.Time       `json:"updated_at"`
+    CompletedAt *time.Time      `json:"completed_at,omitempty"`
+}
+
+// Decode unmarshals the job's payload into v
+func (j *Job) Decode(v interface{}) error {
+    return json.Unmarshal(j.Payload, v)
+}
+
+// LastAttempt reports whether a failure of the current run makes the job dead
+func (j *Job) LastAttempt() bool {
+    return j.Attempts >= j.MaxAttempts
+}
+
+// JobHandler runs one job. A returned error retries the job with exponential
+// backoff until its attempts are used up.
+type JobHandler func(ctx context.Context, job *Job) error
+
+// JobType describes how jobs of one type are run
+type JobType struct {
+    Handler     JobHandler
+    MaxAttempts int
+    // Concurrency is the most jobs of this type one instance runs at once
+    Concurrency int
+    // Timeout cancels a run; a run whose instance died is retried once its
+    // timeout has passed
+    Timeout time.Duration
+}
+
+var (
+    jobTypes = map[string]JobType{}
+
+    // jobSlots counts the running jobs per type on this instance
+    jobSlots   = map[string]int{}
+    jobSlotsMu sync.Mutex
+
+    // jobWake wakes an idle worker when a job is enqueued on this instance
+    jobWake = make(chan struct{}, 1)
+)
+
+const (
+    jobPollInterval = 2 * time.Second
+    jobBaseBackoff  = 30 * time.Second
+    jobMaxBackoff   = time.Hour
+    jobRetention    = 7 * 24 * time.Hour
+
+    scheduledRunRetention = 30 * 24 * time.Hour
+)
+
+// RegisterJob makes jobs of the given type runnable. It must be called
+// before StartJobWorkers.
+func RegisterJob(name string, jobType JobType) {
+    if jobType.MaxAttempts <= 0 {
+        jobType.MaxAttempts = 5
+    }
+    if jobType.Concurrency <= 0 {
+        jobType.Concurrency = 1
+    }
+    if jobType.Timeout <= 0 {
+        jobType.Timeout = 10 * time.Minute
+    }
+    jobTypes[name] = jobType
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx
+type queryRower interface {
+    QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Enqueue adds a job to run as soon as a worker is free
+func Enqueue(jobType string, payload interface{}) (int64, error) {
+    return enqueue(db.DB, jobType, payload)
+}
+
+// EnqueueTx adds a job as part of tx, so it only runs if tx commits
+func EnqueueTx(tx *sql.Tx, jobType string, payload interface{}) (int64, error) {
+    return enqueue(tx, jobType, payload)
+}
+
+func enqueue(q queryRower, jobType string, payload interface{}) (int64, error) {
+    registered, ok := jobTypes[jobType]
+    if !ok {
+        return 0, fmt.Errorf("unknown job type %q", jobType)
+    }
+    data, err := json.Marshal(payload)
+    if err != nil {
+        return 0, err
+    }
+
+    var id int64
+    err = q.QueryRow("INSERT INTO jobs (type, payload, max_attempts) VALUES ($1, $2, $3) RETURNING id",
+        jobType, data, registered.MaxAttempts).Scan(&id)
+    if err != nil {
+        return 0, err
+    }
+
+    select {
+    case jobWake <- struct{}{}:
+    default:
+    }
+    return id, nil
+}
+
+// enqueueUnlessPending adds a job unless one of the same type is already
+// queued or running, for periodic work that must not pile up. It returns 0
+// when a job is already pending. Instances enqueueing at the same moment are
+// serialized by a transaction-level advisory lock, so only one of them adds
+// the job.
+func enqueueUnlessPending(jobType string, payload interface{}) (int64, error) {
+    registered, ok := jobTypes[jobType]
+    if !ok {
+        return 0, fmt.Errorf("unknown job type %q", jobType)
+    }
+    data, err := json.Marshal(payload)
+    if err != nil {
+        return 0, err
+    }
+
+    tx, err := db.DB.Begin()
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", leaseKey("enqueue:"+jobType)); err != nil {
+        return 0, err
+    }
+    var id int64
+    err = tx.QueryRow(`INSERT INTO jobs (type, payload, max_attempts)
+        SELECT $1, $2, $3 WHERE NOT EXISTS (SELECT 1 FROM jobs WHERE type = $1 AND status IN ($4, $5))
+        RETURNING id`, jobType, data, registered.MaxAttempts, JobQueued, JobRunning).Scan(&id)
+    if err == sql.ErrNoRows {
+        return 0, nil
+    }
+    if err != nil {
+        return 0, err
+    }
+    if err := tx.Commit(); err != nil {
+        return 0, err
+    }
+
+    select {
+    case jobWake <- struct{}{}:
+    default:
+    }
+    return id, nil
+}
+
+// StartJobWorkers starts JOB_WORKERS workers (default 4) and the reaper that
+// requeues jobs abandoned by crashed instances
+func StartJobWorkers() {
+    workers, err := strconv.Atoi(config.GetEnv("JOB_WORKERS", "4"))
+    if err != nil || workers <= 0 {
+        log.Println("Invalid value for JOB_WORKERS, using 4")
+        workers = 4
+    }
+
+    for i := 0; i < workers; i++ {
+        go runJobWorker()
+    }
+    go reapJobs()
+}
+
+func runJobWorker() {
+    for {
+        job, err := claimJob()
+        if err != nil {
+            log.Printf("Error claiming job: %v", err)
+        }
+        if job == nil {
+            select {
+            case <-jobWake:
+            case <-time.After(jobPollInterval):
+            }
+            continue
+        }
+
+        runJob(job)
+
+        jobSlotsMu.Lock()
+        jobSlots[job.Type]--
+        jobSlotsMu.Unlock()
+    }
+}
+
+// claimJob locks the next due job of a type with a free slot on this
+// instance. SKIP LOCKED lets every instance claim concurrently without
+// handing the same job out twice.
+func claimJob() (*Job, error) {
+    jobSlotsMu.Lock()
+    defer jobSlotsMu.Unlock()
+
+    var available []string
+    for name, jobType := range jobTypes {
+        if jobSlots[name] < jobType.Concurrency {
+            available = append(available, name)
+        }
+    }
+    if len(available) == 0 {
+        return nil, nil
+    }
+
+    job, err := scanJob(db.DB.QueryRow(`UPDATE jobs SET status = $1, attempts = attempts + 1, updated_at = NOW(),
+            locked_until = NOW() + make_interval(secs => $2)
+        WHERE id = (
+            SELECT id FROM jobs WHERE status = $3 AND run_at <= NOW() AND type = ANY($4)
+            ORDER BY run_at, id
+            LIMIT 1
+            FOR UPDATE SKIP LOCKED)
+        RETURNING `+jobColumns, JobRunning, leaseSeconds(), JobQueued, pq.Array(available)))
+    if err == sql.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    jobSlots[job.Type]++
+    return job, nil
+}
+
+// leaseSeconds is how long a claimed job stays locked to its worker. It
+// covers the longest timeout so a running job is never reaped.
+func leaseSeconds() float64 {
+    longest := time.Duration(0)
+    for _, jobType := range jobTypes {
+        if jobType.Timeout > longest {
+            longest = jobType.Timeout
+        }
+    }
+    return (longest + time.Minute).Seconds()
+}
+
+// runJob runs a claimed job and records the outcome. The final update only
+// applies while the job is still this run's, in case it was reaped.
+func runJob(job *Job) {
+    jobType := jobTypes[job.Type]
+    ctx, cancel := context.WithTimeout(context.Background(), jobType.Timeout)
+    defer cancel()
+
+    start := time.Now()
+    err := runHandler(ctx, jobType.Handler, job)
+    if err == nil {
+        _, err = db.DB.Exec(`UPDATE jobs SET status = $1, last_error = NULL, locked_until = NULL, completed_at = NOW(), updated_at = NOW()
+            WHERE id = $2 AND status = $3 AND attempts = $4`, JobSucceeded, job.ID, JobRunning, job.Attempts)
+        if err != nil {
+            log.Printf("Error completing job %d: %v", job.ID, err)
+        }
+        log.Printf("Job %d (%s) succeeded in %v", job.ID, job.Type, time.Since(start))
+        return
+    }
+
+    if job.LastAttempt() {
+        log.Printf("Job %d (%s) failed on attempt %d and is dead: %v", job.ID, job.Type, job.Attempts, err)
+        _, err = db.DB.Exec(`UPDATE jobs SET status = $1, last_error = $2, locked_until = NULL, completed_at = NOW(), updated_at = NOW()
+            WHERE id = $3 AND status = $4 AND attempts = $5`, JobDead, err.Error(), job.ID, JobRunning, job.Attempts)
+    } else {
+        backoff := jobBackoff(job.Attempts)
+        log.Printf("Job %d (%s) failed on attempt %d, retrying in %v: %v", job.ID, job.Type, job.Attempts, backoff, err)
+        _, err = db.DB.Exec(`UPDATE jobs SET status = $1, last_error = $2, locked_until = NULL, run_at = NOW() + make_interval(secs => $3), updated_at = NOW()
+            WHERE id = $4 AND status = $5 AND attempts = $6`, JobQueued, err.Error(), backoff.Seconds(), job.ID, JobRunning, job.Attempts)
+    }
+    if err != nil {
+        log.Printf("Error recording failure of job %d: %v", job.ID, err)
+    }
+}
+
+// runHandler turns a panicking handler into a failed run
+func runHandler(ctx context.Context, handler JobHandler, job *Job) (err error) {
+    defer func() {
+        if recovered := recover(); recovered != nil {
+            err = fmt.Errorf("panic: %v", recovered)
+        }
+    }()
+    return handler(ctx, job)
+}
+
+// jobBackoff returns the delay before the next attempt: 30 seconds doubling
+// per attempt up to an hour, with up to 20% jitter so failed jobs do not
+// retry in lockstep
+func jobBackoff(attempts int) time.Duration {
+    if attempts < 1 {
+        attempts = 1
+    }
+    backoff := jobMaxBackoff
+    if attempts < 12 {
+        backoff = jobBaseBackoff << uint(attempts-1)
+    }
+    if backoff > jobMaxBackoff {
+        backoff = jobMaxBackoff
+    }
+    return backoff + time.Duration(rand.Int63n(int64(backoff)/5+1))
+}
+
+// reapJobs requeues jobs whose worker died, and removes succeeded jobs and
+// scheduled run records once they are older than their retention period
+func reapJobs() {
+    ticker := time.NewTicker(time.Minute)
+    for range ticker.C {
+        result, err := db.DB.Exec(`UPDATE jobs SET
+                status = CASE WHEN attempts >= max_attempts THEN $1 ELSE $2 END,
+                completed_at = CASE WHEN attempts >= max_attempts THEN NOW() END,
+                last_error = 'worker stopped before the job finished', locked_until = NULL, updated_at = NOW()
+            WHERE status = $3 AND locked_until < NOW()`, JobDead, JobQueued, JobRunning)
+        if err != nil {
+            log.Printf("Error requeueing abandoned jobs: %v", err)
+        } else if count, _ := result.RowsAffected(); count > 0 {
+            log.Printf("Requeued %d abandoned jobs", count)
+        }
+
+        _, err = db.DB.Exec("DELETE FROM jobs WHERE status = $1 AND completed_at < $2", JobSucceeded, time.Now().Add(-jobRetention))
+        if err != nil {
+            log.Printf("Error removing old jobs: %v", err)
+        }
+        _, err = db.DB.Exec("DELETE FROM scheduled_runs WHERE started_at < $1", time.Now().Add(-scheduledRunRetention))
+        if err != nil {
+            log.Printf("Error removing old scheduled runs: %v", err)
+        }
+        _, err = db.DB.Exec("DELETE FROM reconciliation_reports WHERE started_at < $1", time.Now().Add(-scheduledRunRetention))
+        if err != nil {
+            log.Printf("Error removing old reconciliation reports: %v", err)
+        }
+        _, err = db.DB.Exec("DELETE FROM outbox WHERE status = $1 AND processed_at < $2", OutboxDone, time.Now().Add(-jobRetention))
+        if err != nil {
+            log.Printf("Error removing relayed outbox events: %v", err)
+        }
+    }
+}
+
+const jobColumns = "id, type, payload, status, attempts, max_attempts, run_at, last_error, created_at, updated_at, completed_at"
+
+func scanJob(row interface{ Scan(...interface{}) error }) (*Job, error) {
+    var job Job
+    var payload []byte
+    var lastError sql.NullString
+    var completedAt sql.NullTime
+    err := row.Scan(&job.ID, &job.Type, &payload, &job.Status, &job.Attempts, &job.MaxAttempts, &job.RunAt,
+        &lastError, &job.CreatedAt, &job.UpdatedAt, &completedAt)
+    if err != nil {
+        return nil, err
+    }
+    job.Payload = payload
+    if lastError.Valid {
+        job.LastError = &lastError.String
+    }
+    if completedAt.Valid {
+        job.CompletedAt = &completedAt.Time
+    }
+    return &job, nil
+}
+
+// ListJobs returns the most recently updated jobs, optionally filtered by
+// status and type
+func ListJobs(status, jobType string, limit int) ([]Job, error) {
+    rows, err := db.DB.Query(`SELECT `+jobColumns+` FROM jobs
+        WHERE ($1 = '' OR status = $1) AND ($2 = '' OR type = $2)
+        ORDER BY updated_at DESC, id DESC LIMIT $3`, status, jobType, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    jobs := []Job{}
+    for rows.Next() {
+        job, err := scanJob(rows)
+        if err != nil {
+            return nil, err
+        }
+        jobs = append(jobs, *job)
+    }
+    return jobs, rows.Err()
+}
+
+// GetJob returns one job, or sql.ErrNoRows
+func GetJob(id int64) (*Job, error) {
+    return scanJob(db.DB.QueryRow("SELECT "+jobColumns+" FROM jobs WHERE id = $1", id))
+}
+
+// RetryJob requeues a dead job with a fresh set of attempts. It reports
+// false when the job does not exist or is not dead.
+func RetryJob(id int64) (bool, error) {
+    result, err := db.DB.Exec(`UPDATE jobs SET status = $1, attempts = 0, run_at = NOW(), completed_at = NULL, updated_at = NOW()
+        WHERE id = $2 AND status = $3`, JobQueued, id, JobDead)
+    if err != nil {
+        return false, err
+    }
+    count, err := result.RowsAffected()
+    if count > 0 {
+        select {
+        case jobWake <- struct{}{}:
+        default:
+        }
+    }
+    return count > 0, err
+}
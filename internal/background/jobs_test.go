@@ -0,0 +1,40 @@
+package background
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+)
+
+func TestJobBackoffGrowsUpToAnHour(t *testing.T) {
+    previous := time.Duration(0)
+    for attempts := 1; attempts <= 20; attempts++ {
+        backoff := jobBackoff(attempts)
+        base := jobBaseBackoff << uint(attempts-1)
+        if attempts >= 12 || base > jobMaxBackoff {
+            base = jobMaxBackoff
+        }
+        if backoff < base || backoff > base+base/5 {
+            t.Errorf("jobBackoff(%d) = %v, want between %v and %v", attempts, backoff, base, base+base/5)
+        }
+        if base < previous {
+            t.Errorf("Backoff shrank at attempt %d", attempts)
+        }
+        previous = base
+    }
+}
+
+func TestRunHandlerRecoversPanics(t *testing.T) {
+    err := runHandler(context.Background(), func(ctx context.Context, job *Job) error {
+        panic("boom")
+    }, &Job{})
+    if err == nil || err.Error() != "panic: boom" {
+        t.Errorf("runHandler() = %v, want the panic as an error", err)
+    }
+
+    want := errors.New("failed")
+    if err := runHandler(context.Background(), func(ctx context.Context, job *Job) error { return want }, &Job{}); err != want {
+        t.Errorf("runHandler() = %v, want %v", err, want)
+    }
+}
@@ -0,0 +1,89 @@
+package background
+
+import (
+    "context"
+    "database/sql"
+    "database/sql/driver"
+    "hash/fnv"
+    "log"
+    "time"
+    "trademarkia/internal/db"
+)
+
+// leaseCheckInterval is how often the connection holding a lease is checked
+var leaseCheckInterval = 10 * time.Second
+
+// leaseKey maps a lease name to a Postgres advisory lock key
+func leaseKey(name string) int64 {
+    h := fnv.New64a()
+    h.Write([]byte("lease:" + name))
+    return int64(h.Sum64())
+}
+
+// withLease runs fn while holding the cluster-wide lease called name, so only
+// one instance runs it at a time. It reports false without running fn when
+// another instance holds the lease.
+//
+// The lease is a session-level advisory lock on a dedicated connection.
+// Postgres releases it as soon as the connection dies, and another instance
+// can take it over right away. The connection is only checked every
+// leaseCheckInterval, so fn can keep running for up to that long alongside
+// the new holder before its context is cancelled. There is no fencing token:
+// fn must be safe to run twice at once, as the expiry sweep and storage
+// reconciliation are.
+func withLease(ctx context.Context, name string, fn func(ctx context.Context) error) (bool, error) {
+    conn, err := db.DB.Conn(ctx)
+    if err != nil {
+        return false, err
+    }
+    defer conn.Close()
+
+    key := leaseKey(name)
+    var acquired bool
+    if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired); err != nil {
+        return false, err
+    }
+    if !acquired {
+        return false, nil
+    }
+
+    leaseCtx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    watched := make(chan struct{})
+    go func() {
+        defer close(watched)
+        watchLease(leaseCtx, cancel, conn, name)
+    }()
+
+    err = fn(leaseCtx)
+    // The watcher must be done with the connection before it is unlocked
+    // and returned to the pool
+    cancel()
+    <-watched
+
+    if _, unlockErr := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key); unlockErr != nil {
+        // Discarding the connection instead of returning it to the pool
+        // releases the lock as well
+        log.Printf("Error releasing lease %s: %v", name, unlockErr)
+        conn.Raw(func(driverConn interface{}) error { return driver.ErrBadConn })
+    }
+    return true, err
+}
+
+// watchLease cancels the lease holder when its connection stops responding
+func watchLease(ctx context.Context, cancel context.CancelFunc, conn *sql.Conn, name string) {
+    ticker := time.NewTicker(leaseCheckInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            if err := conn.PingContext(ctx); err != nil && ctx.Err() == nil {
+                log.Printf("Lost lease %s: %v", name, err)
+                cancel()
+                return
+            }
+        }
+    }
+}
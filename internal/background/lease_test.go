@@ -0,0 +1,74 @@
+package background
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+    "trademarkia/internal/db"
+
+    "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestWithLeaseSkipsWhenHeldElsewhere(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectQuery("SELECT pg_try_advisory_lock").WithArgs(leaseKey("sweep")).
+        WillReturnRows(sqlmock.NewRows([]string{"acquired"}).AddRow(false))
+
+    ran, err := withLease(context.Background(), "sweep", func(ctx context.Context) error {
+        t.Error("fn ran without the lease")
+        return nil
+    })
+    if ran || err != nil {
+        t.Errorf("withLease() = %v, %v, want false, nil", ran, err)
+    }
+}
+
+func TestWithLeaseReleasesAfterRunning(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectQuery("SELECT pg_try_advisory_lock").WithArgs(leaseKey("sweep")).
+        WillReturnRows(sqlmock.NewRows([]string{"acquired"}).AddRow(true))
+    mock.ExpectExec("SELECT pg_advisory_unlock").WithArgs(leaseKey("sweep")).
+        WillReturnResult(sqlmock.NewResult(0, 0))
+
+    failure := errors.New("sweep failed")
+    ran, err := withLease(context.Background(), "sweep", func(ctx context.Context) error {
+        return failure
+    })
+    if !ran || err != failure {
+        t.Errorf("withLease() = %v, %v, want true and the error of fn", ran, err)
+    }
+}
+
+func TestWithLeaseCancelsWhenTheConnectionIsLost(t *testing.T) {
+    conn, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+    if err != nil {
+        t.Fatal(err)
+    }
+    previous, previousInterval := db.DB, leaseCheckInterval
+    db.DB, leaseCheckInterval = conn, time.Millisecond
+    defer func() {
+        db.DB, leaseCheckInterval = previous, previousInterval
+        conn.Close()
+    }()
+
+    mock.ExpectQuery("SELECT pg_try_advisory_lock").
+        WillReturnRows(sqlmock.NewRows([]string{"acquired"}).AddRow(true))
+    mock.ExpectPing().WillReturnError(errors.New("connection reset"))
+    mock.ExpectExec("SELECT pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+    ran, err := withLease(context.Background(), "sweep", func(ctx context.Context) error {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(time.Second):
+            return errors.New("still running after the lease was lost")
+        }
+    })
+    if !ran || err != context.Canceled {
+        t.Errorf("withLease() = %v, %v, want true, context.Canceled", ran, err)
+    }
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Error(err)
+    }
+}
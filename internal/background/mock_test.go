@@ -0,0 +1,36 @@
+package background
+
+import (
+    "testing"
+    "trademarkia/internal/db"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// mockDB replaces db.DB with a sqlmock connection for the duration of a test
+// and checks that every expected statement ran
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+    t.Helper()
+    conn, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatal(err)
+    }
+    previous := db.DB
+    db.DB = conn
+    t.Cleanup(func() {
+        if err := mock.ExpectationsWereMet(); err != nil {
+            t.Error(err)
+        }
+        db.DB = previous
+        conn.Close()
+    })
+    return mock
+}
+
+// mockS3 replaces s3session for the duration of a test
+func mockS3(t *testing.T, client s3iface.S3API) {
+    previous := s3session
+    s3session = client
+    t.Cleanup(func() { s3session = previous })
+}
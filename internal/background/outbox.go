@@ -0,0 +1,241 @@
+package background
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "time"
+    "trademarkia/internal/cache"
+    "trademarkia/internal/db"
+    "trademarkia/internal/mail"
+
+    "github.com/lib/pq"
+)
+
+// Kinds of outbox events. Each is one side effect, so a failing storage
+// delete is retried without sending its notification again.
+const (
+    OutboxStorageDelete   = "storage_delete"
+    OutboxCacheInvalidate = "cache_invalidate"
+    OutboxNotify          = "notify"
+)
+
+// Statuses of an outbox event
+const (
+    OutboxPending = "pending"
+    OutboxDone    = "done"
+    OutboxFailed  = "failed"
+)
+
+const (
+    outboxMaxAttempts = 10
+    outboxLease       = time.Minute
+    // outboxTimeout bounds a handler well inside the lease, leaving time to
+    // record the outcome before another relay can claim the event again
+    outboxTimeout = 30 * time.Second
+)
+
+// StorageDeletePayload removes objects from the bucket. A key that a files
+// row still uses, such as a file uploaded again under the same name, is kept.
+type StorageDeletePayload struct {
+    Keys []string `json:"keys"`
+}
+
+// CacheInvalidatePayload drops the cached records of files and the listings
+// of the users in Audience
+type CacheInvalidatePayload struct {
+    FileIDs  []int `json:"file_ids"`
+    Audience []int `json:"audience"`
+}
+
+// NotifyPayload emails a user. The address is looked up when the event is
+// relayed, and the event is dropped if the user no longer exists.
+type NotifyPayload struct {
+    UserID  int    `json:"user_id"`
+    Subject string `json:"subject"`
+    Body    string `json:"body"`
+}
+
+type outboxEvent struct {
+    ID       int64
+    Kind     string
+    Payload  []byte
+    Attempts int
+}
+
+var outboxHandlers = map[string]func(ctx context.Context, payload []byte) error{
+    OutboxStorageDelete:   relayStorageDelete,
+    OutboxCacheInvalidate: relayCacheInvalidate,
+    OutboxNotify:          relayNotify,
+}
+
+// outboxWake wakes the relay when an event is written on this instance
+var outboxWake = make(chan struct{}, 1)
+
+// WriteOutbox records a side effect as part of tx. The relay performs it
+// once tx commits, and retries it until it succeeds, so handlers must be
+// safe to run more than once. Call WakeOutboxRelay after the commit.
+func WriteOutbox(tx *sql.Tx, kind string, payload interface{}) error {
+    if _, ok := outboxHandlers[kind]; !ok {
+        return fmt.Errorf("unknown outbox event %q", kind)
+    }
+    data, err := json.Marshal(payload)
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec("INSERT INTO outbox (kind, payload) VALUES ($1, $2)", kind, data)
+    return err
+}
+
+// WakeOutboxRelay tells the relay on this instance that events were
+// committed, so they are performed without waiting for the next poll
+func WakeOutboxRelay() {
+    select {
+    case outboxWake <- struct{}{}:
+    default:
+    }
+}
+
+// StartOutboxRelay performs the side effects written to the outbox. Every
+// instance runs a relay; events are leased with SKIP LOCKED, and an event
+// whose relay stopped is picked up again when its lease expires.
+func StartOutboxRelay() {
+    go func() {
+        for {
+            event, err := claimOutboxEvent()
+            if err != nil {
+                log.Printf("Error claiming outbox event: %v", err)
+            }
+            if event == nil {
+                select {
+                case <-outboxWake:
+                case <-time.After(jobPollInterval):
+                }
+                continue
+            }
+            relayOutboxEvent(*event)
+        }
+    }()
+}
+
+// claimOutboxEvent leases the oldest pending event, or returns nil when there
+// is none. Events are claimed one at a time, so each lease starts when its
+// event is performed rather than while earlier ones are still running.
+func claimOutboxEvent() (*outboxEvent, error) {
+    var event outboxEvent
+    err := db.DB.QueryRow(`UPDATE outbox SET attempts = attempts + 1, locked_until = NOW() + make_interval(secs => $1)
+        WHERE id = (
+            SELECT id FROM outbox WHERE status = $2 AND next_attempt_at <= NOW() AND (locked_until IS NULL OR locked_until < NOW())
+            ORDER BY id
+            LIMIT 1
+            FOR UPDATE SKIP LOCKED)
+        RETURNING id, kind, payload, attempts`, outboxLease.Seconds(), OutboxPending).
+        Scan(&event.ID, &event.Kind, &event.Payload, &event.Attempts)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &event, nil
+}
+
+// relayOutboxEvent performs one event and records the outcome, as long as
+// the event was not claimed again in the meantime
+func relayOutboxEvent(event outboxEvent) {
+    ctx, cancel := context.WithTimeout(context.Background(), outboxTimeout)
+    defer cancel()
+
+    err := fmt.Errorf("unknown outbox event %q", event.Kind)
+    if handler, ok := outboxHandlers[event.Kind]; ok {
+        err = handler(ctx, event.Payload)
+    }
+
+    if err == nil {
+        _, err = db.DB.Exec(`UPDATE outbox SET status = $1, last_error = NULL, locked_until = NULL, processed_at = NOW()
+            WHERE id = $2 AND attempts = $3`, OutboxDone, event.ID, event.Attempts)
+        if err != nil {
+            log.Printf("Error completing outbox event %d: %v", event.ID, err)
+        }
+        return
+    }
+
+    status := OutboxPending
+    if event.Attempts >= outboxMaxAttempts {
+        status = OutboxFailed
+        log.Printf("Outbox event %d (%s) failed for good: %v", event.ID, event.Kind, err)
+    } else {
+        log.Printf("Outbox event %d (%s) failed on attempt %d: %v", event.ID, event.Kind, event.Attempts, err)
+    }
+    _, dbErr := db.DB.Exec(`UPDATE outbox SET status = $1, last_error = $2, locked_until = NULL, next_attempt_at = $3
+        WHERE id = $4 AND attempts = $5`, status, err.Error(), time.Now().Add(jobBackoff(event.Attempts)), event.ID, event.Attempts)
+    if dbErr != nil {
+        log.Printf("Error recording failure of outbox event %d: %v", event.ID, dbErr)
+    }
+}
+
+func relayStorageDelete(ctx context.Context, data []byte) error {
+    var payload StorageDeletePayload
+    if err := json.Unmarshal(data, &payload); err != nil {
+        return err
+    }
+
+    keys, err := unreferencedKeys(payload.Keys)
+    if err != nil {
+        return fmt.Errorf("checking keys: %v", err)
+    }
+    return deleteAllObjects(ctx, s3session, keys)
+}
+
+// unreferencedKeys returns the keys no files row uses, leaving out the rows
+// in ignoreIDs, which are about to be deleted
+func unreferencedKeys(keys []string, ignoreIDs ...int) ([]string, error) {
+    if ignoreIDs == nil {
+        // id <> ALL(NULL) is never true
+        ignoreIDs = []int{}
+    }
+    var referenced []string
+    if err := db.DB.QueryRow("SELECT COALESCE(array_agg(DISTINCT object_key), '{}') FROM files WHERE object_key = ANY($1) AND id <> ALL($2)",
+        pq.Array(keys), pq.Array(ignoreIDs)).Scan(pq.Array(&referenced)); err != nil {
+        return nil, err
+    }
+    skip := make(map[string]bool, len(referenced))
+    for _, key := range referenced {
+        skip[key] = true
+    }
+
+    var unreferenced []string
+    for _, key := range keys {
+        if !skip[key] {
+            unreferenced = append(unreferenced, key)
+        }
+    }
+    return unreferenced, nil
+}
+
+func relayCacheInvalidate(ctx context.Context, data []byte) error {
+    var payload CacheInvalidatePayload
+    if err := json.Unmarshal(data, &payload); err != nil {
+        return err
+    }
+    return cache.Invalidate(ctx, payload.FileIDs, payload.Audience)
+}
+
+func relayNotify(ctx context.Context, data []byte) error {
+    var payload NotifyPayload
+    if err := json.Unmarshal(data, &payload); err != nil {
+        return err
+    }
+
+    var email string
+    err := db.DB.QueryRow("SELECT email FROM users WHERE id = $1", payload.UserID).Scan(&email)
+    if err == sql.ErrNoRows {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    return mail.Default.Send(mail.Message{To: email, Subject: payload.Subject, Body: payload.Body})
+}
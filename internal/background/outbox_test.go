@@ -0,0 +1,103 @@
+package background
+
+import (
+    "context"
+    "errors"
+    "strings"
+    "testing"
+
+    "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestUnreferencedKeysLeavesOutKeysInUse(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectQuery("SELECT COALESCE\\(array_agg\\(DISTINCT object_key\\), '\\{\\}'\\) FROM files").
+        WithArgs(`{"a.pdf","b.pdf","c.pdf"}`, "{}").
+        WillReturnRows(sqlmock.NewRows([]string{"array_agg"}).AddRow("{b.pdf}"))
+
+    keys, err := unreferencedKeys([]string{"a.pdf", "b.pdf", "c.pdf"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if strings.Join(keys, ",") != "a.pdf,c.pdf" {
+        t.Errorf("keys = %v, want a.pdf and c.pdf", keys)
+    }
+}
+
+func TestUnreferencedKeysIgnoresRowsAboutToBeDeleted(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectQuery("SELECT COALESCE\\(array_agg").WithArgs(`{"a.pdf"}`, "{4,5}").
+        WillReturnRows(sqlmock.NewRows([]string{"array_agg"}).AddRow("{}"))
+
+    if keys, err := unreferencedKeys([]string{"a.pdf"}, 4, 5); err != nil || len(keys) != 1 {
+        t.Errorf("unreferencedKeys() = %v, %v, want a.pdf", keys, err)
+    }
+}
+
+func TestRelayStorageDeleteKeepsKeysInUse(t *testing.T) {
+    client := &fakeS3{}
+    mockS3(t, client)
+    mock := mockDB(t)
+    mock.ExpectQuery("SELECT COALESCE\\(array_agg").
+        WillReturnRows(sqlmock.NewRows([]string{"array_agg"}).AddRow("{b.pdf}"))
+
+    if err := relayStorageDelete(context.Background(), []byte(`{"keys": ["a.pdf", "b.pdf"]}`)); err != nil {
+        t.Fatal(err)
+    }
+    if strings.Join(client.deleted, ",") != "a.pdf" {
+        t.Errorf("deleted = %v, want only a.pdf", client.deleted)
+    }
+}
+
+func TestRelayOutboxEventRecordsTheOutcome(t *testing.T) {
+    tests := []struct {
+        name     string
+        s3Err    error
+        attempts int
+        status   string
+    }{
+        {"success", nil, 1, OutboxDone},
+        {"failure is retried", errors.New("connection reset"), 1, OutboxPending},
+        {"last attempt fails for good", errors.New("connection reset"), outboxMaxAttempts, OutboxFailed},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            mockS3(t, &fakeS3{err: test.s3Err})
+            mock := mockDB(t)
+            mock.ExpectQuery("SELECT COALESCE\\(array_agg").
+                WillReturnRows(sqlmock.NewRows([]string{"array_agg"}).AddRow("{}"))
+            if test.status == OutboxDone {
+                mock.ExpectExec("UPDATE outbox SET status = \\$1, last_error = NULL").
+                    WithArgs(OutboxDone, 7, test.attempts).WillReturnResult(sqlmock.NewResult(0, 1))
+            } else {
+                // Matching the attempt count keeps a relay whose lease ran out
+                // from overwriting the outcome of the next one
+                mock.ExpectExec("UPDATE outbox SET status = \\$1, last_error = \\$2").
+                    WithArgs(test.status, sqlmock.AnyArg(), sqlmock.AnyArg(), 7, test.attempts).
+                    WillReturnResult(sqlmock.NewResult(0, 1))
+            }
+
+            relayOutboxEvent(outboxEvent{ID: 7, Kind: OutboxStorageDelete, Payload: []byte(`{"keys": ["a.pdf"]}`), Attempts: test.attempts})
+        })
+    }
+}
+
+func TestRelayOutboxEventFailsUnknownKinds(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectExec("UPDATE outbox SET status = \\$1, last_error = \\$2").
+        WithArgs(OutboxPending, `unknown outbox event "fax"`, sqlmock.AnyArg(), 8, 1).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+
+    relayOutboxEvent(outboxEvent{ID: 8, Kind: "fax", Payload: []byte(`{}`), Attempts: 1})
+}
+
+func TestClaimOutboxEventReturnsNilWhenIdle(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectQuery("UPDATE outbox SET attempts = attempts \\+ 1").WithArgs(outboxLease.Seconds(), OutboxPending).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "kind", "payload", "attempts"}))
+
+    if event, err := claimOutboxEvent(); event != nil || err != nil {
+        t.Errorf("claimOutboxEvent() = %v, %v, want nil, nil", event, err)
+    }
+}
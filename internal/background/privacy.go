@@ -0,0 +1,468 @@
+package background
+
+import (
+    "archive/zip"
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "time"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "github.com/aws/aws-sdk-go/service/s3/s3iface"
+    "github.com/lib/pq"
+    "trademarkia/internal/cache"
+    "trademarkia/internal/db"
+    "trademarkia/internal/mail"
+    "trademarkia/internal/models"
+)
+
+// Export statuses stored in data_exports.status
+const (
+    ExportPending   = "pending"
+    ExportRunning   = "running"
+    ExportCompleted = "completed"
+    ExportFailed    = "failed"
+)
+
+type exportProfile struct {
+    ID            int       `json:"id"`
+    Username      *string   `json:"username"`
+    Email         string    `json:"email"`
+    EmailVerified bool      `json:"email_verified"`
+    Role          string    `json:"role"`
+    CreatedAt     time.Time `json:"created_at"`
+}
+
+type exportFile struct {
+    ID         int       `json:"file_id"`
+    FileName   string    `json:"file_name"`
+    ObjectKey  string    `json:"-"`
+    FileURL    *string   `json:"file_url"`
+    FileSize   int64     `json:"file_size"`
+    UploadDate time.Time `json:"upload_date"`
+}
+
+type exportShareLink struct {
+    FileID    int       `json:"file_id"`
+    CreatedAt time.Time `json:"created_at"`
+    ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Job types for personal data requests
+const (
+    JobDataExport      = "data_export"
+    JobAccountDeletion = "account_deletion"
+    JobPurgeExports    = "purge_exports"
+)
+
+// ExportRetention is how long a completed export can be downloaded before
+// its archive is removed from S3
+const ExportRetention = 7 * 24 * time.Hour
+
+// DataExportPayload is the payload of a data_export job
+type DataExportPayload struct {
+    ExportID int `json:"export_id"`
+}
+
+// AccountDeletionPayload is the payload of an account_deletion job
+type AccountDeletionPayload struct {
+    UserID int `json:"user_id"`
+}
+
+func init() {
+    RegisterJob(JobDataExport, JobType{
+        Handler: func(ctx context.Context, job *Job) error {
+            var payload DataExportPayload
+            if err := job.Decode(&payload); err != nil {
+                return err
+            }
+            return runUserExport(ctx, payload.ExportID, job.LastAttempt())
+        },
+        MaxAttempts: 3,
+        Concurrency: 2,
+        Timeout:     30 * time.Minute,
+    })
+    RegisterJob(JobAccountDeletion, JobType{
+        Handler: func(ctx context.Context, job *Job) error {
+            var payload AccountDeletionPayload
+            if err := job.Decode(&payload); err != nil {
+                return err
+            }
+            return deleteUserAccount(ctx, payload.UserID)
+        },
+        MaxAttempts: 10,
+        Concurrency: 2,
+        Timeout:     30 * time.Minute,
+    })
+    RegisterJob(JobPurgeExports, JobType{
+        Handler: func(ctx context.Context, job *Job) error {
+            return purgeExpiredExports(ctx, s3session)
+        },
+        MaxAttempts: 3,
+        Concurrency: 1,
+        Timeout:     15 * time.Minute,
+    })
+    RegisterSchedule(JobPurgeExports, "30 * * * *")
+}
+
+// runUserExport builds an export. A failed build leaves the export pending
+// for the next attempt, and marks it failed once no attempts are left.
+func runUserExport(ctx context.Context, exportID int, lastAttempt bool) error {
+    var userID int
+    err := db.DB.QueryRow("UPDATE data_exports SET status = $1 WHERE id = $2 RETURNING user_id", ExportRunning, exportID).Scan(&userID)
+    if err == sql.ErrNoRows {
+        // The account, and its exports with it, was deleted in the meantime
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("starting export %d: %v", exportID, err)
+    }
+
+    key, email, err := buildUserExport(ctx, exportID, userID)
+    if err != nil {
+        status := ExportPending
+        if lastAttempt {
+            status = ExportFailed
+        }
+        if _, updateErr := db.DB.Exec("UPDATE data_exports SET status = $1, error = $2, completed_at = CASE WHEN $1 = $4 THEN NOW() END WHERE id = $3",
+            status, err.Error(), exportID, ExportFailed); updateErr != nil {
+            log.Printf("Error recording failure of export %d: %v", exportID, updateErr)
+        }
+        return fmt.Errorf("building export %d: %v", exportID, err)
+    }
+
+    if _, err := db.DB.Exec("UPDATE data_exports SET status = $1, s3_key = $2, error = NULL, completed_at = NOW() WHERE id = $3", ExportCompleted, key, exportID); err != nil {
+        return fmt.Errorf("completing export %d: %v", exportID, err)
+    }
+
+    log.Printf("Export %d for user %d completed", exportID, userID)
+    err = mail.Default.Send(mail.Message{
+        To:      email,
+        Subject: "Your data export is ready",
+        Body:    fmt.Sprintf("The export of your account data is ready. Download it with GET /me/export/%d within 7 days.", exportID),
+    })
+    if err != nil {
+        log.Printf("Error sending export notification: %v", err)
+    }
+    return nil
+}
+
+// buildUserExport writes the user's profile, file metadata, share links and
+// the files themselves to a ZIP archive and uploads it to S3
+func buildUserExport(ctx context.Context, exportID, userID int) (string, string, error) {
+    var profile exportProfile
+    var username sql.NullString
+    err := db.DB.QueryRow("SELECT id, username, email, email_verified, role, created_at FROM users WHERE id = $1", userID).
+        Scan(&profile.ID, &username, &profile.Email, &profile.EmailVerified, &profile.Role, &profile.CreatedAt)
+    if err != nil {
+        return "", "", fmt.Errorf("loading profile: %v", err)
+    }
+    if username.Valid {
+        profile.Username = &username.String
+    }
+
+    files, err := loadExportFiles(userID)
+    if err != nil {
+        return "", "", fmt.Errorf("loading files: %v", err)
+    }
+
+    shareLinks, err := loadExportShareLinks(userID)
+    if err != nil {
+        return "", "", fmt.Errorf("loading share links: %v", err)
+    }
+
+    archive, err := os.CreateTemp("", fmt.Sprintf("export-%d-*.zip", exportID))
+    if err != nil {
+        return "", "", err
+    }
+    defer os.Remove(archive.Name())
+    defer archive.Close()
+
+    zw := zip.NewWriter(archive)
+    if err := writeJSONEntry(zw, "profile.json", profile); err != nil {
+        return "", "", err
+    }
+    if err := writeJSONEntry(zw, "files.json", files); err != nil {
+        return "", "", err
+    }
+    if err := writeJSONEntry(zw, "share_links.json", shareLinks); err != nil {
+        return "", "", err
+    }
+    for _, file := range files {
+        if err := writeS3Entry(ctx, zw, fmt.Sprintf("files/%d_%s", file.ID, file.FileName), file.ObjectKey); err != nil {
+            return "", "", err
+        }
+    }
+    if err := zw.Close(); err != nil {
+        return "", "", err
+    }
+
+    if _, err := archive.Seek(0, io.SeekStart); err != nil {
+        return "", "", err
+    }
+
+    key := fmt.Sprintf("exports/user_%d/export_%d.zip", userID, exportID)
+    _, err = s3session.PutObjectWithContext(ctx, &s3.PutObjectInput{
+        Bucket:               aws.String("trademarkiaa"),
+        Key:                  aws.String(key),
+        Body:                 archive,
+        ContentType:          aws.String("application/zip"),
+        ContentDisposition:   aws.String("attachment"),
+        ServerSideEncryption: aws.String("AES256"),
+    })
+    if err != nil {
+        return "", "", fmt.Errorf("uploading export: %v", err)
+    }
+
+    return key, profile.Email, nil
+}
+
+// purgeExpiredExports removes the archives of exports older than
+// ExportRetention from S3 and clears their keys, in batches of up to 1000
+func purgeExpiredExports(ctx context.Context, client s3iface.S3API) error {
+    purged := 0
+    for {
+        rows, err := db.DB.Query(`SELECT id, s3_key FROM data_exports
+            WHERE status = $1 AND s3_key IS NOT NULL AND completed_at < $2 ORDER BY id LIMIT $3`,
+            ExportCompleted, time.Now().Add(-ExportRetention), expiryBatchSize)
+        if err != nil {
+            return fmt.Errorf("fetching expired exports: %v", err)
+        }
+        keys := make(map[string]int)
+        var batch []string
+        for rows.Next() {
+            var id int
+            var key string
+            if err := rows.Scan(&id, &key); err != nil {
+                rows.Close()
+                return err
+            }
+            keys[key] = id
+            batch = append(batch, key)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+            return err
+        }
+
+        failures := deleteObjects(ctx, client, batch)
+        var ids []int
+        for _, key := range batch {
+            if _, failed := failures[key]; !failed {
+                ids = append(ids, keys[key])
+            }
+        }
+        if len(ids) > 0 {
+            if _, err := db.DB.Exec("UPDATE data_exports SET s3_key = NULL WHERE id = ANY($1)", pq.Array(ids)); err != nil {
+                return fmt.Errorf("clearing expired exports: %v", err)
+            }
+        }
+        purged += len(ids)
+
+        // Stop on failures rather than fetching the same batch again
+        if len(failures) > 0 {
+            return fmt.Errorf("%d of %d expired exports could not be deleted", len(failures), len(batch))
+        }
+        if len(batch) < expiryBatchSize {
+            break
+        }
+    }
+
+    if purged > 0 {
+        log.Printf("Removed %d expired data exports", purged)
+    }
+    return nil
+}
+
+func loadExportFiles(userID int) ([]exportFile, error) {
+    rows, err := db.DB.Query("SELECT id, file_name, object_key, file_url, file_size, upload_date FROM files WHERE user_id = $1 ORDER BY id", userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    files := []exportFile{}
+    for rows.Next() {
+        var file exportFile
+        var fileURL sql.NullString
+        if err := rows.Scan(&file.ID, &file.FileName, &file.ObjectKey, &fileURL, &file.FileSize, &file.UploadDate); err != nil {
+            return nil, err
+        }
+        if fileURL.Valid {
+            file.FileURL = &fileURL.String
+        }
+        files = append(files, file)
+    }
+    return files, rows.Err()
+}
+
+func loadExportShareLinks(userID int) ([]exportShareLink, error) {
+    rows, err := db.DB.Query("SELECT file_id, created_at, expires_at FROM share_links WHERE user_id = $1 ORDER BY created_at", userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    links := []exportShareLink{}
+    for rows.Next() {
+        var link exportShareLink
+        if err := rows.Scan(&link.FileID, &link.CreatedAt, &link.ExpiresAt); err != nil {
+            return nil, err
+        }
+        links = append(links, link)
+    }
+    return links, rows.Err()
+}
+
+func writeJSONEntry(zw *zip.Writer, name string, v interface{}) error {
+    entry, err := zw.Create(name)
+    if err != nil {
+        return err
+    }
+    encoder := json.NewEncoder(entry)
+    encoder.SetIndent("", "  ")
+    return encoder.Encode(v)
+}
+
+func writeS3Entry(ctx context.Context, zw *zip.Writer, name string, key string) error {
+    object, err := s3session.GetObjectWithContext(ctx, &s3.GetObjectInput{
+        Bucket: aws.String("trademarkiaa"),
+        Key:    aws.String(key),
+    })
+    if err != nil {
+        return fmt.Errorf("downloading %s: %v", key, err)
+    }
+    defer object.Body.Close()
+
+    entry, err := zw.Create(name)
+    if err != nil {
+        return err
+    }
+    _, err = io.Copy(entry, object.Body)
+    return err
+}
+
+// deleteUserAccount removes all of the user's objects from S3, then their rows
+// from Postgres. Objects that another user's file also points to are kept. Dependent rows (API keys, sessions, tokens, exports) go with
+// the user through ON DELETE CASCADE. Files the user uploaded to shared
+// workspaces stay with the workspace and are handed over to one of its
+// owners; workspaces where the user was the only member are deleted.
+func deleteUserAccount(ctx context.Context, userID int) error {
+    rows, err := db.DB.Query(`SELECT id, object_key FROM files
+        WHERE (user_id = $1 AND workspace_id IS NULL)
+        OR workspace_id IN (SELECT workspace_id FROM workspace_members member WHERE member.user_id = $1
+            AND NOT EXISTS (SELECT 1 FROM workspace_members other WHERE other.workspace_id = member.workspace_id AND other.user_id <> $1))`, userID)
+    if err != nil {
+        return err
+    }
+    var files []struct {
+        ID        int
+        ObjectKey string
+    }
+    for rows.Next() {
+        var file struct {
+            ID        int
+            ObjectKey string
+        }
+        if err := rows.Scan(&file.ID, &file.ObjectKey); err != nil {
+            rows.Close()
+            return err
+        }
+        files = append(files, file)
+    }
+    rows.Close()
+
+    // The objects go first, so that a failed deletion is retried with the
+    // rows still in place
+    fileIDs := make([]int, len(files))
+    objectKeys := make([]string, len(files))
+    for i, file := range files {
+        fileIDs[i], objectKeys[i] = file.ID, file.ObjectKey
+    }
+    keys, err := unreferencedKeys(objectKeys, fileIDs...)
+    if err != nil {
+        return fmt.Errorf("checking file references: %v", err)
+    }
+    if err := deleteAllObjects(ctx, s3session, keys); err != nil {
+        return fmt.Errorf("deleting files: %v", err)
+    }
+
+    for _, file := range files {
+        audience := cache.FileAudience(file.ID)
+        if _, err := db.DB.Exec("DELETE FROM files WHERE id = $1", file.ID); err != nil {
+            return err
+        }
+        cache.InvalidateFile(ctx, file.ID, audience)
+    }
+
+    _, err = db.DB.Exec(`DELETE FROM workspaces WHERE id IN (
+        SELECT workspace_id FROM workspace_members member WHERE member.user_id = $1
+        AND NOT EXISTS (SELECT 1 FROM workspace_members other WHERE other.workspace_id = member.workspace_id AND other.user_id <> $1))`, userID)
+    if err != nil {
+        return err
+    }
+
+    handedOver, err := db.DB.Query(`UPDATE files SET user_id = (
+            SELECT owner.user_id FROM workspace_members owner
+            WHERE owner.workspace_id = files.workspace_id AND owner.user_id <> $1 AND owner.role = $2
+            ORDER BY owner.created_at LIMIT 1)
+        WHERE user_id = $1 AND workspace_id IS NOT NULL
+        AND EXISTS (SELECT 1 FROM workspace_members owner
+            WHERE owner.workspace_id = files.workspace_id AND owner.user_id <> $1 AND owner.role = $2)
+        RETURNING id`, userID, models.WorkspaceOwner)
+    if err != nil {
+        return fmt.Errorf("handing over workspace files: %v", err)
+    }
+    var handedOverIDs []int
+    for handedOver.Next() {
+        var fileID int
+        if err := handedOver.Scan(&fileID); err == nil {
+            handedOverIDs = append(handedOverIDs, fileID)
+        }
+    }
+    handedOver.Close()
+    // The cached records and listings still name the deleted user as uploader
+    for _, fileID := range handedOverIDs {
+        cache.InvalidateFile(ctx, fileID, cache.FileAudience(fileID))
+    }
+
+    // A workspace can lose its last other owner after the deletion was
+    // requested. Its files keep the user, and the job fails until an owner
+    // is added, rather than deleting files other members still use.
+    var orphaned int
+    if err := db.DB.QueryRow("SELECT COUNT(*) FROM files WHERE user_id = $1", userID).Scan(&orphaned); err != nil {
+        return err
+    }
+    if orphaned > 0 {
+        return fmt.Errorf("%d workspace files have no other owner to hand over to", orphaned)
+    }
+
+    exportRows, err := db.DB.Query("SELECT s3_key FROM data_exports WHERE user_id = $1 AND s3_key IS NOT NULL", userID)
+    if err != nil {
+        return err
+    }
+    var exportKeys []string
+    for exportRows.Next() {
+        var key string
+        if err := exportRows.Scan(&key); err == nil {
+            exportKeys = append(exportKeys, key)
+        }
+    }
+    exportRows.Close()
+
+    if err := deleteAllObjects(ctx, s3session, exportKeys); err != nil {
+        return fmt.Errorf("deleting exports: %v", err)
+    }
+
+    if _, err := db.DB.Exec("DELETE FROM users WHERE id = $1", userID); err != nil {
+        return err
+    }
+
+    log.Printf("Deleted account %d with %d file(s)", userID, len(files))
+    return nil
+}
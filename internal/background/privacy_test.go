@@ -0,0 +1,251 @@
+package background
+
+import (
+    "archive/zip"
+    "bytes"
+    "context"
+    "io"
+    "io/ioutil"
+    "strings"
+    "testing"
+    "time"
+    "trademarkia/internal/mail"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/aws/request"
+    "github.com/aws/aws-sdk-go/service/s3"
+)
+
+func (f *fakeS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, options ...request.Option) (*s3.GetObjectOutput, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    data, ok := f.objects[aws.StringValue(input.Key)]
+    if !ok {
+        return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+    }
+    return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, options ...request.Option) (*s3.PutObjectOutput, error) {
+    data, err := io.ReadAll(input.Body)
+    if err != nil {
+        return nil, err
+    }
+    f.objects[aws.StringValue(input.Key)] = data
+    return &s3.PutObjectOutput{}, nil
+}
+
+// mailbox records the messages sent through mail.Default during a test
+type mailbox struct {
+    sent []mail.Message
+}
+
+func (m *mailbox) Send(msg mail.Message) error {
+    m.sent = append(m.sent, msg)
+    return nil
+}
+
+func mockMail(t *testing.T) *mailbox {
+    previous := mail.Default
+    box := &mailbox{}
+    mail.Default = box
+    t.Cleanup(func() { mail.Default = previous })
+    return box
+}
+
+func TestRunUserExportUploadsTheArchive(t *testing.T) {
+    client := &fakeS3{objects: map[string][]byte{"report.pdf": []byte("file contents")}}
+    mockS3(t, client)
+    box := mockMail(t)
+    mock := mockDB(t)
+    now := time.Now()
+
+    mock.ExpectQuery("UPDATE data_exports SET status").WithArgs(ExportRunning, 3).
+        WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+    mock.ExpectQuery("SELECT id, username, email, email_verified, role, created_at FROM users").WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "email_verified", "role", "created_at"}).
+            AddRow(1, nil, "user@example.com", true, "user", now))
+    // The file was renamed after upload, so its object is still under the old name
+    mock.ExpectQuery("SELECT id, file_name, object_key, file_url, file_size, upload_date FROM files").WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "file_name", "object_key", "file_url", "file_size", "upload_date"}).
+            AddRow(5, "q3-report.pdf", "report.pdf", nil, 13, now))
+    mock.ExpectQuery("SELECT file_id, created_at, expires_at FROM share_links").WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"file_id", "created_at", "expires_at"}))
+    mock.ExpectExec("UPDATE data_exports SET status = \\$1, s3_key = \\$2").
+        WithArgs(ExportCompleted, "exports/user_1/export_3.zip", 3).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+
+    if err := runUserExport(context.Background(), 3, false); err != nil {
+        t.Fatalf("runUserExport returned error: %v", err)
+    }
+
+    archive := client.objects["exports/user_1/export_3.zip"]
+    zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+    if err != nil {
+        t.Fatalf("export is not a ZIP archive: %v", err)
+    }
+    entries := make(map[string]string)
+    for _, entry := range zr.File {
+        r, _ := entry.Open()
+        data, _ := io.ReadAll(r)
+        r.Close()
+        entries[entry.Name] = string(data)
+    }
+    if !strings.Contains(entries["profile.json"], "user@example.com") || !strings.Contains(entries["files.json"], "q3-report.pdf") {
+        t.Errorf("unexpected profile or file metadata: %v", entries)
+    }
+    if entries["files/5_q3-report.pdf"] != "file contents" {
+        t.Errorf("file entry = %q, want the uploaded file", entries["files/5_q3-report.pdf"])
+    }
+    if len(box.sent) != 1 || box.sent[0].To != "user@example.com" {
+        t.Errorf("sent = %+v, want one notification to the user", box.sent)
+    }
+}
+
+func TestRunUserExportRetriesThenFails(t *testing.T) {
+    for _, lastAttempt := range []bool{false, true} {
+        mockS3(t, &fakeS3{objects: map[string][]byte{}})
+        mock := mockDB(t)
+        mock.ExpectQuery("UPDATE data_exports SET status").WithArgs(ExportRunning, 3).
+            WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+        mock.ExpectQuery("SELECT id, username, email, email_verified, role, created_at FROM users").
+            WillReturnError(io.ErrUnexpectedEOF)
+
+        want := ExportPending
+        if lastAttempt {
+            want = ExportFailed
+        }
+        mock.ExpectExec("UPDATE data_exports SET status = \\$1, error = \\$2").
+            WithArgs(want, sqlmock.AnyArg(), 3, ExportFailed).
+            WillReturnResult(sqlmock.NewResult(0, 1))
+
+        if err := runUserExport(context.Background(), 3, lastAttempt); err == nil {
+            t.Errorf("runUserExport(lastAttempt=%v) succeeded, want an error so the job is retried", lastAttempt)
+        }
+        if err := mock.ExpectationsWereMet(); err != nil {
+            t.Errorf("lastAttempt=%v: %v", lastAttempt, err)
+        }
+    }
+}
+
+func TestRunUserExportStopsWhenTheJobTimesOut(t *testing.T) {
+    client := &fakeS3{objects: map[string][]byte{"report.pdf": []byte("file contents")}}
+    mockS3(t, client)
+    mock := mockDB(t)
+    now := time.Now()
+
+    mock.ExpectQuery("UPDATE data_exports SET status").WithArgs(ExportRunning, 3).
+        WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+    mock.ExpectQuery("SELECT id, username, email, email_verified, role, created_at FROM users").WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "email_verified", "role", "created_at"}).
+            AddRow(1, nil, "user@example.com", true, "user", now))
+    mock.ExpectQuery("SELECT id, file_name, object_key, file_url, file_size, upload_date FROM files").WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "file_name", "object_key", "file_url", "file_size", "upload_date"}).
+            AddRow(5, "report.pdf", "report.pdf", nil, 13, now))
+    mock.ExpectQuery("SELECT file_id, created_at, expires_at FROM share_links").WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"file_id", "created_at", "expires_at"}))
+    mock.ExpectExec("UPDATE data_exports SET status = \\$1, error = \\$2").
+        WithArgs(ExportPending, sqlmock.AnyArg(), 3, ExportFailed).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    if err := runUserExport(ctx, 3, false); err == nil {
+        t.Fatal("runUserExport succeeded after its job timed out")
+    }
+    if _, ok := client.objects["exports/user_1/export_3.zip"]; ok {
+        t.Error("A timed out export was still uploaded")
+    }
+}
+
+func TestDeleteUserAccountKeepsObjectsOtherFilesUse(t *testing.T) {
+    client := &fakeS3{}
+    mockS3(t, client)
+    mock := mockDB(t)
+
+    mock.ExpectQuery("SELECT id, object_key FROM files").WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "object_key"}).AddRow(10, "mine.pdf").AddRow(11, "common.pdf"))
+    // Another user's file is also stored as common.pdf
+    mock.ExpectQuery("SELECT COALESCE\\(array_agg\\(DISTINCT object_key\\), '\\{\\}'\\) FROM files").
+        WithArgs(`{"mine.pdf","common.pdf"}`, "{10,11}").
+        WillReturnRows(sqlmock.NewRows([]string{"array_agg"}).AddRow("{common.pdf}"))
+    for _, fileID := range []int{10, 11} {
+        mock.ExpectQuery("SELECT user_id FROM files WHERE id").WithArgs(fileID).
+            WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+        mock.ExpectExec("DELETE FROM files WHERE id").WithArgs(fileID).WillReturnResult(sqlmock.NewResult(0, 1))
+    }
+    mock.ExpectExec("DELETE FROM workspaces").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectQuery("UPDATE files SET user_id").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(12))
+    mock.ExpectQuery("SELECT user_id FROM files WHERE id").WithArgs(12).
+        WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(2))
+    mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM files WHERE user_id").WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+    mock.ExpectQuery("SELECT s3_key FROM data_exports").WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"s3_key"}).AddRow("exports/user_1/export_3.zip"))
+    mock.ExpectExec("DELETE FROM users WHERE id").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+    if err := deleteUserAccount(context.Background(), 1); err != nil {
+        t.Fatalf("deleteUserAccount returned error: %v", err)
+    }
+    want := []string{"mine.pdf", "exports/user_1/export_3.zip"}
+    if strings.Join(client.deleted, ",") != strings.Join(want, ",") {
+        t.Errorf("deleted = %v, want %v", client.deleted, want)
+    }
+}
+
+func TestDeleteUserAccountKeepsRowsWhenStorageFails(t *testing.T) {
+    mockS3(t, &fakeS3{failed: map[string]string{"mine.pdf": "AccessDenied"}})
+    mock := mockDB(t)
+
+    mock.ExpectQuery("SELECT id, object_key FROM files").WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "object_key"}).AddRow(10, "mine.pdf"))
+    mock.ExpectQuery("SELECT COALESCE\\(array_agg").WillReturnRows(sqlmock.NewRows([]string{"array_agg"}).AddRow("{}"))
+
+    // Nothing is deleted from the database, so the retry finds the files again
+    if err := deleteUserAccount(context.Background(), 1); err == nil {
+        t.Fatal("deleteUserAccount succeeded although an object was not deleted")
+    }
+}
+
+func TestPurgeExpiredExports(t *testing.T) {
+    client := &fakeS3{failed: map[string]string{"exports/user_2/export_4.zip": "AccessDenied"}}
+    mock := mockDB(t)
+
+    mock.ExpectQuery("SELECT id, s3_key FROM data_exports").WithArgs(ExportCompleted, sqlmock.AnyArg(), expiryBatchSize).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "s3_key"}).
+            AddRow(3, "exports/user_1/export_3.zip").
+            AddRow(4, "exports/user_2/export_4.zip"))
+    // Only the deleted archive loses its key, the other is tried again
+    mock.ExpectExec("UPDATE data_exports SET s3_key = NULL WHERE id = ANY").WithArgs("{3}").
+        WillReturnResult(sqlmock.NewResult(0, 1))
+
+    if err := purgeExpiredExports(context.Background(), client); err == nil {
+        t.Error("purgeExpiredExports succeeded although an archive was not deleted")
+    }
+    if len(client.deleted) != 1 || client.deleted[0] != "exports/user_1/export_3.zip" {
+        t.Errorf("deleted = %v", client.deleted)
+    }
+}
+
+func TestDeleteUserAccountStopsWhenAWorkspaceHasNoOwnerLeft(t *testing.T) {
+    mockS3(t, &fakeS3{})
+    mock := mockDB(t)
+
+    mock.ExpectQuery("SELECT id, object_key FROM files").WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "object_key"}))
+    mock.ExpectQuery("SELECT COALESCE\\(array_agg").WillReturnRows(sqlmock.NewRows([]string{"array_agg"}).AddRow("{}"))
+    mock.ExpectExec("DELETE FROM workspaces").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 0))
+    // The file's workspace has members but no other owner, so the guarded
+    // UPDATE leaves it alone
+    mock.ExpectQuery("UPDATE files SET user_id .* AND EXISTS").WithArgs(1, "owner").
+        WillReturnRows(sqlmock.NewRows([]string{"id"}))
+    mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM files WHERE user_id").WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+    if err := deleteUserAccount(context.Background(), 1); err == nil {
+        t.Fatal("deleteUserAccount deleted the user although a workspace file could not be handed over")
+    }
+}
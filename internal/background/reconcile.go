@@ -0,0 +1,371 @@
+package background
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "strings"
+    "time"
+    "trademarkia/config"
+    "trademarkia/internal/cache"
+    "trademarkia/internal/db"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// JobReconcileStorage compares the bucket with the files table
+const JobReconcileStorage = "reconcile_storage"
+
+const (
+    // reconcileGrace leaves recent objects and rows alone, since an upload
+    // puts its object before its row is committed
+    reconcileGrace = time.Hour
+    // reconcileSample is how many keys and rows a report lists
+    reconcileSample = 1000
+    // exportPrefix holds data exports, which have no files rows
+    exportPrefix = "exports/"
+)
+
+// ReconcilePayload is the payload of a reconcile_storage job. Without DryRun
+// the job repairs drift only when RECONCILE_REPAIR is true.
+type ReconcilePayload struct {
+    Trigger string `json:"trigger,omitempty"`
+    DryRun  *bool  `json:"dry_run,omitempty"`
+}
+
+// DanglingRow is a files row whose object is missing from the bucket
+type DanglingRow struct {
+    FileID    int    `json:"file_id"`
+    FileName  string `json:"file_name"`
+    ObjectKey string `json:"object_key"`
+}
+
+// ReconcileReport is the outcome of one reconciliation
+type ReconcileReport struct {
+    ID              int64         `json:"id"`
+    JobID           int64         `json:"job_id"`
+    DryRun          bool          `json:"dry_run"`
+    ObjectsScanned  int           `json:"objects_scanned"`
+    RowsScanned     int           `json:"rows_scanned"`
+    OrphanedObjects []string      `json:"orphaned_objects"`
+    DanglingRows    []DanglingRow `json:"dangling_rows"`
+    OrphansFound    int           `json:"orphans_found"`
+    DanglingFound   int           `json:"dangling_found"`
+    OrphansDeleted  int           `json:"orphans_deleted"`
+    RowsDeleted     int           `json:"rows_deleted"`
+    StartedAt       time.Time     `json:"started_at"`
+    FinishedAt      time.Time     `json:"finished_at"`
+}
+
+type storedObject struct {
+    Key          string
+    Size         int64
+    LastModified time.Time
+}
+
+type fileRow struct {
+    ID         int
+    FileName   string
+    ObjectKey  string
+    FileSize   int64
+    UploadDate time.Time
+}
+
+func init() {
+    RegisterJob(JobReconcileStorage, JobType{
+        Handler:     runReconciliation,
+        MaxAttempts: 3,
+        Concurrency: 1,
+        Timeout:     time.Hour,
+    })
+    RegisterSchedule(JobReconcileStorage, "0 3 * * *")
+}
+
+// QueueReconciliation queues a reconciliation unless one is already pending
+// and returns its job ID, or ErrRunPending
+func QueueReconciliation(dryRun bool) (int64, error) {
+    jobID, err := enqueueUnlessPending(JobReconcileStorage, ReconcilePayload{Trigger: TriggerManual, DryRun: &dryRun})
+    if err == nil && jobID == 0 {
+        err = ErrRunPending
+    }
+    return jobID, err
+}
+
+func runReconciliation(ctx context.Context, job *Job) error {
+    var payload ReconcilePayload
+    if err := job.Decode(&payload); err != nil {
+        return err
+    }
+    dryRun := config.GetEnv("RECONCILE_REPAIR", "false") != "true"
+    if payload.DryRun != nil {
+        dryRun = *payload.DryRun
+    }
+
+    var report *ReconcileReport
+    ran, err := withLease(ctx, JobReconcileStorage, func(ctx context.Context) error {
+        var err error
+        report, err = reconcileStorage(ctx, s3session, dryRun)
+        return err
+    })
+    if err != nil {
+        return err
+    }
+    if !ran {
+        log.Println("Another instance is reconciling storage, skipping this run")
+        return nil
+    }
+
+    report.JobID = job.ID
+    if err := saveReconcileReport(report); err != nil {
+        return fmt.Errorf("saving reconciliation report: %v", err)
+    }
+    log.Printf("Reconciliation found %d orphaned objects and %d dangling rows, deleted %d objects and %d rows (dry run: %v)",
+        report.OrphansFound, report.DanglingFound, report.OrphansDeleted, report.RowsDeleted, report.DryRun)
+    return nil
+}
+
+// reconcileStorage lists the bucket and the files table and reports objects
+// without a row and rows without an object. Unless dryRun is set it deletes
+// both, after checking each again so that files uploaded in the meantime
+// are kept.
+func reconcileStorage(ctx context.Context, client s3iface.S3API, dryRun bool) (*ReconcileReport, error) {
+    report := &ReconcileReport{DryRun: dryRun, StartedAt: time.Now()}
+    cutoff := report.StartedAt.Add(-reconcileGrace)
+
+    rows, err := loadFileRows()
+    if err != nil {
+        return nil, fmt.Errorf("loading files: %v", err)
+    }
+
+    var objects []storedObject
+    err = client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("trademarkiaa")},
+        func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+            for _, object := range page.Contents {
+                objects = append(objects, storedObject{Key: aws.StringValue(object.Key), Size: aws.Int64Value(object.Size), LastModified: aws.TimeValue(object.LastModified)})
+            }
+            return true
+        })
+    if err != nil {
+        return nil, fmt.Errorf("listing bucket: %v", err)
+    }
+
+    report.ObjectsScanned, report.RowsScanned = len(objects), len(rows)
+    orphans, dangling := diffStorage(objects, rows, cutoff)
+    report.OrphansFound, report.DanglingFound = len(orphans), len(dangling)
+
+    if !dryRun {
+        repairOrphans, repairDangling := withoutPossibleRenames(objects, orphans, dangling)
+        report.OrphansDeleted, err = deleteOrphanedObjects(ctx, client, repairOrphans)
+        if err != nil {
+            return nil, err
+        }
+        report.RowsDeleted, err = deleteDanglingRows(ctx, client, repairDangling)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    report.OrphanedObjects = orphans
+    if len(orphans) > reconcileSample {
+        report.OrphanedObjects = orphans[:reconcileSample]
+    }
+    report.DanglingRows = make([]DanglingRow, 0, len(dangling))
+    for i, row := range dangling {
+        if i == reconcileSample {
+            break
+        }
+        report.DanglingRows = append(report.DanglingRows, DanglingRow{FileID: row.ID, FileName: row.FileName, ObjectKey: row.ObjectKey})
+    }
+    report.FinishedAt = time.Now()
+    return report, nil
+}
+
+func loadFileRows() ([]fileRow, error) {
+    rows, err := db.DB.Query("SELECT id, file_name, object_key, file_size, upload_date FROM files")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var files []fileRow
+    for rows.Next() {
+        var file fileRow
+        if err := rows.Scan(&file.ID, &file.FileName, &file.ObjectKey, &file.FileSize, &file.UploadDate); err != nil {
+            return nil, err
+        }
+        files = append(files, file)
+    }
+    return files, rows.Err()
+}
+
+// diffStorage returns the keys of objects without a files row and the rows
+// without an object, matching objects on object_key so that renamed files
+// still own theirs. Objects and rows newer than cutoff, and data exports,
+// are left out.
+func diffStorage(objects []storedObject, rows []fileRow, cutoff time.Time) ([]string, []fileRow) {
+    referenced := make(map[string]bool, len(rows))
+    for _, row := range rows {
+        referenced[row.ObjectKey] = true
+    }
+
+    stored := make(map[string]bool, len(objects))
+    orphans := []string{}
+    for _, object := range objects {
+        stored[object.Key] = true
+        if strings.HasPrefix(object.Key, exportPrefix) || referenced[object.Key] || object.LastModified.After(cutoff) {
+            continue
+        }
+        orphans = append(orphans, object.Key)
+    }
+
+    dangling := []fileRow{}
+    for _, row := range rows {
+        if !stored[row.ObjectKey] && row.UploadDate.Before(cutoff) {
+            dangling = append(dangling, row)
+        }
+    }
+    return orphans, dangling
+}
+
+// withoutPossibleRenames leaves out the orphans and dangling rows of the same
+// size. Files renamed before object_key existed got their new name as key,
+// so such a pair may be one file whose row lost track of its object. Both
+// stay in the report for an admin to fix by hand.
+func withoutPossibleRenames(objects []storedObject, orphans []string, dangling []fileRow) ([]string, []fileRow) {
+    sizes := make(map[string]int64, len(objects))
+    for _, object := range objects {
+        sizes[object.Key] = object.Size
+    }
+    orphanSizes := make(map[int64]bool, len(orphans))
+    for _, key := range orphans {
+        orphanSizes[sizes[key]] = true
+    }
+    danglingSizes := make(map[int64]bool, len(dangling))
+    repairRows := []fileRow{}
+    for _, row := range dangling {
+        danglingSizes[row.FileSize] = true
+        if !orphanSizes[row.FileSize] {
+            repairRows = append(repairRows, row)
+        }
+    }
+    repairKeys := []string{}
+    for _, key := range orphans {
+        if !danglingSizes[sizes[key]] {
+            repairKeys = append(repairKeys, key)
+        }
+    }
+    return repairKeys, repairRows
+}
+
+// deleteOrphanedObjects deletes the orphans that still have no row
+func deleteOrphanedObjects(ctx context.Context, client s3iface.S3API, orphans []string) (int, error) {
+    deleted := 0
+    for start := 0; start < len(orphans); start += expiryBatchSize {
+        end := start + expiryBatchSize
+        if end > len(orphans) {
+            end = len(orphans)
+        }
+        keys, err := unreferencedKeys(orphans[start:end])
+        if err != nil {
+            return deleted, fmt.Errorf("checking orphaned objects: %v", err)
+        }
+
+        failures := deleteObjects(ctx, client, keys)
+        deleted += len(keys) - len(failures)
+    }
+    return deleted, nil
+}
+
+// deleteDanglingRows deletes the rows whose object is still missing
+func deleteDanglingRows(ctx context.Context, client s3iface.S3API, dangling []fileRow) (int, error) {
+    deleted := 0
+    for _, row := range dangling {
+        if err := ctx.Err(); err != nil {
+            return deleted, err
+        }
+
+        _, err := client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: aws.String("trademarkiaa"), Key: aws.String(row.ObjectKey)})
+        if err == nil {
+            continue
+        }
+        if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "NotFound" {
+            log.Printf("Error checking object of file %d: %v", row.ID, err)
+            continue
+        }
+
+        audience := cache.FileAudience(row.ID)
+        if _, err := db.DB.Exec("DELETE FROM files WHERE id = $1", row.ID); err != nil {
+            return deleted, fmt.Errorf("deleting dangling row %d: %v", row.ID, err)
+        }
+        cache.InvalidateFile(ctx, row.ID, audience)
+        deleted++
+    }
+    return deleted, nil
+}
+
+func saveReconcileReport(report *ReconcileReport) error {
+    details, err := json.Marshal(struct {
+        OrphanedObjects []string      `json:"orphaned_objects"`
+        DanglingRows    []DanglingRow `json:"dangling_rows"`
+    }{report.OrphanedObjects, report.DanglingRows})
+    if err != nil {
+        return err
+    }
+
+    return db.DB.QueryRow(`INSERT INTO reconciliation_reports (job_id, dry_run, objects_scanned, rows_scanned, orphans_found, dangling_found,
+            orphans_deleted, rows_deleted, details, started_at, finished_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
+        report.JobID, report.DryRun, report.ObjectsScanned, report.RowsScanned, report.OrphansFound, report.DanglingFound,
+        report.OrphansDeleted, report.RowsDeleted, details, report.StartedAt, report.FinishedAt).Scan(&report.ID)
+}
+
+const reconcileReportColumns = `id, job_id, dry_run, objects_scanned, rows_scanned, orphans_found, dangling_found,
+    orphans_deleted, rows_deleted, details, started_at, finished_at`
+
+func scanReconcileReport(row interface{ Scan(...interface{}) error }) (*ReconcileReport, error) {
+    var report ReconcileReport
+    var jobID sql.NullInt64
+    var details []byte
+    err := row.Scan(&report.ID, &jobID, &report.DryRun, &report.ObjectsScanned, &report.RowsScanned, &report.OrphansFound,
+        &report.DanglingFound, &report.OrphansDeleted, &report.RowsDeleted, &details, &report.StartedAt, &report.FinishedAt)
+    if err != nil {
+        return nil, err
+    }
+    report.JobID = jobID.Int64
+    if err := json.Unmarshal(details, &report); err != nil {
+        return nil, err
+    }
+    return &report, nil
+}
+
+// ListReconcileReports returns the most recent reports without their keys
+// and rows
+func ListReconcileReports(limit int) ([]ReconcileReport, error) {
+    rows, err := db.DB.Query("SELECT "+reconcileReportColumns+" FROM reconciliation_reports ORDER BY started_at DESC, id DESC LIMIT $1", limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    reports := []ReconcileReport{}
+    for rows.Next() {
+        report, err := scanReconcileReport(rows)
+        if err != nil {
+            return nil, err
+        }
+        report.OrphanedObjects, report.DanglingRows = nil, nil
+        reports = append(reports, *report)
+    }
+    return reports, rows.Err()
+}
+
+// GetReconcileReport returns one report with up to 1000 orphaned keys and
+// dangling rows, or sql.ErrNoRows
+func GetReconcileReport(id int64) (*ReconcileReport, error) {
+    return scanReconcileReport(db.DB.QueryRow("SELECT "+reconcileReportColumns+" FROM reconciliation_reports WHERE id = $1", id))
+}
@@ -0,0 +1,99 @@
+package background
+
+import (
+    "context"
+    "reflect"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/aws/request"
+    "github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ListObjectsV2PagesWithContext lists the fake's objects in one page, all
+// older than the reconciliation grace period
+func (f *fakeS3) ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, options ...request.Option) error {
+    page := &s3.ListObjectsV2Output{}
+    for key := range f.objects {
+        page.Contents = append(page.Contents, &s3.Object{Key: aws.String(key), Size: aws.Int64(int64(len(f.objects[key]))), LastModified: aws.Time(time.Now().Add(-2 * reconcileGrace))})
+    }
+    fn(page, true)
+    return nil
+}
+
+func (f *fakeS3) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, options ...request.Option) (*s3.HeadObjectOutput, error) {
+    if _, ok := f.objects[aws.StringValue(input.Key)]; !ok {
+        return nil, awserr.New("NotFound", "not found", nil)
+    }
+    return &s3.HeadObjectOutput{}, nil
+}
+
+func TestDiffStorage(t *testing.T) {
+    now := time.Now()
+    old, recent := now.Add(-2*reconcileGrace), now.Add(-time.Minute)
+
+    objects := []storedObject{
+        {Key: "kept.pdf", LastModified: old},
+        {Key: "orphan.pdf", LastModified: old},
+        {Key: "uploading.pdf", LastModified: recent},
+        {Key: "exports/7.zip", LastModified: old},
+    }
+    rows := []fileRow{
+        {ID: 1, FileName: "kept.pdf", ObjectKey: "kept.pdf", UploadDate: old},
+        {ID: 2, FileName: "missing.pdf", ObjectKey: "missing.pdf", UploadDate: old},
+        {ID: 3, FileName: "new.pdf", ObjectKey: "new.pdf", UploadDate: recent},
+    }
+
+    orphans, dangling := diffStorage(objects, rows, now.Add(-reconcileGrace))
+    if !reflect.DeepEqual(orphans, []string{"orphan.pdf"}) {
+        t.Errorf("orphans = %v, want [orphan.pdf]", orphans)
+    }
+    if len(dangling) != 1 || dangling[0].ID != 2 {
+        t.Errorf("dangling = %v, want only file 2", dangling)
+    }
+}
+
+func TestRepairKeepsRenamedFiles(t *testing.T) {
+    client := &fakeS3{objects: map[string][]byte{"report.pdf": []byte("file contents")}}
+    mock := mockDB(t)
+    // The file was uploaded as report.pdf and renamed long ago
+    mock.ExpectQuery("SELECT id, file_name, object_key, file_size, upload_date FROM files").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "file_name", "object_key", "file_size", "upload_date"}).
+            AddRow(1, "q3-report.pdf", "report.pdf", 13, time.Now().Add(-2*reconcileGrace)))
+
+    report, err := reconcileStorage(context.Background(), client, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.OrphansFound != 0 || report.DanglingFound != 0 {
+        t.Errorf("found %d orphans and %d dangling rows, want none", report.OrphansFound, report.DanglingFound)
+    }
+    if len(client.deleted) != 0 {
+        t.Errorf("repair deleted %v", client.deleted)
+    }
+}
+
+func TestRepairKeepsFilesRenamedBeforeObjectKeys(t *testing.T) {
+    client := &fakeS3{objects: map[string][]byte{"report.pdf": []byte("file contents"), "stray.tmp": []byte("x")}}
+    mock := mockDB(t)
+    // Renamed before object_key existed, so the key was backfilled with the new name
+    mock.ExpectQuery("SELECT id, file_name, object_key, file_size, upload_date FROM files").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "file_name", "object_key", "file_size", "upload_date"}).
+            AddRow(1, "q3-report.pdf", "q3-report.pdf", 13, time.Now().Add(-2*reconcileGrace)))
+    mock.ExpectQuery("SELECT COALESCE\\(array_agg").WithArgs(`{"stray.tmp"}`, "{}").
+        WillReturnRows(sqlmock.NewRows([]string{"array_agg"}).AddRow("{}"))
+
+    report, err := reconcileStorage(context.Background(), client, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.OrphansFound != 2 || report.DanglingFound != 1 {
+        t.Errorf("found %d orphans and %d dangling rows, want both reported", report.OrphansFound, report.DanglingFound)
+    }
+    if report.RowsDeleted != 0 || len(client.deleted) != 1 || client.deleted[0] != "stray.tmp" {
+        t.Errorf("repair deleted %v and %d rows, want only stray.tmp", client.deleted, report.RowsDeleted)
+    }
+}
@@ -0,0 +1,282 @@
+package background
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "log"
+    "strings"
+    "time"
+    "trademarkia/config"
+    "trademarkia/internal/db"
+)
+
+// Outcomes of a scheduled run stored in scheduled_runs.status
+const (
+    RunRunning   = "running"
+    RunSucceeded = "succeeded"
+    RunFailed    = "failed"
+)
+
+// How a scheduled run was started
+const (
+    TriggerSchedule = "schedule"
+    TriggerManual   = "manual"
+)
+
+const schedulerInterval = 30 * time.Second
+
+var (
+    // ErrUnknownSchedule is returned for a schedule that is not registered
+    ErrUnknownSchedule = errors.New("unknown schedule")
+    // ErrRunPending is returned when a run of the schedule is already queued
+    // or running
+    ErrRunPending = errors.New("a run is already pending")
+)
+
+// schedule is a recurring job. Its name is also the type of the job it
+// queues. A nil cron means the schedule is switched off.
+type schedule struct {
+    name       string
+    expression string
+    cron       *CronSchedule
+}
+
+var schedules []*schedule
+
+type scheduledPayload struct {
+    Trigger string `json:"trigger"`
+}
+
+// ScheduledRun is one run of a scheduled job
+type ScheduledRun struct {
+    ID         int64      `json:"id"`
+    JobID      *int64     `json:"job_id,omitempty"`
+    Trigger    string     `json:"trigger"`
+    Status     string     `json:"status"`
+    Error      *string    `json:"error,omitempty"`
+    StartedAt  time.Time  `json:"started_at"`
+    FinishedAt *time.Time `json:"finished_at,omitempty"`
+    DurationMS *int64     `json:"duration_ms,omitempty"`
+}
+
+// Schedule is a registered schedule with its next and last run
+type Schedule struct {
+    Name       string        `json:"name"`
+    Expression string        `json:"expression"`
+    Enabled    bool          `json:"enabled"`
+    NextRunAt  *time.Time    `json:"next_run_at,omitempty"`
+    LastRun    *ScheduledRun `json:"last_run,omitempty"`
+}
+
+// RegisterSchedule runs the job type called name on a cron schedule. The
+// expression is read from SCHEDULE_<NAME>, e.g. SCHEDULE_EXPIRE_FILES, and
+// "off" switches the schedule off. Every run of the job is recorded in
+// scheduled_runs. It must be called after RegisterJob and before
+// StartScheduler.
+func RegisterSchedule(name, defaultExpression string) {
+    jobType, ok := jobTypes[name]
+    if !ok {
+        log.Fatalf("Schedule %s has no job type", name)
+    }
+    jobType.Handler = recordRun(name, jobType.Handler)
+    jobTypes[name] = jobType
+
+    expression := strings.TrimSpace(config.GetEnv("SCHEDULE_"+strings.ToUpper(name), defaultExpression))
+    s := &schedule{name: name, expression: expression}
+    if expression != "off" {
+        cron, err := ParseCron(expression)
+        if err == nil && cron.Next(time.Now()).IsZero() {
+            err = errors.New("the expression never matches")
+        }
+        if err != nil {
+            log.Printf("Invalid schedule for %s, using %q: %v", name, defaultExpression, err)
+            s.expression = defaultExpression
+            cron, _ = ParseCron(defaultExpression)
+        }
+        s.cron = cron
+    }
+    schedules = append(schedules, s)
+}
+
+// recordRun wraps a job handler to record each run of a scheduled job
+func recordRun(name string, handler JobHandler) JobHandler {
+    return func(ctx context.Context, job *Job) error {
+        payload := scheduledPayload{Trigger: TriggerSchedule}
+        job.Decode(&payload)
+
+        var runID int64
+        err := db.DB.QueryRow("INSERT INTO scheduled_runs (name, job_id, trigger, status) VALUES ($1, $2, $3, $4) RETURNING id",
+            name, job.ID, payload.Trigger, RunRunning).Scan(&runID)
+        if err != nil {
+            log.Printf("Error recording run of %s: %v", name, err)
+        }
+
+        start := time.Now()
+        runErr := handler(ctx, job)
+
+        status, message := RunSucceeded, sql.NullString{}
+        if runErr != nil {
+            status, message = RunFailed, sql.NullString{String: runErr.Error(), Valid: true}
+        }
+        if runID != 0 {
+            _, err = db.DB.Exec("UPDATE scheduled_runs SET status = $1, error = $2, finished_at = NOW(), duration_ms = $3 WHERE id = $4",
+                status, message, time.Since(start).Milliseconds(), runID)
+            if err != nil {
+                log.Printf("Error recording outcome of %s: %v", name, err)
+            }
+        }
+        return runErr
+    }
+}
+
+// StartScheduler stores the registered schedules and queues their jobs when
+// they are due. Every instance runs the scheduler; a due run is claimed by
+// moving its next_run_at forward, which only one instance can do.
+func StartScheduler() {
+    now := time.Now().UTC()
+    for _, s := range schedules {
+        var next sql.NullTime
+        if s.cron != nil {
+            next = sql.NullTime{Time: s.cron.Next(now), Valid: true}
+        }
+        // A changed expression takes effect right away; otherwise the stored
+        // next run is kept, so a run missed while the server was down
+        // happens once on startup
+        _, err := db.DB.Exec(`INSERT INTO schedules (name, expression, next_run_at) VALUES ($1, $2, $3)
+            ON CONFLICT (name) DO UPDATE SET expression = EXCLUDED.expression, updated_at = NOW(),
+                next_run_at = CASE WHEN schedules.expression = EXCLUDED.expression AND schedules.next_run_at IS NOT NULL
+                    THEN schedules.next_run_at ELSE EXCLUDED.next_run_at END`,
+            s.name, s.expression, next)
+        if err != nil {
+            log.Printf("Error storing schedule %s: %v", s.name, err)
+        }
+    }
+
+    go func() {
+        ticker := time.NewTicker(schedulerInterval)
+        for range ticker.C {
+            runDueSchedules(time.Now().UTC())
+        }
+    }()
+}
+
+func runDueSchedules(now time.Time) {
+    for _, s := range schedules {
+        if s.cron == nil {
+            continue
+        }
+
+        var next sql.NullTime
+        if err := db.DB.QueryRow("SELECT next_run_at FROM schedules WHERE name = $1", s.name).Scan(&next); err != nil {
+            log.Printf("Error reading schedule %s: %v", s.name, err)
+            continue
+        }
+        if next.Valid && next.Time.After(now) {
+            continue
+        }
+
+        // Only the instance that moves next_run_at forward queues the run
+        result, err := db.DB.Exec("UPDATE schedules SET next_run_at = $1, updated_at = NOW() WHERE name = $2 AND next_run_at IS NOT DISTINCT FROM $3",
+            s.cron.Next(now), s.name, next)
+        if err != nil {
+            log.Printf("Error claiming run of %s: %v", s.name, err)
+            continue
+        }
+        if claimed, _ := result.RowsAffected(); claimed == 0 {
+            continue
+        }
+
+        if _, err := enqueueUnlessPending(s.name, scheduledPayload{Trigger: TriggerSchedule}); err != nil {
+            log.Printf("Error queueing %s: %v", s.name, err)
+        }
+    }
+}
+
+// RunScheduleNow queues a run of a schedule right away, whether or not it
+// is switched off. It returns the ID of the queued job.
+func RunScheduleNow(name string) (int64, error) {
+    if findSchedule(name) == nil {
+        return 0, ErrUnknownSchedule
+    }
+    jobID, err := enqueueUnlessPending(name, scheduledPayload{Trigger: TriggerManual})
+    if err == nil && jobID == 0 {
+        err = ErrRunPending
+    }
+    return jobID, err
+}
+
+func findSchedule(name string) *schedule {
+    for _, s := range schedules {
+        if s.name == name {
+            return s
+        }
+    }
+    return nil
+}
+
+// ListSchedules returns every registered schedule with its last run
+func ListSchedules() ([]Schedule, error) {
+    list := []Schedule{}
+    for _, s := range schedules {
+        item := Schedule{Name: s.name, Expression: s.expression, Enabled: s.cron != nil}
+
+        var next sql.NullTime
+        err := db.DB.QueryRow("SELECT next_run_at FROM schedules WHERE name = $1", s.name).Scan(&next)
+        if err != nil && err != sql.ErrNoRows {
+            return nil, err
+        }
+        if next.Valid && item.Enabled {
+            item.NextRunAt = &next.Time
+        }
+
+        runs, err := ListScheduledRuns(s.name, 1)
+        if err != nil {
+            return nil, err
+        }
+        if len(runs) > 0 {
+            item.LastRun = &runs[0]
+        }
+        list = append(list, item)
+    }
+    return list, nil
+}
+
+// ListScheduledRuns returns the most recent runs of a schedule
+func ListScheduledRuns(name string, limit int) ([]ScheduledRun, error) {
+    if findSchedule(name) == nil {
+        return nil, ErrUnknownSchedule
+    }
+
+    rows, err := db.DB.Query(`SELECT id, job_id, trigger, status, error, started_at, finished_at, duration_ms FROM scheduled_runs
+        WHERE name = $1 ORDER BY started_at DESC, id DESC LIMIT $2`, name, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    runs := []ScheduledRun{}
+    for rows.Next() {
+        var run ScheduledRun
+        var jobID, duration sql.NullInt64
+        var message sql.NullString
+        var finishedAt sql.NullTime
+        if err := rows.Scan(&run.ID, &jobID, &run.Trigger, &run.Status, &message, &run.StartedAt, &finishedAt, &duration); err != nil {
+            return nil, err
+        }
+        if jobID.Valid {
+            run.JobID = &jobID.Int64
+        }
+        if message.Valid {
+            run.Error = &message.String
+        }
+        if finishedAt.Valid {
+            run.FinishedAt = &finishedAt.Time
+        }
+        if duration.Valid {
+            run.DurationMS = &duration.Int64
+        }
+        runs = append(runs, run)
+    }
+    return runs, rows.Err()
+}
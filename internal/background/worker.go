@@ -4,101 +4,257 @@ import (
     "context"
     "fmt"
     "log"
+    "strconv"
+    "strings"
+    "sync"
     "time"
 
     "github.com/aws/aws-sdk-go/aws"
     "github.com/aws/aws-sdk-go/service/s3"
+    "github.com/aws/aws-sdk-go/service/s3/s3iface"
+    "github.com/lib/pq"
+    "trademarkia/config"
+    "trademarkia/internal/cache"
     "trademarkia/internal/db"
     "github.com/aws/aws-sdk-go/aws/session"
 )
 
-var (
-    s3session *s3.S3
-    ctx       = context.Background()
-)
+var s3session s3iface.S3API
+
+// JobExpireFiles deletes files older than 20 minutes
+const JobExpireFiles = "expire_files"
 
 func init() {
     s3session = s3.New(session.Must(session.NewSession(&aws.Config{
         Region: aws.String("ap-south-1"),
     })))
+
+    RegisterJob(JobExpireFiles, JobType{
+        Handler:     runExpirySweep,
+        MaxAttempts: 3,
+        Concurrency: 1,
+        Timeout:     15 * time.Minute,
+    })
+    RegisterSchedule(JobExpireFiles, "*/20 * * * *")
 }
 
-func StartFileDeletionWorker() {
-    ticker := time.NewTicker(20 * time.Minute)
+// runExpirySweep runs the sweep under a lease, so that when the job is
+// queued more than once only one instance deletes files at a time
+func runExpirySweep(ctx context.Context, job *Job) error {
+    ran, err := withLease(ctx, JobExpireFiles, deleteExpiredFiles)
+    if err == nil && !ran {
+        log.Println("Another instance is running the file expiry sweep, skipping this run")
+    }
+    return err
+}
 
-    go func() {
-        for {
-            select {
-            case <-ticker.C:
-                log.Println("Running background job for file deletion...")
-                deleteExpiredFiles()
-            }
+const (
+    // expiryBatchSize is the most keys S3 accepts in one DeleteObjects call
+    expiryBatchSize = 1000
+    // expiryFailureSample is how many failed keys are kept in the job error
+    expiryFailureSample = 10
+)
+
+type expiredFile struct {
+    ID        int
+    ObjectKey string
+}
+
+// expiryReport collects the outcome of a sweep across its workers
+type expiryReport struct {
+    mu       sync.Mutex
+    deleted  int
+    failed   int
+    failures []string
+}
+
+func (report *expiryReport) add(deleted int, failures map[string]string) {
+    report.mu.Lock()
+    defer report.mu.Unlock()
+
+    report.deleted += deleted
+    for key, reason := range failures {
+        report.failed++
+        if len(report.failures) < expiryFailureSample {
+            report.failures = append(report.failures, fmt.Sprintf("%s (%s)", key, reason))
         }
-    }()
+    }
 }
 
-func deleteExpiredFiles() {
-	expiryThreshold := time.Now().Add(-20 * time.Minute)
+// deleteExpiredFiles pages through the expired files in batches, which
+// EXPIRY_WORKERS workers (default 4) delete from S3 and the database. It
+// fails with a sample of the failed keys if any file could not be deleted,
+// so the job is retried. It stops early when ctx is cancelled, such as when
+// the lease is lost.
+func deleteExpiredFiles(ctx context.Context) error {
+    expiryThreshold := time.Now().Add(-20 * time.Minute)
+
+    workers, err := strconv.Atoi(config.GetEnv("EXPIRY_WORKERS", "4"))
+    if err != nil || workers <= 0 {
+        log.Println("Invalid value for EXPIRY_WORKERS, using 4")
+        workers = 4
+    }
 
+    report := &expiryReport{}
+    batches := make(chan []expiredFile)
+    var wg sync.WaitGroup
+    for i := 0; i < workers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for batch := range batches {
+                report.add(deleteExpiredBatch(ctx, s3session, batch))
+            }
+        }()
+    }
+
+    // Keyset pagination, so rows that fail to delete are not read again
+    lastID := 0
+    for ctx.Err() == nil {
+        batch, err := fetchExpiredBatch(expiryThreshold, lastID)
+        if err != nil {
+            close(batches)
+            wg.Wait()
+            return fmt.Errorf("fetching expired files: %v", err)
+        }
+        if len(batch) == 0 {
+            break
+        }
+        batches <- batch
+        lastID = batch[len(batch)-1].ID
+    }
+    close(batches)
+    wg.Wait()
+
+    log.Printf("File expiry sweep deleted %d files, %d failed", report.deleted, report.failed)
+    if err := ctx.Err(); err != nil {
+        return fmt.Errorf("sweep stopped after deleting %d files: %v", report.deleted, err)
+    }
+    if report.failed > 0 {
+        return fmt.Errorf("%d of %d expired files could not be deleted: %s",
+            report.failed, report.deleted+report.failed, strings.Join(report.failures, ", "))
+    }
+    return nil
+}
 
-    rows, err := db.DB.Query("SELECT id, file_name FROM files WHERE upload_date < $1", expiryThreshold)
+func fetchExpiredBatch(threshold time.Time, afterID int) ([]expiredFile, error) {
+    rows, err := db.DB.Query("SELECT id, object_key FROM files WHERE upload_date < $1 AND id > $2 ORDER BY id LIMIT $3",
+        threshold, afterID, expiryBatchSize)
     if err != nil {
-        log.Printf("Error fetching expired files: %v", err)
-        return
+        return nil, err
     }
     defer rows.Close()
 
-    var expiredFiles []struct {
-        ID       int
-        FileName string
+    var batch []expiredFile
+    for rows.Next() {
+        var file expiredFile
+        if err := rows.Scan(&file.ID, &file.ObjectKey); err != nil {
+            return nil, err
+        }
+        batch = append(batch, file)
     }
+    return batch, rows.Err()
+}
 
-    for rows.Next() {
-        var fileID int
-        var fileName string
-        if err := rows.Scan(&fileID, &fileName); err != nil {
-            log.Printf("Error scanning expired files: %v", err)
-            continue
+// deleteExpiredBatch deletes a batch of files from S3 in one call, then the
+// rows of the files whose objects are gone. It returns how many files were
+// deleted and the reason each failed key could not be.
+func deleteExpiredBatch(ctx context.Context, client s3iface.S3API, batch []expiredFile) (int, map[string]string) {
+    keys := make([]string, 0, len(batch))
+    seen := make(map[string]bool)
+    for _, file := range batch {
+        if !seen[file.ObjectKey] {
+            seen[file.ObjectKey] = true
+            keys = append(keys, file.ObjectKey)
         }
-        expiredFiles = append(expiredFiles, struct {
-            ID       int
-            FileName string
-        }{fileID, fileName})
     }
 
-    for _, file := range expiredFiles {
-        err := deleteFileFromS3(file.FileName)
-        if err != nil {
-            log.Printf("Error deleting file from S3: %v", err)
-            continue
+    // A key that a newer upload reuses stays in the bucket with its row
+    batchIDs := make([]int, len(batch))
+    for i, file := range batch {
+        batchIDs[i] = file.ID
+    }
+    unreferenced, err := unreferencedKeys(keys, batchIDs...)
+    if err != nil {
+        failures := make(map[string]string, len(keys))
+        for _, key := range keys {
+            failures[key] = "database: " + err.Error()
         }
+        return 0, failures
+    }
+    failures := deleteObjects(ctx, client, unreferenced)
 
-        _, err = db.DB.Exec("DELETE FROM files WHERE id = $1", file.ID)
-        if err != nil {
-            log.Printf("Error deleting file metadata from DB: %v", err)
-            continue
+    var fileIDs []int
+    for _, file := range batch {
+        if _, failed := failures[file.ObjectKey]; !failed {
+            fileIDs = append(fileIDs, file.ID)
         }
+    }
+    if len(fileIDs) == 0 {
+        return 0, failures
+    }
 
-        log.Printf("Deleted file and metadata for file ID: %d", file.ID)
+    audiences := cache.FileAudiences(fileIDs)
+    if _, err := db.DB.Exec("DELETE FROM files WHERE id = ANY($1)", pq.Array(fileIDs)); err != nil {
+        log.Printf("Error deleting metadata of %d expired files: %v", len(fileIDs), err)
+        for _, file := range batch {
+            if _, failed := failures[file.ObjectKey]; !failed {
+                failures[file.ObjectKey] = "database: " + err.Error()
+            }
+        }
+        return 0, failures
+    }
+    for _, fileID := range fileIDs {
+        cache.InvalidateFile(ctx, fileID, audiences[fileID])
     }
+    return len(fileIDs), failures
 }
 
-func deleteFileFromS3(fileName string) error {
-    _, err := s3session.DeleteObject(&s3.DeleteObjectInput{
-        Bucket: aws.String("trademarkiaa"), 
-        Key:    aws.String(fileName),       
-    })
-    if err != nil {
-        return fmt.Errorf("failed to delete object %s from S3: %v", fileName, err)
+// deleteObjects removes up to 1000 keys with a single DeleteObjects call and
+// returns the reason for every key that was not deleted. S3 is strongly
+// consistent, so there is no need to wait for the objects to disappear.
+func deleteObjects(ctx context.Context, client s3iface.S3API, keys []string) map[string]string {
+    failures := make(map[string]string)
+    if len(keys) == 0 {
+        return failures
     }
 
-    err = s3session.WaitUntilObjectNotExists(&s3.HeadObjectInput{
+    objects := make([]*s3.ObjectIdentifier, len(keys))
+    for i, key := range keys {
+        objects[i] = &s3.ObjectIdentifier{Key: aws.String(key)}
+    }
+
+    output, err := client.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
         Bucket: aws.String("trademarkiaa"),
-        Key:    aws.String(fileName),
+        Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
     })
     if err != nil {
-        return fmt.Errorf("error waiting for S3 object %s to be deleted: %v", fileName, err)
+        log.Printf("Error deleting %d objects from S3: %v", len(keys), err)
+        for _, key := range keys {
+            failures[key] = err.Error()
+        }
+        return failures
     }
 
+    for _, failure := range output.Errors {
+        key, code, message := aws.StringValue(failure.Key), aws.StringValue(failure.Code), aws.StringValue(failure.Message)
+        log.Printf("Error deleting %s from S3: %s %s", key, code, message)
+        failures[key] = code
+    }
+    return failures
+}
+
+// deleteAllObjects deletes keys in batches of up to 1000 and fails when any
+// of them was not deleted
+func deleteAllObjects(ctx context.Context, client s3iface.S3API, keys []string) error {
+    for start := 0; start < len(keys); start += expiryBatchSize {
+        end := start + expiryBatchSize
+        if end > len(keys) {
+            end = len(keys)
+        }
+        if failures := deleteObjects(ctx, client, keys[start:end]); len(failures) > 0 {
+            return fmt.Errorf("%d objects were not deleted", len(failures))
+        }
+    }
     return nil
 }
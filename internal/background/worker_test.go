@@ -0,0 +1,97 @@
+package background
+
+import (
+    "context"
+    "errors"
+    "testing"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/request"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeS3 answers DeleteObjects with the configured per-key errors and
+// records the keys it deleted. Objects holds what Get and Put read and write.
+type fakeS3 struct {
+    s3iface.S3API
+    calls   int
+    failed  map[string]string
+    err     error
+    deleted []string
+    objects map[string][]byte
+}
+
+func (f *fakeS3) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, options ...request.Option) (*s3.DeleteObjectsOutput, error) {
+    f.calls++
+    if f.err != nil {
+        return nil, f.err
+    }
+    output := &s3.DeleteObjectsOutput{}
+    for _, object := range input.Delete.Objects {
+        if code, ok := f.failed[*object.Key]; ok {
+            output.Errors = append(output.Errors, &s3.Error{Key: object.Key, Code: aws.String(code), Message: aws.String("failed")})
+            continue
+        }
+        f.deleted = append(f.deleted, *object.Key)
+    }
+    return output, nil
+}
+
+func TestDeleteObjectsReportsFailuresPerKey(t *testing.T) {
+    client := &fakeS3{failed: map[string]string{"b.pdf": "AccessDenied"}}
+
+    failures := deleteObjects(context.Background(), client, []string{"a.pdf", "b.pdf", "c.pdf"})
+    if client.calls != 1 {
+        t.Errorf("DeleteObjects called %d times, want 1", client.calls)
+    }
+    if len(failures) != 1 || failures["b.pdf"] != "AccessDenied" {
+        t.Errorf("failures = %v, want only b.pdf", failures)
+    }
+}
+
+func TestDeleteObjectsFailsEveryKeyWhenTheRequestFails(t *testing.T) {
+    client := &fakeS3{err: errors.New("connection reset")}
+
+    failures := deleteObjects(context.Background(), client, []string{"a.pdf", "b.pdf"})
+    if len(failures) != 2 || failures["a.pdf"] != "connection reset" {
+        t.Errorf("failures = %v, want both keys", failures)
+    }
+}
+
+func TestExpiryReportKeepsASampleOfFailures(t *testing.T) {
+    report := &expiryReport{}
+    failures := make(map[string]string)
+    for i := 0; i < expiryFailureSample+5; i++ {
+        failures[string(rune('a'+i))] = "AccessDenied"
+    }
+    report.add(3, failures)
+    report.add(2, nil)
+
+    if report.deleted != 5 || report.failed != expiryFailureSample+5 {
+        t.Errorf("deleted %d, failed %d", report.deleted, report.failed)
+    }
+    if len(report.failures) != expiryFailureSample {
+        t.Errorf("kept %d failures, want %d", len(report.failures), expiryFailureSample)
+    }
+}
+
+func TestDeleteExpiredBatchKeepsObjectsNewerUploadsUse(t *testing.T) {
+    client := &fakeS3{}
+    mock := mockDB(t)
+    // report.pdf was uploaded again and the new row still uses the object
+    mock.ExpectQuery("SELECT COALESCE\\(array_agg").WithArgs(`{"old.pdf","report.pdf"}`, "{1,2}").
+        WillReturnRows(sqlmock.NewRows([]string{"array_agg"}).AddRow("{report.pdf}"))
+    mock.ExpectQuery("SELECT id, user_id FROM files").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}))
+    mock.ExpectExec("DELETE FROM files WHERE id = ANY").WithArgs("{1,2}").WillReturnResult(sqlmock.NewResult(0, 2))
+
+    deleted, failures := deleteExpiredBatch(context.Background(), client, []expiredFile{{ID: 1, ObjectKey: "old.pdf"}, {ID: 2, ObjectKey: "report.pdf"}})
+    if deleted != 2 || len(failures) != 0 {
+        t.Errorf("deleteExpiredBatch() = %d, %v, want both rows deleted", deleted, failures)
+    }
+    if len(client.deleted) != 1 || client.deleted[0] != "old.pdf" {
+        t.Errorf("deleted objects = %v, want only old.pdf", client.deleted)
+    }
+}
@@ -0,0 +1,117 @@
+package cache
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "log"
+    "net"
+    "time"
+
+    "github.com/go-redis/redis/v8"
+)
+
+// InvalidationChannel is the Redis channel invalidations are published on
+const InvalidationChannel = "cache_invalidations"
+
+// Bus broadcasts cache invalidations between instances over Redis pub/sub.
+// Each instance evicts the published keys from its local cache.
+type Bus struct {
+    client *redis.Client
+    local  *LRU
+    origin string
+}
+
+type invalidation struct {
+    Origin string   `json:"origin"`
+    Keys   []string `json:"keys"`
+}
+
+// NewBus returns a bus evicting from local. Call Listen to start receiving.
+func NewBus(client *redis.Client, local *LRU) *Bus {
+    id := make([]byte, 8)
+    rand.Read(id)
+    return &Bus{client: client, local: local, origin: hex.EncodeToString(id)}
+}
+
+// Publish tells the other instances to evict keys
+func (b *Bus) Publish(ctx context.Context, keys ...string) error {
+    if len(keys) == 0 {
+        return nil
+    }
+    payload, err := json.Marshal(invalidation{Origin: b.origin, Keys: keys})
+    if err != nil {
+        return err
+    }
+    return b.client.Publish(ctx, InvalidationChannel, payload).Err()
+}
+
+// Listen receives invalidations until the process exits, resubscribing with
+// backoff whenever the connection is lost. Invalidations published while
+// disconnected are missed, so the local cache is purged on every
+// (re)subscription.
+func (b *Bus) Listen() {
+    backoff := time.Second
+    for {
+        pubsub := b.client.Subscribe(context.Background(), InvalidationChannel)
+        subscribed, err := b.receive(pubsub)
+        pubsub.Close()
+
+        if subscribed {
+            backoff = time.Second
+        }
+        log.Printf("Cache invalidation subscription lost, retrying in %v: %v", backoff, err)
+        time.Sleep(backoff)
+        if backoff < 30*time.Second {
+            backoff *= 2
+        }
+    }
+}
+
+// receive handles messages until the connection fails. It reports whether
+// the subscription was established.
+func (b *Bus) receive(pubsub *redis.PubSub) (bool, error) {
+    ctx := context.Background()
+    subscribed := false
+    awaitingPong := false
+    for {
+        msg, err := pubsub.ReceiveTimeout(ctx, time.Minute)
+        if err != nil {
+            // A quiet channel is normal; a missing pong means a dead connection
+            if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !awaitingPong {
+                awaitingPong = true
+                if err := pubsub.Ping(ctx); err != nil {
+                    return subscribed, err
+                }
+                continue
+            }
+            return subscribed, err
+        }
+        awaitingPong = false
+
+        switch msg := msg.(type) {
+        case *redis.Subscription:
+            if msg.Kind == "subscribe" {
+                subscribed = true
+                b.local.Purge()
+                log.Println("Subscribed to cache invalidations")
+            }
+        case *redis.Message:
+            b.handle(msg.Payload)
+        }
+    }
+}
+
+// handle evicts the keys of an invalidation published by another instance
+func (b *Bus) handle(payload string) {
+    var event invalidation
+    if err := json.Unmarshal([]byte(payload), &event); err != nil {
+        log.Println("Ignoring malformed cache invalidation:", err)
+        return
+    }
+    if event.Origin == b.origin {
+        return
+    }
+    b.local.Delete(context.Background(), event.Keys...)
+}
@@ -0,0 +1,56 @@
+package cache
+
+import (
+    "context"
+    "encoding/json"
+    "testing"
+    "time"
+)
+
+func TestBusEvictsKeysFromOtherInstances(t *testing.T) {
+    ctx := context.Background()
+    local := NewLRU(10)
+    bus := NewBus(nil, local)
+    local.Set(ctx, "file_1", []byte("a"), 0)
+    local.Set(ctx, "file_2", []byte("b"), 0)
+
+    own, _ := json.Marshal(invalidation{Origin: bus.origin, Keys: []string{"file_1"}})
+    bus.handle(string(own))
+    if _, err := local.Get(ctx, "file_1"); err != nil {
+        t.Error("Instance evicted a key on its own invalidation")
+    }
+
+    other, _ := json.Marshal(invalidation{Origin: "other", Keys: []string{"file_1", "file_2"}})
+    bus.handle(string(other))
+    for _, key := range []string{"file_1", "file_2"} {
+        if _, err := local.Get(ctx, key); err != ErrMiss {
+            t.Errorf("%s was not evicted", key)
+        }
+    }
+}
+
+func TestTieredCapsLocalTTL(t *testing.T) {
+    ctx := context.Background()
+    remote := NewLRU(10)
+    c := &Tiered{Local: NewLRU(10), Remote: remote, LocalTTL: 30 * time.Second}
+
+    if ttl := c.localTTL(0); ttl != 30*time.Second {
+        t.Errorf("localTTL(0) = %v, want 30s", ttl)
+    }
+    if ttl := c.localTTL(10 * time.Second); ttl != 10*time.Second {
+        t.Errorf("localTTL(10s) = %v, want 10s", ttl)
+    }
+
+    remote.Set(ctx, "file_1", []byte("a"), 0)
+    if value, err := c.Get(ctx, "file_1"); err != nil || string(value) != "a" {
+        t.Fatalf("Get() = %q, %v", value, err)
+    }
+    if _, err := c.Local.Get(ctx, "file_1"); err != nil {
+        t.Error("Remote hit was not copied to the local cache")
+    }
+
+    c.Delete(ctx, "file_1")
+    if _, err := c.Get(ctx, "file_1"); err != ErrMiss {
+        t.Error("Deleted key still cached")
+    }
+}
@@ -0,0 +1,120 @@
+package cache
+
+import (
+    "context"
+    "errors"
+    "log"
+    "strconv"
+    "time"
+    "trademarkia/config"
+    "trademarkia/internal/db"
+)
+
+// ErrMiss is returned by Get when the key is not cached
+var ErrMiss = errors.New("cache miss")
+
+// Cache stores byte values with a time to live. Callers treat every error,
+// not just ErrMiss, as a miss and fall back to the database.
+type Cache interface {
+    Get(ctx context.Context, key string) ([]byte, error)
+    Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+    Delete(ctx context.Context, keys ...string) error
+}
+
+// TTL is how long every cached entry lives, set from CACHE_TTL_SECONDS.
+// Writes invalidate the entries they affect, so the TTL only bounds how long
+// an entry can be stale after a failed invalidation.
+var TTL = 5 * time.Minute
+
+// Default is the cache configured at startup. It is a no-op cache until
+// Init is called.
+var Default Cache = Nop{}
+
+// Init configures Default from CACHE_BACKEND: "redis" (the default) uses
+// db.Redis, "memory" an in-process LRU of CACHE_LRU_SIZE entries, "tiered"
+// the LRU in front of Redis, and "none" disables caching. The in-process
+// backends evict keys invalidated by other instances through the Bus.
+func Init() {
+    TTL = time.Duration(envSeconds("CACHE_TTL_SECONDS", 300)) * time.Second
+
+    stale, err := strconv.Atoi(config.GetEnv("CACHE_STALE_SECONDS", "0"))
+    if err != nil || stale < 0 {
+        log.Println("Invalid value for CACHE_STALE_SECONDS, disabling stale reads")
+        stale = 0
+    }
+    StaleFor = time.Duration(stale) * time.Second
+
+    switch backend := config.GetEnv("CACHE_BACKEND", "redis"); backend {
+    case "redis":
+        if db.Redis == nil {
+            log.Println("Redis is not initialized, using the in-memory cache")
+            Default = localCache()
+            return
+        }
+        Default = &RedisCache{Client: db.Redis}
+    case "tiered":
+        if db.Redis == nil {
+            log.Println("Redis is not initialized, using the in-memory cache")
+            Default = localCache()
+            return
+        }
+        local := NewLRU(lruSize())
+        Default = &Tiered{
+            Local:    local,
+            Remote:   &RedisCache{Client: db.Redis},
+            LocalTTL: time.Duration(envSeconds("CACHE_LOCAL_TTL_SECONDS", 30)) * time.Second,
+            Bus:      startBus(local),
+        }
+    case "memory":
+        Default = localCache()
+    case "none":
+        Default = Nop{}
+    default:
+        log.Printf("Unknown CACHE_BACKEND %q, using the in-memory cache", backend)
+        Default = localCache()
+    }
+}
+
+// localCache returns an in-process cache whose invalidations are shared with
+// the other instances when Redis is available
+func localCache() Cache {
+    local := NewLRU(lruSize())
+    return &Tiered{Local: local, Bus: startBus(local)}
+}
+
+func startBus(local *LRU) *Bus {
+    if db.Redis == nil {
+        return nil
+    }
+    bus := NewBus(db.Redis, local)
+    go bus.Listen()
+    return bus
+}
+
+// envSeconds reads a positive number of seconds
+func envSeconds(name string, fallback int) int {
+    seconds, err := strconv.Atoi(config.GetEnv(name, strconv.Itoa(fallback)))
+    if err != nil || seconds <= 0 {
+        log.Printf("Invalid value for %s, using %d", name, fallback)
+        return fallback
+    }
+    return seconds
+}
+
+func lruSize() int {
+    size, err := strconv.Atoi(config.GetEnv("CACHE_LRU_SIZE", "10000"))
+    if err != nil || size <= 0 {
+        log.Println("Invalid value for CACHE_LRU_SIZE, using 10000")
+        return 10000
+    }
+    return size
+}
+
+// Nop caches nothing
+type Nop struct{}
+
+func (Nop) Get(ctx context.Context, key string) ([]byte, error) { return nil, ErrMiss }
+
+func (Nop) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error { return nil }
+
+func (Nop) Delete(ctx context.Context, keys ...string) error { return nil }
@@ -0,0 +1,96 @@
+package cache
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "math/rand"
+    "sync/atomic"
+    "time"
+)
+
+// StaleFor is how long past its TTL an entry may still be served while it is
+// refreshed in the background, set from CACHE_STALE_SECONDS. Zero disables
+// stale-while-revalidate. Invalidated entries are never served stale.
+var StaleFor time.Duration
+
+// loads coalesces the database loads behind cache misses on this instance
+var loads Group
+
+// entry wraps values stored through Fetch with the time they stop being fresh
+type entry struct {
+    Value      []byte `json:"value"`
+    FreshUntil int64  `json:"fresh_until"`
+}
+
+// Jitter spreads ttl by up to 10% either way, so entries written together do
+// not all expire at the same moment
+func Jitter(ttl time.Duration) time.Duration {
+    spread := int64(ttl) / 10
+    if spread <= 0 {
+        return ttl
+    }
+    return ttl - time.Duration(spread) + time.Duration(rand.Int63n(2*spread+1))
+}
+
+// Fetch returns the value cached under key, calling load on a miss. Concurrent
+// misses for the same key share a single load. With StaleFor set, an expired
+// value is returned immediately while one background load refreshes it.
+func Fetch(ctx context.Context, key string, load func() ([]byte, error)) ([]byte, error) {
+    data, err := Default.Get(ctx, key)
+    if err == nil {
+        var cached entry
+        if err := json.Unmarshal(data, &cached); err == nil {
+            if time.Now().UnixNano() < cached.FreshUntil {
+                return cached.Value, nil
+            }
+            if StaleFor > 0 {
+                go loads.Do(key, func() ([]byte, error) { return refresh(key, load) })
+                return cached.Value, nil
+            }
+        }
+    } else if err != ErrMiss {
+        log.Println("Error reading from cache:", err)
+    }
+
+    return loads.Do(key, func() ([]byte, error) { return refresh(key, load) })
+}
+
+// invalidations counts the invalidations made on this instance
+var invalidations int64
+
+// invalidated records an invalidation, so that loads running concurrently
+// with it do not cache what they read before the write
+func invalidated() {
+    atomic.AddInt64(&invalidations, 1)
+}
+
+// refresh loads a value and caches it. It does not use the caller's context,
+// since callers waiting on the same load may outlive it. A value is not
+// cached when an invalidation happened during the load, since it may have
+// been read before the write that caused it.
+func refresh(key string, load func() ([]byte, error)) ([]byte, error) {
+    before := atomic.LoadInt64(&invalidations)
+    value, err := load()
+    if err != nil {
+        return nil, err
+    }
+    if atomic.LoadInt64(&invalidations) == before {
+        Store(context.Background(), key, value)
+    }
+    return value, nil
+}
+
+// Store caches value under key for a jittered TTL, plus StaleFor during
+// which it may be served stale
+func Store(ctx context.Context, key string, value []byte) {
+    ttl := Jitter(TTL)
+    data, err := json.Marshal(entry{Value: value, FreshUntil: time.Now().Add(ttl).UnixNano()})
+    if err != nil {
+        log.Println("Error encoding cache entry:", err)
+        return
+    }
+    if err := Default.Set(ctx, key, data, ttl+StaleFor); err != nil {
+        log.Println("Error writing to cache:", err)
+    }
+}
@@ -0,0 +1,87 @@
+package cache
+
+import (
+    "context"
+    "encoding/json"
+    "runtime"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// waiting returns how many callers are waiting on the call in flight for key
+func (g *Group) waiting(key string) int {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    if c, ok := g.calls[key]; ok {
+        return c.dups
+    }
+    return 0
+}
+
+func TestGroupCoalescesConcurrentLoads(t *testing.T) {
+    var g Group
+    var loads int32
+    release := make(chan struct{})
+
+    var wg sync.WaitGroup
+    for i := 0; i < 10; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            value, err := g.Do("file_1", func() ([]byte, error) {
+                atomic.AddInt32(&loads, 1)
+                <-release
+                return []byte("report.pdf"), nil
+            })
+            if err != nil || string(value) != "report.pdf" {
+                t.Errorf("Do() = %q, %v", value, err)
+            }
+        }()
+    }
+
+    // Release the load only once every other caller is waiting on it, so
+    // none of them can start a second one
+    for g.waiting("file_1") < 9 {
+        runtime.Gosched()
+    }
+    close(release)
+    wg.Wait()
+
+    if loads != 1 {
+        t.Errorf("Load ran %d times, want 1", loads)
+    }
+}
+
+func TestFetchServesStaleWhileRevalidating(t *testing.T) {
+    ctx := context.Background()
+    previousTTL := TTL
+    Default = NewLRU(100)
+    TTL = time.Minute
+    StaleFor = time.Minute
+    defer func() { Default, TTL, StaleFor = Nop{}, previousTTL, 0 }()
+
+    stale, _ := json.Marshal(entry{Value: []byte("old"), FreshUntil: time.Now().Add(-time.Second).UnixNano()})
+    Default.Set(ctx, "file_1", stale, time.Minute)
+
+    value, err := Fetch(ctx, "file_1", func() ([]byte, error) { return []byte("new"), nil })
+    if err != nil || string(value) != "old" {
+        t.Fatalf("Fetch() = %q, %v, want the stale value", value, err)
+    }
+
+    // The refresh runs in the background
+    deadline := time.Now().Add(time.Second)
+    for {
+        data, _ := Default.Get(ctx, "file_1")
+        var cached entry
+        json.Unmarshal(data, &cached)
+        if string(cached.Value) == "new" {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("Stale entry was not refreshed")
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
@@ -0,0 +1,214 @@
+package cache
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "strconv"
+    "time"
+    "trademarkia/internal/db"
+    "trademarkia/internal/models"
+
+    "github.com/lib/pq"
+)
+
+// File records are cached as JSON under file_<id>. Every write to a file
+// (upload, rename, delete, the expiry sweep and storage reconciliation)
+// invalidates its record. Membership and grants are not part of the record,
+// so access checks still read them from the database.
+//
+// A user's file listings are cached under a key that embeds a per-user
+// version token, so invalidating every listing of a user (all workspace
+// filters at once) only replaces the token. A listing built from data read
+// before a write is stored under the old token and is never served again.
+
+func fileKey(fileID int) string {
+    return fmt.Sprintf("file_%d", fileID)
+}
+
+func listingVersionKey(userID int) string {
+    return fmt.Sprintf("files_version_%d", userID)
+}
+
+// cachedFile is the JSON form of a cached file record. It includes the
+// object key, which is hidden from API responses.
+type cachedFile struct {
+    models.File
+    ObjectKey string `json:"object_key"`
+}
+
+// FetchFile returns the record of a file from the cache, calling load on a
+// miss. Errors from load, such as sql.ErrNoRows, are returned as they are.
+func FetchFile(ctx context.Context, fileID int, load func() (*models.File, error)) (*models.File, error) {
+    data, err := Fetch(ctx, fileKey(fileID), func() ([]byte, error) {
+        file, err := load()
+        if err != nil {
+            return nil, err
+        }
+        return json.Marshal(cachedFile{File: *file, ObjectKey: file.ObjectKey})
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    var cached cachedFile
+    if err := json.Unmarshal(data, &cached); err != nil {
+        log.Println("Error decoding cached file:", err)
+        return load()
+    }
+    cached.File.ObjectKey = cached.ObjectKey
+    return &cached.File, nil
+}
+
+// ListingKey returns the key of a user's file listing, filtered to one
+// workspace when workspaceID is not zero. It returns false when the cache is
+// unavailable, in which case the listing must not be cached.
+func ListingKey(ctx context.Context, userID, workspaceID int) (string, bool) {
+    version, err := Default.Get(ctx, listingVersionKey(userID))
+    if err == ErrMiss {
+        version = newVersion()
+        err = Default.Set(ctx, listingVersionKey(userID), version, TTL)
+    }
+    if err != nil {
+        log.Println("Error reading listing version from cache:", err)
+        return "", false
+    }
+
+    key := fmt.Sprintf("files_%d_%s", userID, version)
+    if workspaceID != 0 {
+        key += fmt.Sprintf("_workspace_%d", workspaceID)
+    }
+    return key, true
+}
+
+// FetchFileList returns the listing cached under a key from ListingKey,
+// calling load on a miss
+func FetchFileList(ctx context.Context, key string, load func() ([]models.File, error)) ([]models.File, error) {
+    data, err := Fetch(ctx, key, func() ([]byte, error) {
+        files, err := load()
+        if err != nil {
+            return nil, err
+        }
+        return json.Marshal(files)
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    var files []models.File
+    if err := json.Unmarshal(data, &files); err != nil {
+        log.Println("Error decoding cached file listing:", err)
+        return load()
+    }
+    return files, nil
+}
+
+// InvalidateListings drops every cached file listing of the given users
+func InvalidateListings(ctx context.Context, userIDs ...int) {
+    keys := make([]string, len(userIDs))
+    for i, userID := range userIDs {
+        keys[i] = listingVersionKey(userID)
+    }
+    if err := Default.Delete(ctx, keys...); err != nil {
+        log.Println("Error invalidating file listings:", err)
+    }
+}
+
+// InvalidateFile drops the cached record of a file and the listings of the
+// users in audience, as returned by FileAudience
+func InvalidateFile(ctx context.Context, fileID int, audience []int) {
+    invalidated()
+    if err := Default.Delete(ctx, fileKey(fileID)); err != nil {
+        log.Println("Error invalidating cached file:", err)
+    }
+    InvalidateListings(ctx, audience...)
+}
+
+// Invalidate drops the cached records of files and the listings of the
+// users in audience. Unlike InvalidateFile it returns the cache's error, so
+// that the caller can retry.
+func Invalidate(ctx context.Context, fileIDs []int, audience []int) error {
+    invalidated()
+    keys := make([]string, 0, len(fileIDs)+len(audience))
+    for _, fileID := range fileIDs {
+        keys = append(keys, fileKey(fileID))
+    }
+    for _, userID := range audience {
+        keys = append(keys, listingVersionKey(userID))
+    }
+    if len(keys) == 0 {
+        return nil
+    }
+    return Default.Delete(ctx, keys...)
+}
+
+// FileAudience returns the users whose listings include a file: the uploader
+// of a personal file, or every member of the file's workspace. When a file is
+// deleted it must be called before the row is removed.
+func FileAudience(fileID int) []int {
+    return fileAudience(db.DB, fileID)
+}
+
+// FileAudienceTx is FileAudience within tx, which also sees a file inserted
+// by tx
+func FileAudienceTx(tx *sql.Tx, fileID int) []int {
+    return fileAudience(tx, fileID)
+}
+
+func fileAudience(q interface {
+    Query(string, ...interface{}) (*sql.Rows, error)
+}, fileID int) []int {
+    rows, err := q.Query(`SELECT user_id FROM files WHERE id = $1 AND workspace_id IS NULL
+        UNION
+        SELECT workspace_members.user_id FROM files
+        JOIN workspace_members ON workspace_members.workspace_id = files.workspace_id
+        WHERE files.id = $1`, fileID)
+    if err != nil {
+        log.Println("Error finding users of a file:", err)
+        return nil
+    }
+    defer rows.Close()
+
+    var userIDs []int
+    for rows.Next() {
+        var userID int
+        if err := rows.Scan(&userID); err != nil {
+            log.Println("Error scanning users of a file:", err)
+            return userIDs
+        }
+        userIDs = append(userIDs, userID)
+    }
+    return userIDs
+}
+
+// FileAudiences returns the audience of each of several files with one query,
+// keyed by file ID
+func FileAudiences(fileIDs []int) map[int][]int {
+    audiences := make(map[int][]int)
+    rows, err := db.DB.Query(`SELECT id, user_id FROM files WHERE id = ANY($1) AND workspace_id IS NULL
+        UNION
+        SELECT files.id, workspace_members.user_id FROM files
+        JOIN workspace_members ON workspace_members.workspace_id = files.workspace_id
+        WHERE files.id = ANY($1)`, pq.Array(fileIDs))
+    if err != nil {
+        log.Println("Error finding users of files:", err)
+        return audiences
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var fileID, userID int
+        if err := rows.Scan(&fileID, &userID); err != nil {
+            log.Println("Error scanning users of files:", err)
+            return audiences
+        }
+        audiences[fileID] = append(audiences[fileID], userID)
+    }
+    return audiences
+}
+
+func newVersion() []byte {
+    return []byte(strconv.FormatInt(time.Now().UnixNano(), 36))
+}
@@ -0,0 +1,114 @@
+package cache
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+    "trademarkia/internal/models"
+)
+
+func TestInvalidateListingsChangesListingKey(t *testing.T) {
+    ctx := context.Background()
+    Default = NewLRU(100)
+    defer func() { Default = Nop{} }()
+
+    key, ok := ListingKey(ctx, 7, 0)
+    if !ok {
+        t.Fatal("Listing key unavailable with a working cache")
+    }
+    load := func() ([]models.File, error) {
+        return []models.File{{ID: 1, UserID: 7, FileName: "report.pdf"}}, nil
+    }
+    FetchFileList(ctx, key, load)
+
+    again, _ := ListingKey(ctx, 7, 0)
+    if again != key {
+        t.Fatalf("Listing key changed from %q to %q without a write", key, again)
+    }
+    if workspaceKey, _ := ListingKey(ctx, 7, 3); workspaceKey == again {
+        t.Error("Workspace listing shares the key of the full listing")
+    }
+
+    InvalidateListings(ctx, 7)
+    fresh, _ := ListingKey(ctx, 7, 0)
+    if fresh == key {
+        t.Fatal("Listing key did not change after invalidation")
+    }
+    if _, err := Default.Get(ctx, fresh); err != ErrMiss {
+        t.Error("Listing cached under the new key before it was loaded")
+    }
+}
+
+// failingCache fails every delete, like an unreachable Redis
+type failingCache struct{ Nop }
+
+func (failingCache) Delete(ctx context.Context, keys ...string) error {
+    return errors.New("connection refused")
+}
+
+func TestInvalidateReturnsCacheErrors(t *testing.T) {
+    ctx := context.Background()
+    Default = NewLRU(100)
+    defer func() { Default = Nop{} }()
+
+    Default.Set(ctx, fileKey(4), []byte("{}"), time.Minute)
+    key, _ := ListingKey(ctx, 7, 0)
+    if err := Invalidate(ctx, []int{4}, []int{7}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := Default.Get(ctx, fileKey(4)); err != ErrMiss {
+        t.Error("File record still cached after invalidation")
+    }
+    if fresh, _ := ListingKey(ctx, 7, 0); fresh == key {
+        t.Error("Listing key did not change after invalidation")
+    }
+
+    Default = failingCache{}
+    if err := Invalidate(ctx, []int{4}, []int{7}); err == nil {
+        t.Error("Invalidate hid the cache error, so the outbox would not retry")
+    }
+}
+
+func TestFetchFileCachesRecordUntilInvalidated(t *testing.T) {
+    ctx := context.Background()
+    Default = NewLRU(100)
+    defer func() { Default = Nop{} }()
+
+    loads := 0
+    name := "report.pdf"
+    load := func() (*models.File, error) {
+        loads++
+        return &models.File{ID: 4, UserID: 7, FileName: name, ObjectKey: "report.pdf"}, nil
+    }
+
+    FetchFile(ctx, 4, load)
+    file, err := FetchFile(ctx, 4, load)
+    if err != nil || loads != 1 {
+        t.Fatalf("second fetch loaded again (%d loads, %v)", loads, err)
+    }
+    if file.ObjectKey != "report.pdf" {
+        t.Errorf("cached record lost its object key: %+v", file)
+    }
+
+    name = "q3-report.pdf"
+    InvalidateFile(ctx, 4, nil)
+    if file, _ := FetchFile(ctx, 4, load); loads != 2 || file.FileName != name || file.ObjectKey != "report.pdf" {
+        t.Errorf("after a rename got %+v with %d loads, want the new name and the same key", file, loads)
+    }
+}
+
+func TestFetchFileSkipsCachingLoadsRacingAnInvalidation(t *testing.T) {
+    ctx := context.Background()
+    Default = NewLRU(100)
+    defer func() { Default = Nop{} }()
+
+    // The record is read, then renamed and invalidated before it is stored
+    FetchFile(ctx, 4, func() (*models.File, error) {
+        InvalidateFile(ctx, 4, nil)
+        return &models.File{ID: 4, FileName: "report.pdf"}, nil
+    })
+    if _, err := Default.Get(ctx, fileKey(4)); err != ErrMiss {
+        t.Error("record read before an invalidation was cached")
+    }
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+    "container/list"
+    "context"
+    "sync"
+    "time"
+)
+
+// LRU is an in-process cache holding at most a fixed number of entries,
+// evicting the least recently used one when full
+type LRU struct {
+    mu       sync.Mutex
+    capacity int
+    order    *list.List
+    entries  map[string]*list.Element
+    now      func() time.Time
+}
+
+type lruEntry struct {
+    key       string
+    value     []byte
+    expiresAt time.Time
+}
+
+// NewLRU returns an empty cache for up to capacity entries
+func NewLRU(capacity int) *LRU {
+    return &LRU{
+        capacity: capacity,
+        order:    list.New(),
+        entries:  make(map[string]*list.Element),
+        now:      time.Now,
+    }
+}
+
+// Get implements Cache
+func (c *LRU) Get(ctx context.Context, key string) ([]byte, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    element, ok := c.entries[key]
+    if !ok {
+        return nil, ErrMiss
+    }
+    entry := element.Value.(*lruEntry)
+    if !entry.expiresAt.IsZero() && c.now().After(entry.expiresAt) {
+        c.remove(element)
+        return nil, ErrMiss
+    }
+
+    c.order.MoveToFront(element)
+    return entry.value, nil
+}
+
+// Set implements Cache. A ttl of zero keeps the entry until it is evicted.
+func (c *LRU) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    var expiresAt time.Time
+    if ttl > 0 {
+        expiresAt = c.now().Add(ttl)
+    }
+
+    if element, ok := c.entries[key]; ok {
+        entry := element.Value.(*lruEntry)
+        entry.value = value
+        entry.expiresAt = expiresAt
+        c.order.MoveToFront(element)
+        return nil
+    }
+
+    c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expiresAt: expiresAt})
+    for c.order.Len() > c.capacity {
+        c.remove(c.order.Back())
+    }
+    return nil
+}
+
+// Delete implements Cache
+func (c *LRU) Delete(ctx context.Context, keys ...string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    for _, key := range keys {
+        if element, ok := c.entries[key]; ok {
+            c.remove(element)
+        }
+    }
+    return nil
+}
+
+// Purge drops every entry
+func (c *LRU) Purge() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.order.Init()
+    c.entries = make(map[string]*list.Element)
+}
+
+func (c *LRU) remove(element *list.Element) {
+    c.order.Remove(element)
+    delete(c.entries, element.Value.(*lruEntry).key)
+}
@@ -0,0 +1,46 @@
+package cache
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+    ctx := context.Background()
+    c := NewLRU(2)
+
+    c.Set(ctx, "a", []byte("1"), 0)
+    c.Set(ctx, "b", []byte("2"), 0)
+    c.Get(ctx, "a")
+    c.Set(ctx, "c", []byte("3"), 0)
+
+    if _, err := c.Get(ctx, "b"); err != ErrMiss {
+        t.Error("Least recently used entry was not evicted")
+    }
+    if value, err := c.Get(ctx, "a"); err != nil || string(value) != "1" {
+        t.Errorf("Get(a) = %q, %v", value, err)
+    }
+
+    c.Delete(ctx, "a")
+    if _, err := c.Get(ctx, "a"); err != ErrMiss {
+        t.Error("Deleted entry is still cached")
+    }
+}
+
+func TestLRUExpiresEntries(t *testing.T) {
+    ctx := context.Background()
+    now := time.Unix(1700000000, 0)
+    c := NewLRU(10)
+    c.now = func() time.Time { return now }
+
+    c.Set(ctx, "file_1", []byte("report.pdf"), time.Minute)
+    if _, err := c.Get(ctx, "file_1"); err != nil {
+        t.Fatalf("Fresh entry missing: %v", err)
+    }
+
+    now = now.Add(2 * time.Minute)
+    if _, err := c.Get(ctx, "file_1"); err != ErrMiss {
+        t.Error("Expired entry was returned")
+    }
+}
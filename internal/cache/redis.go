@@ -0,0 +1,35 @@
+package cache
+
+import (
+    "context"
+    "time"
+
+    "github.com/go-redis/redis/v8"
+)
+
+// RedisCache stores entries in Redis, shared by all instances
+type RedisCache struct {
+    Client *redis.Client
+}
+
+// Get implements Cache
+func (c *RedisCache) Get(ctx context.Context, key string) ([]byte, error) {
+    value, err := c.Client.Get(ctx, key).Bytes()
+    if err == redis.Nil {
+        return nil, ErrMiss
+    }
+    return value, err
+}
+
+// Set implements Cache
+func (c *RedisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    return c.Client.Set(ctx, key, value, ttl).Err()
+}
+
+// Delete implements Cache
+func (c *RedisCache) Delete(ctx context.Context, keys ...string) error {
+    if len(keys) == 0 {
+        return nil
+    }
+    return c.Client.Del(ctx, keys...).Err()
+}
@@ -0,0 +1,44 @@
+package cache
+
+import "sync"
+
+// Group coalesces concurrent loads of the same key, so only one of them runs
+// and the others wait for and share its result
+type Group struct {
+    mu    sync.Mutex
+    calls map[string]*call
+}
+
+type call struct {
+    done  chan struct{}
+    value []byte
+    err   error
+    dups  int
+}
+
+// Do runs fn unless a call for key is already in flight, in which case it
+// waits for that call and returns its result
+func (g *Group) Do(key string, fn func() ([]byte, error)) ([]byte, error) {
+    g.mu.Lock()
+    if g.calls == nil {
+        g.calls = make(map[string]*call)
+    }
+    if c, ok := g.calls[key]; ok {
+        c.dups++
+        g.mu.Unlock()
+        <-c.done
+        return c.value, c.err
+    }
+    c := &call{done: make(chan struct{})}
+    g.calls[key] = c
+    g.mu.Unlock()
+
+    defer func() {
+        g.mu.Lock()
+        delete(g.calls, key)
+        g.mu.Unlock()
+        close(c.done)
+    }()
+    c.value, c.err = fn()
+    return c.value, c.err
+}
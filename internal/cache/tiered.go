@@ -0,0 +1,68 @@
+package cache
+
+import (
+    "context"
+    "time"
+)
+
+// Tiered keeps entries in a local LRU in front of an optional shared remote
+// cache. Deletes are published on the Bus so that every other instance
+// evicts its local copies as well.
+type Tiered struct {
+    Local *LRU
+    // Remote is nil for a local-only cache
+    Remote Cache
+    // LocalTTL caps how long a local copy lives, bounding staleness when an
+    // invalidation is lost. It must be set when Remote is.
+    LocalTTL time.Duration
+    // Bus is nil when running without Redis
+    Bus *Bus
+}
+
+// Get implements Cache
+func (c *Tiered) Get(ctx context.Context, key string) ([]byte, error) {
+    value, err := c.Local.Get(ctx, key)
+    if err == nil || c.Remote == nil {
+        return value, err
+    }
+
+    value, err = c.Remote.Get(ctx, key)
+    if err != nil {
+        return nil, err
+    }
+    c.Local.Set(ctx, key, value, c.LocalTTL)
+    return value, nil
+}
+
+// Set implements Cache
+func (c *Tiered) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    if c.Remote != nil {
+        if err := c.Remote.Set(ctx, key, value, ttl); err != nil {
+            return err
+        }
+    }
+    return c.Local.Set(ctx, key, value, c.localTTL(ttl))
+}
+
+// Delete implements Cache
+func (c *Tiered) Delete(ctx context.Context, keys ...string) error {
+    c.Local.Delete(ctx, keys...)
+
+    var err error
+    if c.Remote != nil {
+        err = c.Remote.Delete(ctx, keys...)
+    }
+    if c.Bus != nil {
+        if publishErr := c.Bus.Publish(ctx, keys...); err == nil {
+            err = publishErr
+        }
+    }
+    return err
+}
+
+func (c *Tiered) localTTL(ttl time.Duration) time.Duration {
+    if c.Remote != nil && (ttl <= 0 || ttl > c.LocalTTL) {
+        return c.LocalTTL
+    }
+    return ttl
+}
@@ -3,8 +3,9 @@ package db
 
 import (
     "database/sql"
+    "errors"
     "log"
-    _ "github.com/lib/pq" 
+    "github.com/lib/pq"
 )
 
 var DB *sql.DB
@@ -32,3 +33,9 @@ func initPostgresDB(connStr string) error {
     log.Println("Database connection established")
     return nil
 }
+
+// IsUniqueViolation reports whether err is a Postgres unique constraint violation
+func IsUniqueViolation(err error) bool {
+    var pqErr *pq.Error
+    return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
@@ -0,0 +1,36 @@
+package db
+
+import (
+    "context"
+    "log"
+    "time"
+    "trademarkia/config"
+
+    "github.com/go-redis/redis/v8"
+)
+
+// Redis is the shared Redis client used for caching, login throttling and
+// rate limiting
+var Redis *redis.Client
+
+// InitRedis connects to the Redis server at REDIS_ADDR. A failed ping is only
+// logged, since every Redis user degrades gracefully while it is down.
+func InitRedis() {
+    Redis = redis.NewClient(&redis.Options{
+        Addr:     config.GetEnv("REDIS_ADDR", "localhost:6379"),
+        Password: config.GetEnv("REDIS_PASSWORD", ""),
+        DB:       0,
+        // Fail fast when Redis is down so callers fall back instead of
+        // holding the request for the client's default retries
+        DialTimeout:  2 * time.Second,
+        ReadTimeout:  500 * time.Millisecond,
+        WriteTimeout: 500 * time.Millisecond,
+        MaxRetries:   1,
+    })
+
+    if err := Redis.Ping(context.Background()).Err(); err != nil {
+        log.Println("Redis is not reachable:", err)
+        return
+    }
+    log.Println("Redis connection established")
+}
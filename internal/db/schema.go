@@ -0,0 +1,221 @@
+package db
+
+import (
+    "fmt"
+    "log"
+)
+
+// migrations are applied in order on every startup, so each statement must be idempotent
+var migrations = []string{
+    `CREATE TABLE IF NOT EXISTS users (
+        id SERIAL PRIMARY KEY,
+        email TEXT NOT NULL UNIQUE,
+        password TEXT NOT NULL
+    )`,
+    `CREATE TABLE IF NOT EXISTS files (
+        id SERIAL PRIMARY KEY,
+        user_id INTEGER NOT NULL REFERENCES users(id),
+        file_name TEXT NOT NULL,
+        file_size BIGINT NOT NULL,
+        upload_date TIMESTAMP NOT NULL DEFAULT NOW(),
+        file_url TEXT
+    )`,
+    `CREATE TABLE IF NOT EXISTS api_keys (
+        id SERIAL PRIMARY KEY,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        name TEXT NOT NULL,
+        prefix TEXT NOT NULL UNIQUE,
+        key_hash TEXT NOT NULL,
+        scopes TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+        last_used_at TIMESTAMP,
+        revoked_at TIMESTAMP
+    )`,
+    `CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys (user_id)`,
+    `ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user'`,
+    `ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE`,
+    `ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT FALSE`,
+    `CREATE TABLE IF NOT EXISTS user_tokens (
+        id TEXT PRIMARY KEY,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        purpose TEXT NOT NULL,
+        expires_at TIMESTAMP NOT NULL,
+        used_at TIMESTAMP
+    )`,
+    `ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT`,
+    `ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE`,
+    `ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0`,
+    `CREATE TABLE IF NOT EXISTS recovery_codes (
+        id SERIAL PRIMARY KEY,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        code_hash TEXT NOT NULL,
+        used_at TIMESTAMP
+    )`,
+    `CREATE INDEX IF NOT EXISTS recovery_codes_user_id_idx ON recovery_codes (user_id)`,
+    `ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_issuer TEXT`,
+    `ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_subject TEXT`,
+    `CREATE UNIQUE INDEX IF NOT EXISTS users_oidc_identity_idx ON users (oidc_issuer, oidc_subject)`,
+    `CREATE TABLE IF NOT EXISTS sessions (
+        id TEXT PRIMARY KEY,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        user_agent TEXT NOT NULL DEFAULT '',
+        ip TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+        last_used_at TIMESTAMP NOT NULL DEFAULT NOW(),
+        expires_at TIMESTAMP NOT NULL,
+        revoked_at TIMESTAMP
+    )`,
+    `CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id)`,
+    `ALTER TABLE users ADD COLUMN IF NOT EXISTS username TEXT`,
+    `ALTER TABLE users ADD COLUMN IF NOT EXISTS pending_email TEXT`,
+    `ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at TIMESTAMP NOT NULL DEFAULT NOW()`,
+    `ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT NOW()`,
+    `CREATE UNIQUE INDEX IF NOT EXISTS users_username_idx ON users (username)`,
+    `ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_requested_at TIMESTAMP`,
+    `CREATE TABLE IF NOT EXISTS share_links (
+        id SERIAL PRIMARY KEY,
+        file_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+        expires_at TIMESTAMP NOT NULL
+    )`,
+    `CREATE INDEX IF NOT EXISTS share_links_user_id_idx ON share_links (user_id)`,
+    `CREATE TABLE IF NOT EXISTS data_exports (
+        id SERIAL PRIMARY KEY,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        status TEXT NOT NULL DEFAULT 'pending',
+        s3_key TEXT,
+        error TEXT,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+        completed_at TIMESTAMP
+    )`,
+    `CREATE INDEX IF NOT EXISTS data_exports_user_id_idx ON data_exports (user_id)`,
+    `CREATE TABLE IF NOT EXISTS workspaces (
+        id SERIAL PRIMARY KEY,
+        name TEXT NOT NULL,
+        created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW()
+    )`,
+    `CREATE TABLE IF NOT EXISTS workspace_members (
+        workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        role TEXT NOT NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+        PRIMARY KEY (workspace_id, user_id)
+    )`,
+    `CREATE INDEX IF NOT EXISTS workspace_members_user_id_idx ON workspace_members (user_id)`,
+    `ALTER TABLE files ADD COLUMN IF NOT EXISTS workspace_id INTEGER REFERENCES workspaces(id)`,
+    `CREATE INDEX IF NOT EXISTS files_workspace_id_idx ON files (workspace_id)`,
+    `CREATE TABLE IF NOT EXISTS file_grants (
+        file_id INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        permission TEXT NOT NULL,
+        granted_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+        PRIMARY KEY (file_id, user_id)
+    )`,
+    `CREATE INDEX IF NOT EXISTS file_grants_user_id_idx ON file_grants (user_id)`,
+    `ALTER TABLE users ADD COLUMN IF NOT EXISTS plan TEXT NOT NULL DEFAULT 'free'`,
+    `CREATE TABLE IF NOT EXISTS transfer_usage (
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        month DATE NOT NULL,
+        bytes_uploaded BIGINT NOT NULL DEFAULT 0,
+        bytes_downloaded BIGINT NOT NULL DEFAULT 0,
+        PRIMARY KEY (user_id, month)
+    )`,
+    `CREATE TABLE IF NOT EXISTS jobs (
+        id BIGSERIAL PRIMARY KEY,
+        type TEXT NOT NULL,
+        payload JSONB NOT NULL DEFAULT '{}',
+        status TEXT NOT NULL DEFAULT 'queued',
+        attempts INTEGER NOT NULL DEFAULT 0,
+        max_attempts INTEGER NOT NULL DEFAULT 5,
+        run_at TIMESTAMP NOT NULL DEFAULT NOW(),
+        locked_until TIMESTAMP,
+        last_error TEXT,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+        updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+        completed_at TIMESTAMP
+    )`,
+    `CREATE INDEX IF NOT EXISTS jobs_queued_idx ON jobs (run_at) WHERE status = 'queued'`,
+    `CREATE INDEX IF NOT EXISTS jobs_type_status_idx ON jobs (type, status)`,
+    // Exports and account deletions used to be resumed from their own tables
+    // on startup; hand any still in flight over to the job queue
+    `INSERT INTO jobs (type, payload)
+        SELECT 'data_export', json_build_object('export_id', id) FROM data_exports
+        WHERE status IN ('pending', 'running')
+        AND NOT EXISTS (SELECT 1 FROM jobs WHERE type = 'data_export' AND (payload->>'export_id')::int = data_exports.id)`,
+    `INSERT INTO jobs (type, payload)
+        SELECT 'account_deletion', json_build_object('user_id', id) FROM users
+        WHERE deletion_requested_at IS NOT NULL
+        AND NOT EXISTS (SELECT 1 FROM jobs WHERE type = 'account_deletion' AND (payload->>'user_id')::int = users.id)`,
+    `CREATE TABLE IF NOT EXISTS schedules (
+        name TEXT PRIMARY KEY,
+        expression TEXT NOT NULL,
+        next_run_at TIMESTAMP,
+        updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+    )`,
+    `CREATE TABLE IF NOT EXISTS scheduled_runs (
+        id BIGSERIAL PRIMARY KEY,
+        name TEXT NOT NULL,
+        job_id BIGINT,
+        trigger TEXT NOT NULL,
+        status TEXT NOT NULL,
+        error TEXT,
+        started_at TIMESTAMP NOT NULL DEFAULT NOW(),
+        finished_at TIMESTAMP,
+        duration_ms BIGINT
+    )`,
+    `CREATE INDEX IF NOT EXISTS scheduled_runs_name_idx ON scheduled_runs (name, started_at DESC)`,
+    `CREATE TABLE IF NOT EXISTS reconciliation_reports (
+        id BIGSERIAL PRIMARY KEY,
+        job_id BIGINT,
+        dry_run BOOLEAN NOT NULL,
+        objects_scanned INT NOT NULL,
+        rows_scanned INT NOT NULL,
+        orphans_found INT NOT NULL,
+        dangling_found INT NOT NULL,
+        orphans_deleted INT NOT NULL DEFAULT 0,
+        rows_deleted INT NOT NULL DEFAULT 0,
+        details JSONB NOT NULL,
+        started_at TIMESTAMP NOT NULL,
+        finished_at TIMESTAMP NOT NULL
+    )`,
+    `CREATE TABLE IF NOT EXISTS outbox (
+        id BIGSERIAL PRIMARY KEY,
+        kind TEXT NOT NULL,
+        payload JSONB NOT NULL,
+        status TEXT NOT NULL DEFAULT 'pending',
+        attempts INT NOT NULL DEFAULT 0,
+        next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+        locked_until TIMESTAMP,
+        last_error TEXT,
+        created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+        processed_at TIMESTAMP
+    )`,
+    `CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (id) WHERE status = 'pending'`,
+    // The S3 key of a file is fixed at upload, so renaming a file only
+    // changes file_name. Files renamed before this column existed keep the
+    // new name as their key.
+    `ALTER TABLE files ADD COLUMN IF NOT EXISTS object_key TEXT`,
+    `UPDATE files SET object_key = file_name WHERE object_key IS NULL`,
+    `ALTER TABLE files ALTER COLUMN object_key SET NOT NULL`,
+    `CREATE INDEX IF NOT EXISTS files_object_key_idx ON files (object_key)`,
+    // Emails are unique regardless of case and stored lowercased. Accounts
+    // whose addresses differ only in case must be merged before this runs.
+    `CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON users (lower(email))`,
+    `ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_key`,
+    `UPDATE users SET email = lower(email) WHERE email <> lower(email)`,
+}
+
+// Migrate creates or updates the tables the server depends on
+func Migrate() error {
+    for i, statement := range migrations {
+        if _, err := DB.Exec(statement); err != nil {
+            return fmt.Errorf("migration %d failed: %v", i, err)
+        }
+    }
+
+    log.Println("Database schema is up to date")
+    return nil
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "log"
+    "net/http"
+    "trademarkia/internal/cache"
+    "trademarkia/internal/db"
+    "trademarkia/internal/models"
+)
+
+// Access levels on a file, from lowest to highest. Manage covers sharing the
+// file, publicly or with other users.
+const (
+    AccessView   = "view"
+    AccessEdit   = "edit"
+    AccessManage = "manage"
+)
+
+var accessRank = map[string]int{AccessView: 1, AccessEdit: 2, AccessManage: 3}
+
+var (
+    errFileNotFound     = errors.New("file not found")
+    errFileAccessDenied = errors.New("insufficient access to file")
+)
+
+// visibleFilesCondition restricts a query on files to the user's personal
+// files and the files of the workspaces they belong to. The user ID is $1.
+// Files shared directly with the user are listed separately.
+const visibleFilesCondition = `((files.workspace_id IS NULL AND files.user_id = $1)
+    OR files.workspace_id IN (SELECT workspace_id FROM workspace_members WHERE user_id = $1))`
+
+// fileAccess returns the user's access level on a file along with the file.
+// The uploader of a personal file manages it; workspace owners and editors
+// manage workspace files while viewers can only view them. A direct grant
+// adds view or edit access on top of that.
+//
+// The file record comes from the cache, so concurrent checks on a popular
+// file share one load. The caller's membership and grant are never cached and
+// cost one query per check.
+func fileAccess(ctx context.Context, userID, fileID int) (*models.File, string, error) {
+    file, err := fetchFile(ctx, fileID)
+    if err == sql.ErrNoRows {
+        return nil, "", errFileNotFound
+    }
+    if err != nil {
+        return nil, "", err
+    }
+    if file.WorkspaceID == nil && file.UserID == userID {
+        return file, AccessManage, nil
+    }
+
+    var memberRole, grant sql.NullString
+    err = db.DB.QueryRowContext(ctx, `SELECT
+            (SELECT role FROM workspace_members WHERE workspace_id = $2 AND user_id = $3),
+            (SELECT permission FROM file_grants WHERE file_id = $1 AND user_id = $3)`,
+        fileID, file.WorkspaceID, userID).Scan(&memberRole, &grant)
+    if err != nil {
+        return nil, "", err
+    }
+
+    access := ""
+    switch {
+    case memberRole.Valid && models.CanEditWorkspace(memberRole.String):
+        access = AccessManage
+    case memberRole.Valid:
+        access = AccessView
+    }
+    if grant.Valid && accessRank[grant.String] > accessRank[access] {
+        access = grant.String
+    }
+
+    if access == "" {
+        return nil, "", errFileNotFound
+    }
+    return file, access, nil
+}
+
+// fetchFile returns a file's record from the cache, or from the database when
+// it is not cached or the cache is unavailable. The load does not use ctx,
+// since other requests may be waiting on it.
+func fetchFile(ctx context.Context, fileID int) (*models.File, error) {
+    return cache.FetchFile(ctx, fileID, func() (*models.File, error) {
+        file := &models.File{ID: fileID}
+        var workspaceID sql.NullInt64
+        var fileURL sql.NullString
+        err := db.DB.QueryRow(`SELECT user_id, workspace_id, file_name, object_key, file_url, upload_date, file_size
+            FROM files WHERE id = $1`, fileID).
+            Scan(&file.UserID, &workspaceID, &file.FileName, &file.ObjectKey, &fileURL, &file.UploadDate, &file.FileSize)
+        if err != nil {
+            return nil, err
+        }
+        if workspaceID.Valid {
+            file.WorkspaceID = &workspaceID.Int64
+        }
+        file.FileURL = fileURL.String
+        return file, nil
+    })
+}
+
+// authorizeFile checks that the user has at least the given access level on
+// a file and returns the file. It writes the error response and returns
+// false otherwise. Files the user cannot see are reported as not found.
+func authorizeFile(w http.ResponseWriter, r *http.Request, userID, fileID int, level string) (*models.File, bool) {
+    file, access, err := fileAccess(r.Context(), userID, fileID)
+    if err == nil && accessRank[access] < accessRank[level] {
+        err = errFileAccessDenied
+    }
+
+    switch err {
+    case nil:
+        return file, true
+    case errFileNotFound:
+        http.Error(w, "File not found", http.StatusNotFound)
+    case errFileAccessDenied:
+        http.Error(w, "You do not have "+level+" access to this file", http.StatusForbidden)
+    default:
+        log.Println("Error checking file access:", err)
+        http.Error(w, "Error checking file access", http.StatusInternalServerError)
+    }
+    return nil, false
+}
+
+// workspaceRole returns the user's role in a workspace, or "" when they are not a member
+func workspaceRole(userID, workspaceID int) (string, error) {
+    var role string
+    err := db.DB.QueryRow("SELECT role FROM workspace_members WHERE workspace_id = $1 AND user_id = $2", workspaceID, userID).Scan(&role)
+    if err == sql.ErrNoRows {
+        return "", nil
+    }
+    return role, err
+}
@@ -0,0 +1,290 @@
+package handlers
+
+import (
+    "crypto/rand"
+    "database/sql"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "html/template"
+    "log"
+    "net/http"
+    "net/url"
+    "sync"
+    "time"
+    "trademarkia/config"
+    "trademarkia/internal/auth"
+    "trademarkia/internal/db"
+    "trademarkia/internal/mail"
+    "trademarkia/internal/models"
+
+    "github.com/dgrijalva/jwt-go"
+)
+
+// Purposes of single-use tokens sent by email
+const (
+    PurposeVerifyEmail   = "verify_email"
+    PurposePasswordReset = "password_reset"
+    PurposeEmailChange   = "email_change"
+)
+
+const (
+    verifyEmailTTL   = 24 * time.Hour
+    passwordResetTTL = 30 * time.Minute
+)
+
+var errInvalidToken = errors.New("invalid or expired token")
+
+// issueSingleUseToken signs a token for purpose and records its ID so it can only be redeemed once
+func issueSingleUseToken(userID int, email string, purpose string, ttl time.Duration) (string, error) {
+    idBytes := make([]byte, 16)
+    if _, err := rand.Read(idBytes); err != nil {
+        return "", err
+    }
+    tokenID := hex.EncodeToString(idBytes)
+    expiresAt := time.Now().Add(ttl)
+
+    _, err := db.DB.Exec("INSERT INTO user_tokens (id, user_id, purpose, expires_at) VALUES ($1, $2, $3, $4)",
+        tokenID, userID, purpose, expiresAt)
+    if err != nil {
+        return "", err
+    }
+
+    return auth.Keys.Sign(&Claims{
+        UserID:  userID,
+        Email:   email,
+        Purpose: purpose,
+        StandardClaims: jwt.StandardClaims{
+            Id:        tokenID,
+            ExpiresAt: expiresAt.Unix(),
+        },
+    })
+}
+
+// redeemSingleUseToken verifies a token issued for purpose and marks it as used
+func redeemSingleUseToken(tokenString string, purpose string) (*Claims, error) {
+    claims := &Claims{}
+    if err := auth.Keys.Parse(tokenString, claims); err != nil || claims.Purpose != purpose || claims.Id == "" {
+        return nil, errInvalidToken
+    }
+
+    result, err := db.DB.Exec("UPDATE user_tokens SET used_at = NOW() WHERE id = $1 AND user_id = $2 AND purpose = $3 AND used_at IS NULL AND expires_at > NOW()",
+        claims.Id, claims.UserID, purpose)
+    if err != nil {
+        return nil, err
+    }
+    if affected, _ := result.RowsAffected(); affected == 0 {
+        return nil, errInvalidToken
+    }
+
+    return claims, nil
+}
+
+// tokenLink builds a link to path on the public base URL carrying token
+func tokenLink(path string, token string) string {
+    baseURL := config.GetEnv("APP_BASE_URL", "http://localhost:8080")
+    return fmt.Sprintf("%s%s?token=%s", baseURL, path, url.QueryEscape(token))
+}
+
+// backgroundMail tracks the emails started by sendInBackground
+var backgroundMail sync.WaitGroup
+
+// sendInBackground runs send without holding up the response. Requests that
+// reveal nothing about whether an address is registered use it, so that a
+// registered address does not take longer to answer than an unknown one.
+func sendInBackground(kind string, send func() error) {
+    backgroundMail.Add(1)
+    go func() {
+        defer backgroundMail.Done()
+        if err := send(); err != nil {
+            log.Printf("Error sending %s email: %v", kind, err)
+        }
+    }()
+}
+
+// sendVerificationEmail emails a single-use email verification link
+func sendVerificationEmail(userID int, email string) error {
+    token, err := issueSingleUseToken(userID, email, PurposeVerifyEmail, verifyEmailTTL)
+    if err != nil {
+        return err
+    }
+
+    return mail.Default.Send(mail.Message{
+        To:      email,
+        Subject: "Verify your email address",
+        Body:    "Please verify your email address by opening the link below:\n\n" + tokenLink("/verify-email", token) + "\n\nThe link expires in 24 hours.",
+    })
+}
+
+// VerifyEmail marks the user's email as verified using the token from the verification link
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+    claims, err := redeemSingleUseToken(r.URL.Query().Get("token"), PurposeVerifyEmail)
+    if err == errInvalidToken {
+        http.Error(w, "Invalid or expired verification link", http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        log.Println("Error redeeming verification token:", err)
+        http.Error(w, "Error verifying email", http.StatusInternalServerError)
+        return
+    }
+
+    _, err = db.DB.Exec("UPDATE users SET email_verified = TRUE WHERE id = $1 AND lower(email) = lower($2)", claims.UserID, claims.Email)
+    if err != nil {
+        log.Println("Error verifying email:", err)
+        http.Error(w, "Error verifying email", http.StatusInternalServerError)
+        return
+    }
+
+    w.Write([]byte("Email verified successfully"))
+}
+
+// EmailRequest is the payload for endpoints that only take an email address
+type EmailRequest struct {
+    Email string `json:"email"`
+}
+
+// ResendVerificationEmail sends a new verification link. The response is the
+// same whether or not the address is registered.
+func ResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+    var req EmailRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid input", http.StatusBadRequest)
+        return
+    }
+
+    req.Email = models.NormalizeEmail(req.Email)
+    var userID int
+    var verified bool
+    err := db.DB.QueryRow("SELECT id, email_verified FROM users WHERE lower(email) = $1", req.Email).Scan(&userID, &verified)
+    if err != nil && err != sql.ErrNoRows {
+        log.Println("Error looking up user:", err)
+    }
+    if err == nil && !verified {
+        sendInBackground("verification", func() error { return sendVerificationEmail(userID, req.Email) })
+    }
+
+    w.WriteHeader(http.StatusAccepted)
+    w.Write([]byte("If the account exists and is unverified, a verification email has been sent"))
+}
+
+// ForgotPassword emails a password reset link. The response is the same
+// whether or not the address is registered.
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+    var req EmailRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid input", http.StatusBadRequest)
+        return
+    }
+
+    req.Email = models.NormalizeEmail(req.Email)
+    var userID int
+    err := db.DB.QueryRow("SELECT id FROM users WHERE lower(email) = $1 AND disabled = FALSE", req.Email).Scan(&userID)
+    if err != nil && err != sql.ErrNoRows {
+        log.Println("Error looking up user:", err)
+    }
+    if err == nil {
+        email := req.Email
+        sendInBackground("password reset", func() error {
+            token, err := issueSingleUseToken(userID, email, PurposePasswordReset, passwordResetTTL)
+            if err != nil {
+                return err
+            }
+            return mail.Default.Send(mail.Message{
+                To:      email,
+                Subject: "Reset your password",
+                Body:    "A password reset was requested for your account. Open the link below to choose a new password:\n\n" + tokenLink("/password/reset", token) + "\n\nThe link expires in 30 minutes. If you did not request this, you can ignore this email.",
+            })
+        })
+    }
+
+    w.WriteHeader(http.StatusAccepted)
+    w.Write([]byte("If the account exists, a password reset email has been sent"))
+}
+
+// PasswordResetRequest is the payload for completing a password reset
+type PasswordResetRequest struct {
+    Token    string `json:"token"`
+    Password string `json:"password"`
+}
+
+var resetPasswordPage = template.Must(template.New("reset").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Reset your password</title></head>
+<body>
+<form method="POST" action="/password/reset">
+<input type="hidden" name="token" value="{{.}}">
+<label>New password <input type="password" name="password" minlength="8" required></label>
+<button type="submit">Reset password</button>
+</form>
+</body>
+</html>
+`))
+
+// ResetPasswordForm serves the page the reset email links to. The page
+// posts the token and the new password to ResetPassword.
+func ResetPasswordForm(w http.ResponseWriter, r *http.Request) {
+    token := r.URL.Query().Get("token")
+    if token == "" {
+        http.Error(w, "Missing reset token", http.StatusBadRequest)
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    // Keep the token out of the Referer header of anything the page loads
+    w.Header().Set("Referrer-Policy", "no-referrer")
+    resetPasswordPage.Execute(w, token)
+}
+
+// ResetPassword sets a new password using the token from the reset link. It
+// accepts a JSON body or the form served by ResetPasswordForm.
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+    var req PasswordResetRequest
+    if r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+        if err := r.ParseForm(); err != nil {
+            http.Error(w, "Invalid input", http.StatusBadRequest)
+            return
+        }
+        req.Token, req.Password = r.PostFormValue("token"), r.PostFormValue("password")
+    } else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid input", http.StatusBadRequest)
+        return
+    }
+    if err := models.ValidatePassword(req.Password); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    claims, err := redeemSingleUseToken(req.Token, PurposePasswordReset)
+    if err == errInvalidToken {
+        http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        log.Println("Error redeeming password reset token:", err)
+        http.Error(w, "Error resetting password", http.StatusInternalServerError)
+        return
+    }
+
+    hashedPassword, err := HashPassword(req.Password)
+    if err != nil {
+        http.Error(w, "Error hashing password", http.StatusInternalServerError)
+        return
+    }
+
+    // Receiving the reset link proves ownership of the address as well
+    _, err = db.DB.Exec("UPDATE users SET password = $1, email_verified = TRUE WHERE id = $2 AND lower(email) = lower($3)", hashedPassword, claims.UserID, claims.Email)
+    if err != nil {
+        log.Println("Error resetting password:", err)
+        http.Error(w, "Error resetting password", http.StatusInternalServerError)
+        return
+    }
+
+    // Whoever knew the old password must not stay logged in
+    if err := revokeUserSessions(claims.UserID, ""); err != nil {
+        log.Println("Error revoking sessions:", err)
+    }
+
+    w.Write([]byte("Password reset successfully"))
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+
+    "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestResetPasswordFormPostsTheToken(t *testing.T) {
+    w := httptest.NewRecorder()
+    ResetPasswordForm(w, httptest.NewRequest("GET", "/password/reset?token="+url.QueryEscape(`abc"><script>`), nil))
+
+    body := w.Body.String()
+    if w.Code != http.StatusOK || !strings.Contains(body, `action="/password/reset"`) {
+        t.Fatalf("ResetPasswordForm = %d: %s", w.Code, body)
+    }
+    if strings.Contains(body, "<script>") || !strings.Contains(body, "abc&#34;&gt;&lt;script&gt;") {
+        t.Errorf("token not escaped in the form: %s", body)
+    }
+}
+
+func TestResetPasswordFormRequiresToken(t *testing.T) {
+    w := httptest.NewRecorder()
+    ResetPasswordForm(w, httptest.NewRequest("GET", "/password/reset", nil))
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("ResetPasswordForm without token = %d, want 400", w.Code)
+    }
+}
+
+func TestResetPasswordAcceptsTheForm(t *testing.T) {
+    // The password is validated before the token is redeemed, so a short
+    // password shows the form body was read
+    form := url.Values{"token": {"t"}, "password": {"short"}}
+    r := httptest.NewRequest("POST", "/password/reset", strings.NewReader(form.Encode()))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    w := httptest.NewRecorder()
+    ResetPassword(w, r)
+    if w.Code != http.StatusBadRequest || strings.Contains(w.Body.String(), "Invalid input") {
+        t.Errorf("ResetPassword(form) = %d: %s", w.Code, w.Body)
+    }
+}
+
+func TestForgotPasswordAnswersTheSameForUnknownAddresses(t *testing.T) {
+    tests := []struct {
+        name       string
+        registered bool
+    }{
+        {"registered", true},
+        {"unknown", false},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            testKeys(t)
+            box := mockMail(t)
+            mock := mockDB(t)
+            rows := sqlmock.NewRows([]string{"id"})
+            if test.registered {
+                rows.AddRow(1)
+            }
+            mock.ExpectQuery("SELECT id FROM users WHERE lower\\(email\\)").WithArgs("user@example.com").WillReturnRows(rows)
+            if test.registered {
+                mock.ExpectExec("INSERT INTO user_tokens").WithArgs(sqlmock.AnyArg(), 1, PurposePasswordReset, sqlmock.AnyArg()).
+                    WillReturnResult(sqlmock.NewResult(0, 1))
+            }
+
+            w := httptest.NewRecorder()
+            ForgotPassword(w, httptest.NewRequest("POST", "/password/forgot", strings.NewReader(`{"email": "User@example.com"}`)))
+            // The reset email is sent after the response
+            backgroundMail.Wait()
+            if w.Code != http.StatusAccepted || w.Body.String() != "If the account exists, a password reset email has been sent" {
+                t.Errorf("response = %d %q", w.Code, w.Body)
+            }
+            if sent := len(box.sent); (sent == 1) != test.registered {
+                t.Errorf("sent %d emails, registered = %v", sent, test.registered)
+            }
+        })
+    }
+}
@@ -0,0 +1,298 @@
+package handlers
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+    "trademarkia/internal/auth"
+    "trademarkia/internal/background"
+    "trademarkia/internal/cache"
+    "trademarkia/internal/db"
+
+    "github.com/gorilla/mux"
+)
+
+// AdminUser is a user account as seen by admins and auditors
+type AdminUser struct {
+    ID       int    `json:"id"`
+    Email    string `json:"email"`
+    Role     string `json:"role"`
+    Plan     string `json:"plan"`
+    Disabled bool   `json:"disabled"`
+}
+
+// AdminFile is the full metadata record of a file, regardless of owner
+type AdminFile struct {
+    ID         int       `json:"file_id"`
+    UserID     int       `json:"user_id"`
+    FileName   string    `json:"file_name"`
+    FileURL    string    `json:"file_url"`
+    FileSize   int64     `json:"file_size"`
+    UploadDate time.Time `json:"upload_date"`
+}
+
+// AdminListUsers lists every user account
+func AdminListUsers(w http.ResponseWriter, r *http.Request) {
+    rows, err := db.DB.Query("SELECT id, email, role, plan, disabled FROM users ORDER BY id")
+    if err != nil {
+        log.Println("Error retrieving users:", err)
+        http.Error(w, "Error retrieving users", http.StatusInternalServerError)
+        return
+    }
+    defer rows.Close()
+
+    users := []AdminUser{}
+    for rows.Next() {
+        var user AdminUser
+        if err := rows.Scan(&user.ID, &user.Email, &user.Role, &user.Plan, &user.Disabled); err != nil {
+            log.Println("Error scanning users:", err)
+            http.Error(w, "Error retrieving users", http.StatusInternalServerError)
+            return
+        }
+        users = append(users, user)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(users)
+}
+
+// AdminDisableUser disables an account, blocking login and all existing tokens and API keys
+func AdminDisableUser(w http.ResponseWriter, r *http.Request) {
+    setUserDisabled(w, r, true)
+}
+
+// AdminEnableUser re-enables a disabled account
+func AdminEnableUser(w http.ResponseWriter, r *http.Request) {
+    setUserDisabled(w, r, false)
+}
+
+func setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+    userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+    if err != nil {
+        http.Error(w, "Invalid user ID", http.StatusBadRequest)
+        return
+    }
+
+    if userID == r.Context().Value("userID").(int) {
+        http.Error(w, "Admins cannot change their own account status", http.StatusBadRequest)
+        return
+    }
+
+    result, err := db.DB.Exec("UPDATE users SET disabled = $1 WHERE id = $2", disabled, userID)
+    if err != nil {
+        log.Println("Error updating user status:", err)
+        http.Error(w, "Error updating user status", http.StatusInternalServerError)
+        return
+    }
+    if affected, _ := result.RowsAffected(); affected == 0 {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+
+    if disabled {
+        if err := revokeUserSessions(userID, ""); err != nil {
+            log.Println("Error revoking sessions:", err)
+        }
+    }
+
+    w.Write([]byte("User status updated successfully"))
+}
+
+// AdminUnlockUser clears the failed login counters and lockout of an account
+func AdminUnlockUser(w http.ResponseWriter, r *http.Request) {
+    userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+    if err != nil {
+        http.Error(w, "Invalid user ID", http.StatusBadRequest)
+        return
+    }
+
+    var email string
+    err = db.DB.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&email)
+    if err == sql.ErrNoRows {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        log.Println("Error retrieving user:", err)
+        http.Error(w, "Error retrieving user", http.StatusInternalServerError)
+        return
+    }
+
+    if err := db.Redis.Del(r.Context(), accountKey("fail", email), accountKey("delay", email), accountKey("lock", email)).Err(); err != nil {
+        log.Println("Error unlocking account:", err)
+        http.Error(w, "Error unlocking account", http.StatusInternalServerError)
+        return
+    }
+
+    w.Write([]byte("Account unlocked successfully"))
+}
+
+// AdminSetUserRole changes the role of an account
+func AdminSetUserRole(w http.ResponseWriter, r *http.Request) {
+    userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+    if err != nil {
+        http.Error(w, "Invalid user ID", http.StatusBadRequest)
+        return
+    }
+
+    var req struct {
+        Role string `json:"role"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !auth.ValidRole(req.Role) {
+        http.Error(w, "Invalid role", http.StatusBadRequest)
+        return
+    }
+
+    if userID == r.Context().Value("userID").(int) {
+        http.Error(w, "Admins cannot change their own role", http.StatusBadRequest)
+        return
+    }
+
+    result, err := db.DB.Exec("UPDATE users SET role = $1 WHERE id = $2", req.Role, userID)
+    if err != nil {
+        log.Println("Error updating user role:", err)
+        http.Error(w, "Error updating user role", http.StatusInternalServerError)
+        return
+    }
+    if affected, _ := result.RowsAffected(); affected == 0 {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+
+    w.Write([]byte("User role updated successfully"))
+}
+
+// AdminSetUserPlan changes the plan of an account, which selects its rate limits
+func AdminSetUserPlan(w http.ResponseWriter, r *http.Request) {
+    userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+    if err != nil {
+        http.Error(w, "Invalid user ID", http.StatusBadRequest)
+        return
+    }
+
+    var req struct {
+        Plan string `json:"plan"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !auth.ValidPlan(req.Plan) {
+        http.Error(w, "Invalid plan", http.StatusBadRequest)
+        return
+    }
+
+    result, err := db.DB.Exec("UPDATE users SET plan = $1, updated_at = NOW() WHERE id = $2", req.Plan, userID)
+    if err != nil {
+        log.Println("Error updating user plan:", err)
+        http.Error(w, "Error updating user plan", http.StatusInternalServerError)
+        return
+    }
+    if affected, _ := result.RowsAffected(); affected == 0 {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+
+    w.Write([]byte("User plan updated successfully"))
+}
+
+// AdminGetFile returns the metadata of any file
+func AdminGetFile(w http.ResponseWriter, r *http.Request) {
+    fileID, err := strconv.Atoi(mux.Vars(r)["file_id"])
+    if err != nil {
+        http.Error(w, "Invalid file ID", http.StatusBadRequest)
+        return
+    }
+
+    var file AdminFile
+    var fileURL sql.NullString
+    err = db.DB.QueryRow("SELECT id, user_id, file_name, file_url, file_size, upload_date FROM files WHERE id = $1", fileID).
+        Scan(&file.ID, &file.UserID, &file.FileName, &fileURL, &file.FileSize, &file.UploadDate)
+    if err == sql.ErrNoRows {
+        http.Error(w, "File not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        log.Println("Error retrieving file metadata:", err)
+        http.Error(w, "Error retrieving file metadata", http.StatusInternalServerError)
+        return
+    }
+
+    file.FileURL = "No URL available"
+    if fileURL.Valid {
+        file.FileURL = fileURL.String
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(file)
+}
+
+// AdminDeleteFile removes any file's metadata from the database. Its object
+// is deleted from S3, its cache entries dropped and its owner notified by the
+// outbox relay once the row is gone.
+func AdminDeleteFile(w http.ResponseWriter, r *http.Request) {
+    adminID := r.Context().Value("userID").(int)
+    fileID, err := strconv.Atoi(mux.Vars(r)["file_id"])
+    if err != nil {
+        http.Error(w, "Invalid file ID", http.StatusBadRequest)
+        return
+    }
+
+    tx, err := db.DB.Begin()
+    if err != nil {
+        log.Println("Error starting transaction:", err)
+        http.Error(w, "Error deleting file", http.StatusInternalServerError)
+        return
+    }
+    defer tx.Rollback()
+
+    var fileName, objectKey string
+    var ownerID int
+    err = tx.QueryRow("SELECT file_name, object_key, user_id FROM files WHERE id = $1 FOR UPDATE", fileID).Scan(&fileName, &objectKey, &ownerID)
+    if err == sql.ErrNoRows {
+        http.Error(w, "File not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        log.Println("Error retrieving file metadata:", err)
+        http.Error(w, "Error retrieving file metadata", http.StatusInternalServerError)
+        return
+    }
+
+    audience := cache.FileAudienceTx(tx, fileID)
+    if _, err := tx.Exec("DELETE FROM files WHERE id = $1", fileID); err != nil {
+        log.Println("Error deleting file metadata:", err)
+        http.Error(w, "Error deleting file metadata", http.StatusInternalServerError)
+        return
+    }
+
+    err = background.WriteOutbox(tx, background.OutboxStorageDelete, background.StorageDeletePayload{Keys: []string{objectKey}})
+    if err == nil {
+        err = background.WriteOutbox(tx, background.OutboxCacheInvalidate, background.CacheInvalidatePayload{
+            FileIDs:  []int{fileID},
+            Audience: audience,
+        })
+    }
+    if err == nil && ownerID != adminID {
+        err = background.WriteOutbox(tx, background.OutboxNotify, background.NotifyPayload{
+            UserID:  ownerID,
+            Subject: "A file was removed",
+            Body:    fmt.Sprintf("%s was removed by an administrator.", fileName),
+        })
+    }
+    if err != nil {
+        log.Println("Error writing outbox event:", err)
+        http.Error(w, "Error deleting file", http.StatusInternalServerError)
+        return
+    }
+
+    if err := tx.Commit(); err != nil {
+        log.Println("Error committing file deletion:", err)
+        http.Error(w, "Error deleting file", http.StatusInternalServerError)
+        return
+    }
+    background.WakeOutboxRelay()
+
+    log.Printf("Admin %d force-deleted file ID: %d", adminID, fileID)
+    w.Write([]byte("File deleted successfully"))
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/gorilla/mux"
+)
+
+func TestAdminListUsers(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectQuery("SELECT id, email, role, plan, disabled FROM users").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "plan", "disabled"}).
+            AddRow(1, "admin@example.com", "admin", "free", false).
+            AddRow(2, "user@example.com", "user", "pro", true))
+
+    w := httptest.NewRecorder()
+    AdminListUsers(w, asUser(httptest.NewRequest("GET", "/admin/users", nil), 1, "admin"))
+
+    var users []AdminUser
+    json.NewDecoder(w.Body).Decode(&users)
+    if len(users) != 2 || !users[1].Disabled || users[1].Plan != "pro" {
+        t.Errorf("users = %+v", users)
+    }
+}
+
+func TestAdminSetUserRole(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectExec("UPDATE users SET role").WithArgs("auditor", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("UPDATE users SET role").WithArgs("auditor", 9).WillReturnResult(sqlmock.NewResult(0, 0))
+
+    tests := []struct {
+        userID string
+        body   string
+        want   int
+    }{
+        {"2", `{"role":"auditor"}`, http.StatusOK},
+        {"9", `{"role":"auditor"}`, http.StatusNotFound},
+        {"2", `{"role":"owner"}`, http.StatusBadRequest},
+        // Admins cannot demote themselves and lock everyone out
+        {"1", `{"role":"user"}`, http.StatusBadRequest},
+    }
+    for _, test := range tests {
+        r := asUser(httptest.NewRequest("PUT", "/admin/users/"+test.userID+"/role", strings.NewReader(test.body)), 1, "admin")
+        r = mux.SetURLVars(r, map[string]string{"user_id": test.userID})
+        w := httptest.NewRecorder()
+        AdminSetUserRole(w, r)
+        if w.Code != test.want {
+            t.Errorf("AdminSetUserRole(%s, %s) = %d, want %d", test.userID, test.body, w.Code, test.want)
+        }
+    }
+}
+
+func TestAdminDisableUserRevokesSessions(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectExec("UPDATE users SET disabled").WithArgs(true, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("UPDATE sessions SET revoked_at").WithArgs(2, "").WillReturnResult(sqlmock.NewResult(0, 3))
+
+    r := asUser(httptest.NewRequest("POST", "/admin/users/2/disable", nil), 1, "admin")
+    r = mux.SetURLVars(r, map[string]string{"user_id": "2"})
+    w := httptest.NewRecorder()
+    AdminDisableUser(w, r)
+    if w.Code != http.StatusOK {
+        t.Errorf("AdminDisableUser = %d: %s", w.Code, w.Body)
+    }
+}
+
+func TestAdminCannotDisableThemselves(t *testing.T) {
+    mockDB(t)
+    r := asUser(httptest.NewRequest("POST", "/admin/users/1/disable", nil), 1, "admin")
+    r = mux.SetURLVars(r, map[string]string{"user_id": "1"})
+    w := httptest.NewRecorder()
+    AdminDisableUser(w, r)
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("AdminDisableUser on self = %d, want 400", w.Code)
+    }
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+    "database/sql"
+    "encoding/json"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "trademarkia/internal/auth"
+    "trademarkia/internal/db"
+
+    "github.com/gorilla/mux"
+)
+
+// APIKey describes a personal API key. The secret itself is only ever
+// returned once, when the key is created.
+type APIKey struct {
+    ID         int        `json:"id"`
+    Name       string     `json:"name"`
+    Prefix     string     `json:"prefix"`
+    Scopes     []string   `json:"scopes"`
+    CreatedAt  time.Time  `json:"created_at"`
+    LastUsedAt *time.Time `json:"last_used_at"`
+    Key        string     `json:"key,omitempty"`
+}
+
+// APIKeyRequest is the payload for creating an API key
+type APIKeyRequest struct {
+    Name   string   `json:"name"`
+    Scopes []string `json:"scopes"`
+}
+
+// CreateAPIKey creates a named, scoped API key for the authenticated user
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    var req APIKeyRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid input", http.StatusBadRequest)
+        return
+    }
+
+    req.Name = strings.TrimSpace(req.Name)
+    if req.Name == "" {
+        http.Error(w, "API key name is required", http.StatusBadRequest)
+        return
+    }
+    if len(req.Scopes) == 0 {
+        http.Error(w, "At least one scope is required", http.StatusBadRequest)
+        return
+    }
+    for _, scope := range req.Scopes {
+        if !auth.ValidScope(scope) {
+            http.Error(w, "Invalid scope: "+scope, http.StatusBadRequest)
+            return
+        }
+    }
+
+    key, prefix, hash, err := auth.GenerateAPIKey()
+    if err != nil {
+        log.Println("Error generating API key:", err)
+        http.Error(w, "Error generating API key", http.StatusInternalServerError)
+        return
+    }
+
+    apiKey := APIKey{Name: req.Name, Prefix: prefix, Scopes: req.Scopes, Key: key}
+    err = db.DB.QueryRow("INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+        userID, req.Name, prefix, hash, strings.Join(req.Scopes, ",")).Scan(&apiKey.ID, &apiKey.CreatedAt)
+    if err != nil {
+        log.Println("Error saving API key:", err)
+        http.Error(w, "Error saving API key", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(apiKey)
+}
+
+// ListAPIKeys lists the authenticated user's active API keys
+func ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    rows, err := db.DB.Query("SELECT id, name, prefix, scopes, created_at, last_used_at FROM api_keys WHERE user_id = $1 AND revoked_at IS NULL ORDER BY created_at DESC", userID)
+    if err != nil {
+        log.Println("Error retrieving API keys:", err)
+        http.Error(w, "Error retrieving API keys", http.StatusInternalServerError)
+        return
+    }
+    defer rows.Close()
+
+    keys := []APIKey{}
+    for rows.Next() {
+        var apiKey APIKey
+        var scopes string
+        var lastUsed sql.NullTime
+
+        if err := rows.Scan(&apiKey.ID, &apiKey.Name, &apiKey.Prefix, &scopes, &apiKey.CreatedAt, &lastUsed); err != nil {
+            log.Println("Error scanning API keys:", err)
+            http.Error(w, "Error retrieving API keys", http.StatusInternalServerError)
+            return
+        }
+
+        apiKey.Scopes = strings.Split(scopes, ",")
+        if lastUsed.Valid {
+            apiKey.LastUsedAt = &lastUsed.Time
+        }
+        keys = append(keys, apiKey)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(keys)
+}
+
+// RevokeAPIKey revokes one of the authenticated user's API keys
+func RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    keyID, err := strconv.Atoi(mux.Vars(r)["key_id"])
+    if err != nil {
+        http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+        return
+    }
+
+    result, err := db.DB.Exec("UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL", keyID, userID)
+    if err != nil {
+        log.Println("Error revoking API key:", err)
+        http.Error(w, "Error revoking API key", http.StatusInternalServerError)
+        return
+    }
+
+    if affected, _ := result.RowsAffected(); affected == 0 {
+        http.Error(w, "API key not found", http.StatusNotFound)
+        return
+    }
+
+    w.Write([]byte("API key revoked successfully"))
+}
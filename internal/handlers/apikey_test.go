@@ -0,0 +1,80 @@
+package handlers
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/gorilla/mux"
+)
+
+func TestCreateAPIKeyValidatesScopes(t *testing.T) {
+    for _, body := range []string{`{"name":"ci","scopes":[]}`, `{"name":"ci","scopes":["admin"]}`, `{"name":" ","scopes":["read"]}`} {
+        r := asUser(httptest.NewRequest("POST", "/api-keys", strings.NewReader(body)), 1, "user")
+        w := httptest.NewRecorder()
+        CreateAPIKey(w, r)
+        if w.Code != http.StatusBadRequest {
+            t.Errorf("CreateAPIKey(%s) = %d, want 400", body, w.Code)
+        }
+    }
+}
+
+func TestCreateAPIKeyReturnsTheKeyOnce(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectQuery("INSERT INTO api_keys").
+        WithArgs(1, "ci", sqlmock.AnyArg(), sqlmock.AnyArg(), "read,upload").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(5, time.Now()))
+
+    r := asUser(httptest.NewRequest("POST", "/api-keys", strings.NewReader(`{"name":"ci","scopes":["read","upload"]}`)), 1, "user")
+    w := httptest.NewRecorder()
+    CreateAPIKey(w, r)
+    if w.Code != http.StatusCreated {
+        t.Fatalf("CreateAPIKey = %d: %s", w.Code, w.Body)
+    }
+
+    var key APIKey
+    json.NewDecoder(w.Body).Decode(&key)
+    if key.ID != 5 || !strings.HasPrefix(key.Key, "tmk_"+key.Prefix+"_") {
+        t.Errorf("created key = %+v", key)
+    }
+}
+
+func TestListAPIKeysOmitsSecrets(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectQuery("SELECT (.+) FROM api_keys WHERE user_id = \\$1 AND revoked_at IS NULL").WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "name", "prefix", "scopes", "created_at", "last_used_at"}).
+            AddRow(5, "ci", "abc123", "read,share", time.Now(), nil))
+
+    w := httptest.NewRecorder()
+    ListAPIKeys(w, asUser(httptest.NewRequest("GET", "/api-keys", nil), 1, "user"))
+
+    var keys []APIKey
+    json.NewDecoder(w.Body).Decode(&keys)
+    if len(keys) != 1 || keys[0].Key != "" || len(keys[0].Scopes) != 2 {
+        t.Errorf("listed keys = %+v", keys)
+    }
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectExec("UPDATE api_keys SET revoked_at").WithArgs(5, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("UPDATE api_keys SET revoked_at").WithArgs(6, 1).WillReturnResult(sqlmock.NewResult(0, 0))
+
+    tests := []struct {
+        keyID string
+        want  int
+    }{{"5", http.StatusOK}, {"6", http.StatusNotFound}}
+    for _, test := range tests {
+        r := asUser(httptest.NewRequest("DELETE", "/api-keys/"+test.keyID, nil), 1, "user")
+        r = mux.SetURLVars(r, map[string]string{"key_id": test.keyID})
+        w := httptest.NewRecorder()
+        RevokeAPIKey(w, r)
+        if w.Code != test.want {
+            t.Errorf("RevokeAPIKey(%s) = %d, want %d", test.keyID, w.Code, test.want)
+        }
+    }
+}
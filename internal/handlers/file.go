@@ -1,7 +1,6 @@
 package handlers
 
 import (
-    "context"
     "encoding/json"
     "fmt"
     "log"
@@ -12,28 +11,19 @@ import (
     "bytes"
     "database/sql"
 
-    "github.com/go-redis/redis/v8"
     "github.com/gorilla/mux"
+    "trademarkia/internal/background"
+    "trademarkia/internal/cache"
     "trademarkia/internal/db"
+    "trademarkia/internal/models"
     "github.com/aws/aws-sdk-go/aws"
     "github.com/aws/aws-sdk-go/aws/session"
     "github.com/aws/aws-sdk-go/service/s3"
 )
 
-var (
-    s3session *s3.S3
-    rdb       *redis.Client
-    ctx       = context.Background()
-)
+var s3session *s3.S3
 
 func init() {
-    // Initialize Redis
-    rdb = redis.NewClient(&redis.Options{
-        Addr:     "localhost:6379", // Default Redis port
-        Password: "",               // No password set
-        DB:       0,                // Default DB
-    })
-
     // Initialize AWS S3 session
     s3session = s3.New(session.Must(session.NewSession(&aws.Config{
         Region: aws.String("ap-south-1"),
@@ -45,6 +35,9 @@ func init() {
 func HandleFileUpload(w http.ResponseWriter, r *http.Request) {
     userID := r.Context().Value("userID").(int)
 
+    // Receive the body at the user's upload rate
+    upload := throttleUpload(r, userID)
+
     // Parse multipart form data
     r.ParseMultipartForm(10 << 20) // Limit file size to 10 MB
     file, handler, err := r.FormFile("file")
@@ -54,6 +47,27 @@ func HandleFileUpload(w http.ResponseWriter, r *http.Request) {
     }
     defer file.Close()
 
+    // Files can be uploaded to a workspace the user can edit
+    var workspaceID sql.NullInt64
+    if value := r.FormValue("workspace_id"); value != "" {
+        id, err := strconv.Atoi(value)
+        if err != nil {
+            http.Error(w, "Invalid workspace ID", http.StatusBadRequest)
+            return
+        }
+        role, err := workspaceRole(userID, id)
+        if err != nil {
+            log.Println("Error checking workspace membership:", err)
+            http.Error(w, "Error checking workspace membership", http.StatusInternalServerError)
+            return
+        }
+        if !models.CanEditWorkspace(role) {
+            http.Error(w, "You cannot upload to this workspace", http.StatusForbidden)
+            return
+        }
+        workspaceID = sql.NullInt64{Int64: int64(id), Valid: true}
+    }
+
     // Read the file into a buffer
     buffer := make([]byte, handler.Size)
     _, err = file.Read(buffer)
@@ -72,8 +86,8 @@ func HandleFileUpload(w http.ResponseWriter, r *http.Request) {
 
     // Save file metadata within the transaction
     var fileID int
-    err = tx.QueryRow("INSERT INTO files (user_id, file_name, file_size, upload_date) VALUES ($1, $2, $3, $4) RETURNING id",
-        userID, handler.Filename, handler.Size, time.Now()).Scan(&fileID)
+    err = tx.QueryRow("INSERT INTO files (user_id, workspace_id, file_name, object_key, file_size, upload_date) VALUES ($1, $2, $3, $3, $4, $5) RETURNING id",
+        userID, workspaceID, handler.Filename, handler.Size, time.Now()).Scan(&fileID)
     if err != nil {
         log.Println("Error saving file metadata:", err)
         tx.Rollback() // Rollback the transaction if there's an error
@@ -99,6 +113,18 @@ func HandleFileUpload(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    // Listings are invalidated by the outbox relay once the upload commits
+    err = background.WriteOutbox(tx, background.OutboxCacheInvalidate, background.CacheInvalidatePayload{
+        FileIDs:  []int{fileID},
+        Audience: cache.FileAudienceTx(tx, fileID),
+    })
+    if err != nil {
+        log.Println("Error writing outbox event:", err)
+        tx.Rollback()
+        http.Error(w, "Error saving file metadata", http.StatusInternalServerError)
+        return
+    }
+
     // Commit the transaction if all steps succeed
     err = tx.Commit()
     if err != nil {
@@ -107,7 +133,8 @@ func HandleFileUpload(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    cacheFileMetadata(fileID, handler.Filename)
+    background.WakeOutboxRelay()
+    recordTransfer(userID, upload.N, 0)
 
     w.Write([]byte(fmt.Sprintf("File uploaded successfully. Public URL: %s", fileURL)))
 }
@@ -115,7 +142,7 @@ func HandleFileUpload(w http.ResponseWriter, r *http.Request) {
 
 func storeFileMetadata(filename string, fileSize int64, userID int) int {
     var fileID int
-    err := db.DB.QueryRow("INSERT INTO files (user_id, file_name, file_size, upload_date) VALUES ($1, $2, $3, $4) RETURNING id",
+    err := db.DB.QueryRow("INSERT INTO files (user_id, file_name, object_key, file_size, upload_date) VALUES ($1, $2, $2, $3, $4) RETURNING id",
         userID, filename, fileSize, time.Now()).Scan(&fileID)
     if err != nil {
         log.Println("Error saving file metadata:", err)
@@ -124,15 +151,6 @@ func storeFileMetadata(filename string, fileSize int64, userID int) int {
     return fileID
 }
 
-func cacheFileMetadatad(fileID int, fileName string) {
-    err := rdb.Set(ctx, fmt.Sprintf("file_%d", fileID), fileName, 24*time.Hour).Err()
-    if err != nil {
-        log.Println("Error caching file metadata in Redis:", err)
-    } else {
-        log.Printf("File metadata cached for file ID: %d", fileID)
-    }
-}
-
 func processFileUpload(filename string, fileBytes []byte) (string, error) {
     log.Printf("Processing upload for file: %s", filename)
 
@@ -165,46 +183,79 @@ func uploadToS3(filename string, fileBytes []byte) (string, error) {
     return fileURL, nil
 }
 
-// GetFiles retrieves all files uploaded by the user
-func GetFiles(w http.ResponseWriter, r *http.Request) {
-    userID := r.Context().Value("userID").(int)
+// fileColumns are the columns scanned by scanFile
+const fileColumns = "id, user_id, workspace_id, file_name, file_url, upload_date, file_size"
 
-    rows, err := db.DB.Query("SELECT id, file_name, file_url, upload_date, file_size FROM files WHERE user_id = $1", userID)
+// scanFile reads a file record selected with fileColumns
+func scanFile(row interface{ Scan(...interface{}) error }) (*models.File, error) {
+    var file models.File
+    var workspaceID sql.NullInt64
+    var fileURL sql.NullString
+    err := row.Scan(&file.ID, &file.UserID, &workspaceID, &file.FileName, &fileURL, &file.UploadDate, &file.FileSize)
     if err != nil {
-        log.Println("Error retrieving files:", err)
-        http.Error(w, "Error retrieving files", http.StatusInternalServerError)
-        return
+        return nil, err
     }
-    defer rows.Close()
 
-    var files []map[string]interface{}
+    file.FileURL = "No URL available"
+    if fileURL.Valid {
+        file.FileURL = fileURL.String
+    }
+    if workspaceID.Valid {
+        file.WorkspaceID = &workspaceID.Int64
+    }
+    return &file, nil
+}
 
-    for rows.Next() {
-        var fileID int
-        var fileName string
-        var fileURL sql.NullString
-        var uploadDate time.Time
-        var fileSize int64
+// GetFiles retrieves the user's own files and the files of their workspaces,
+// optionally limited to one workspace with ?workspace_id=. Listings are
+// cached per user until one of the listed files changes.
+func GetFiles(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
 
-        if err := rows.Scan(&fileID, &fileName, &fileURL, &uploadDate, &fileSize); err != nil {
-            log.Println("Error scanning files:", err)
-            http.Error(w, "Error scanning files", http.StatusInternalServerError)
+    query := "SELECT " + fileColumns + " FROM files WHERE " + visibleFilesCondition
+    args := []interface{}{userID}
+    workspaceID := 0
+    if value := r.URL.Query().Get("workspace_id"); value != "" {
+        var err error
+        workspaceID, err = strconv.Atoi(value)
+        if err != nil {
+            http.Error(w, "Invalid workspace ID", http.StatusBadRequest)
             return
         }
+        query += " AND workspace_id = $2"
+        args = append(args, workspaceID)
+    }
 
-        fileData := map[string]interface{}{
-            "file_id":     fileID,
-            "file_name":   fileName,
-            "file_url":    "No URL available",
-            "upload_date": uploadDate,
-            "file_size":   fileSize,
+    load := func() ([]models.File, error) {
+        rows, err := db.DB.Query(query, args...)
+        if err != nil {
+            return nil, err
         }
-
-        if fileURL.Valid {
-            fileData["file_url"] = fileURL.String
+        defer rows.Close()
+
+        var files []models.File
+        for rows.Next() {
+            file, err := scanFile(rows)
+            if err != nil {
+                return nil, err
+            }
+            files = append(files, *file)
         }
+        return files, rows.Err()
+    }
 
-        files = append(files, fileData)
+    // The listing key must be read before the query, see cache.ListingKey
+    var files []models.File
+    var err error
+    if cacheKey, ok := cache.ListingKey(r.Context(), userID, workspaceID); ok {
+        files, err = cache.FetchFileList(r.Context(), cacheKey, load)
+    } else {
+        files, err = load()
+    }
+    if err != nil {
+        log.Println("Error retrieving files:", err)
+        http.Error(w, "Error retrieving files", http.StatusInternalServerError)
+        return
     }
 
     json.NewEncoder(w).Encode(files)
@@ -225,8 +276,12 @@ func GeneratePreSignedURL(filename string, expiration time.Duration) (string, er
     return presignedURL, nil
 }
 
-// ShareFile allows a user to share a public link for a file by its ID
+// ShareFile allows a user to share a public link for a file by its ID.
+// Personal files can be shared by their uploader, workspace files by owners
+// and editors.
 func ShareFile(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
     vars := mux.Vars(r)
     fileID, err := strconv.Atoi(vars["file_id"])
     if err != nil {
@@ -234,46 +289,30 @@ func ShareFile(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    key := fmt.Sprintf("file_%d", fileID)
-    cachedFileName, err := rdb.Get(ctx, key).Result()
-
-    if err == redis.Nil {
-        // Cache miss, retrieve from DB
-        var fileName sql.NullString
-        err := db.DB.QueryRow("SELECT file_name FROM files WHERE id = $1", fileID).Scan(&fileName)
-        if err != nil {
-            log.Println("Error retrieving file name:", err)
-            http.Error(w, "Error retrieving file name", http.StatusInternalServerError)
-            return
-        }
-
-        if !fileName.Valid {
-            http.Error(w, "No file available", http.StatusNotFound)
-            return
-        }
+    file, ok := authorizeFile(w, r, userID, fileID, AccessManage)
+    if !ok {
+        return
+    }
 
-        // Cache the file name in Redis
-        cacheFileMetadatad(fileID, fileName.String)
+    preSignedURL, err := GeneratePreSignedURL(file.ObjectKey, 1*time.Hour)
+    if err != nil {
+        log.Println("Error generating pre-signed URL:", err)
+        http.Error(w, "Error generating pre-signed URL", http.StatusInternalServerError)
+        return
+    }
 
-        preSignedURL, err := GeneratePreSignedURL(fileName.String, 1*time.Hour)
-        if err != nil {
-            log.Println("Error generating pre-signed URL:", err)
-            http.Error(w, "Error generating pre-signed URL", http.StatusInternalServerError)
-            return
-        }
+    recordShareLink(r, fileID, 1*time.Hour)
 
-        w.Write([]byte(fmt.Sprintf("Pre-signed URL: %s", preSignedURL)))
-    } else if err != nil {
-        log.Printf("Error retrieving from Redis for key: %s, err: %v", key, err)
-        http.Error(w, "Error retrieving from cache", http.StatusInternalServerError)
-    } else {
-        preSignedURL, err := GeneratePreSignedURL(cachedFileName, 1*time.Hour)
-        if err != nil {
-            log.Println("Error generating pre-signed URL:", err)
-            http.Error(w, "Error generating pre-signed URL", http.StatusInternalServerError)
-            return
-        }
+    w.Write([]byte(fmt.Sprintf("Pre-signed URL: %s", preSignedURL)))
+}
 
-        w.Write([]byte(fmt.Sprintf("Pre-signed URL (cached): %s", preSignedURL)))
+// recordShareLink keeps a record of an issued share link so it can be
+// included in the user's data export
+func recordShareLink(r *http.Request, fileID int, expiresIn time.Duration) {
+    userID := r.Context().Value("userID").(int)
+    _, err := db.DB.Exec("INSERT INTO share_links (file_id, user_id, expires_at) VALUES ($1, $2, $3)",
+        fileID, userID, time.Now().Add(expiresIn))
+    if err != nil {
+        log.Println("Error recording share link:", err)
     }
 }
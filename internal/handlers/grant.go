@@ -0,0 +1,216 @@
+package handlers
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+    "trademarkia/internal/db"
+    "trademarkia/internal/mail"
+    "trademarkia/internal/models"
+
+    "github.com/gorilla/mux"
+)
+
+// FileGrantRequest shares a file with another registered user
+type FileGrantRequest struct {
+    Email      string `json:"email"`
+    Permission string `json:"permission"`
+}
+
+// FileGrant is a user's direct access to a file
+type FileGrant struct {
+    UserID     int       `json:"user_id"`
+    Email      string    `json:"email"`
+    Permission string    `json:"permission"`
+    CreatedAt  time.Time `json:"created_at"`
+}
+
+// SharedFile is a file another user has shared with the caller
+type SharedFile struct {
+    ID         int       `json:"file_id"`
+    FileName   string    `json:"file_name"`
+    FileSize   int64     `json:"file_size"`
+    UploadDate time.Time `json:"upload_date"`
+    Permission string    `json:"permission"`
+    SharedBy   string    `json:"shared_by"`
+    SharedAt   time.Time `json:"shared_at"`
+}
+
+// GrantFileAccess gives another user view or edit access to a file, or
+// changes the permission of an existing grant
+func GrantFileAccess(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    fileID, err := strconv.Atoi(mux.Vars(r)["file_id"])
+    if err != nil {
+        http.Error(w, "Invalid file ID", http.StatusBadRequest)
+        return
+    }
+
+    file, ok := authorizeFile(w, r, userID, fileID, AccessManage)
+    if !ok {
+        return
+    }
+
+    var req FileGrantRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid input", http.StatusBadRequest)
+        return
+    }
+    if req.Permission != AccessView && req.Permission != AccessEdit {
+        http.Error(w, "Permission must be view or edit", http.StatusBadRequest)
+        return
+    }
+
+    var granteeID int
+    var granteeEmail string
+    err = db.DB.QueryRow("SELECT id, email FROM users WHERE lower(email) = $1 AND NOT disabled", models.NormalizeEmail(req.Email)).Scan(&granteeID, &granteeEmail)
+    if err == sql.ErrNoRows {
+        http.Error(w, "No user with this email", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        log.Println("Error retrieving user:", err)
+        http.Error(w, "Error sharing file", http.StatusInternalServerError)
+        return
+    }
+    if granteeID == userID {
+        http.Error(w, "You cannot share a file with yourself", http.StatusBadRequest)
+        return
+    }
+
+    var inserted bool
+    err = db.DB.QueryRow(`INSERT INTO file_grants (file_id, user_id, permission, granted_by) VALUES ($1, $2, $3, $4)
+        ON CONFLICT (file_id, user_id) DO UPDATE SET permission = EXCLUDED.permission, granted_by = EXCLUDED.granted_by
+        RETURNING (xmax = 0)`, fileID, granteeID, req.Permission, userID).Scan(&inserted)
+    if err != nil {
+        log.Println("Error granting file access:", err)
+        http.Error(w, "Error sharing file", http.StatusInternalServerError)
+        return
+    }
+
+    if inserted {
+        err = mail.Default.Send(mail.Message{
+            To:      granteeEmail,
+            Subject: "A file was shared with you",
+            Body:    fmt.Sprintf("%s was shared with you with %s access. It is listed under GET /shared-with-me.", file.FileName, req.Permission),
+        })
+        if err != nil {
+            log.Println("Error sending share notification:", err)
+        }
+        w.WriteHeader(http.StatusCreated)
+    }
+    w.Write([]byte("File shared successfully"))
+}
+
+// ListFileGrants lists the users a file is shared with
+func ListFileGrants(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    fileID, err := strconv.Atoi(mux.Vars(r)["file_id"])
+    if err != nil {
+        http.Error(w, "Invalid file ID", http.StatusBadRequest)
+        return
+    }
+
+    if _, ok := authorizeFile(w, r, userID, fileID, AccessManage); !ok {
+        return
+    }
+
+    rows, err := db.DB.Query(`SELECT users.id, users.email, file_grants.permission, file_grants.created_at
+        FROM file_grants JOIN users ON users.id = file_grants.user_id
+        WHERE file_grants.file_id = $1 ORDER BY file_grants.created_at`, fileID)
+    if err != nil {
+        log.Println("Error retrieving file grants:", err)
+        http.Error(w, "Error retrieving file grants", http.StatusInternalServerError)
+        return
+    }
+    defer rows.Close()
+
+    grants := []FileGrant{}
+    for rows.Next() {
+        var grant FileGrant
+        if err := rows.Scan(&grant.UserID, &grant.Email, &grant.Permission, &grant.CreatedAt); err != nil {
+            log.Println("Error scanning file grants:", err)
+            http.Error(w, "Error retrieving file grants", http.StatusInternalServerError)
+            return
+        }
+        grants = append(grants, grant)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(grants)
+}
+
+// RevokeFileAccess removes a user's grant on a file. Users who manage the
+// file can revoke anyone, and grantees can remove their own access.
+func RevokeFileAccess(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    vars := mux.Vars(r)
+    fileID, err := strconv.Atoi(vars["file_id"])
+    if err != nil {
+        http.Error(w, "Invalid file ID", http.StatusBadRequest)
+        return
+    }
+    granteeID, err := strconv.Atoi(vars["user_id"])
+    if err != nil {
+        http.Error(w, "Invalid user ID", http.StatusBadRequest)
+        return
+    }
+
+    if granteeID != userID {
+        if _, ok := authorizeFile(w, r, userID, fileID, AccessManage); !ok {
+            return
+        }
+    }
+
+    result, err := db.DB.Exec("DELETE FROM file_grants WHERE file_id = $1 AND user_id = $2", fileID, granteeID)
+    if err != nil {
+        log.Println("Error revoking file access:", err)
+        http.Error(w, "Error revoking file access", http.StatusInternalServerError)
+        return
+    }
+    if n, _ := result.RowsAffected(); n == 0 {
+        http.Error(w, "Grant not found", http.StatusNotFound)
+        return
+    }
+
+    w.Write([]byte("File access revoked successfully"))
+}
+
+// ListSharedWithMe lists the files other users have shared directly with the caller
+func ListSharedWithMe(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    rows, err := db.DB.Query(`SELECT files.id, files.file_name, files.file_size, files.upload_date, file_grants.permission,
+            COALESCE(granter.email, ''), file_grants.created_at
+        FROM file_grants
+        JOIN files ON files.id = file_grants.file_id
+        LEFT JOIN users granter ON granter.id = file_grants.granted_by
+        WHERE file_grants.user_id = $1 ORDER BY file_grants.created_at DESC`, userID)
+    if err != nil {
+        log.Println("Error retrieving shared files:", err)
+        http.Error(w, "Error retrieving shared files", http.StatusInternalServerError)
+        return
+    }
+    defer rows.Close()
+
+    files := []SharedFile{}
+    for rows.Next() {
+        var file SharedFile
+        if err := rows.Scan(&file.ID, &file.FileName, &file.FileSize, &file.UploadDate, &file.Permission, &file.SharedBy, &file.SharedAt); err != nil {
+            log.Println("Error scanning shared files:", err)
+            http.Error(w, "Error retrieving shared files", http.StatusInternalServerError)
+            return
+        }
+        files = append(files, file)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(files)
+}
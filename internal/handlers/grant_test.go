@@ -0,0 +1,232 @@
+package handlers
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "trademarkia/internal/cache"
+    "trademarkia/internal/models"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/gorilla/mux"
+)
+
+func TestFileAccessRanking(t *testing.T) {
+    tests := []struct {
+        name        string
+        workspaceID interface{}
+        role        interface{}
+        grant       interface{}
+        want        string
+    }{
+        {"view grant on a personal file", nil, nil, AccessView, AccessView},
+        {"edit grant on a personal file", nil, nil, AccessEdit, AccessEdit},
+        {"edit grant raises a workspace viewer", 4, models.WorkspaceViewer, AccessEdit, AccessEdit},
+        {"view grant does not lower a workspace editor", 4, models.WorkspaceEditor, AccessView, AccessManage},
+        {"no membership and no grant", nil, nil, nil, ""},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            mock := mockDB(t)
+            expectAccess(mock, 9, 1, test.workspaceID, test.role, test.grant)
+
+            _, access, err := fileAccess(context.Background(), 2, 9)
+            if test.want == "" {
+                if err != errFileNotFound {
+                    t.Errorf("err = %v, want errFileNotFound", err)
+                }
+                return
+            }
+            if err != nil || access != test.want {
+                t.Errorf("access = %q, %v, want %q", access, err, test.want)
+            }
+        })
+    }
+}
+
+func TestUploaderManagesPersonalFile(t *testing.T) {
+    mock := mockDB(t)
+    // No membership or grant lookup is needed
+    expectFile(mock, 9, 1, nil)
+
+    if _, access, err := fileAccess(context.Background(), 1, 9); err != nil || access != AccessManage {
+        t.Errorf("access = %q, %v, want manage", access, err)
+    }
+}
+
+func TestFileAccessCachesTheRecordButNotTheGrant(t *testing.T) {
+    cache.Default = cache.NewLRU(100)
+    defer func() { cache.Default = cache.Nop{} }()
+
+    mock := mockDB(t)
+    expectAccess(mock, 9, 1, nil, nil, AccessEdit)
+    // The second check reads the record from the cache and only the grant
+    // from the database, where it has been revoked
+    mock.ExpectQuery("SELECT role FROM workspace_members WHERE workspace_id = \\$2").
+        WillReturnRows(sqlmock.NewRows([]string{"role", "permission"}).AddRow(nil, nil))
+
+    if _, access, err := fileAccess(context.Background(), 2, 9); err != nil || access != AccessEdit {
+        t.Fatalf("access = %q, %v, want edit", access, err)
+    }
+    if _, _, err := fileAccess(context.Background(), 2, 9); err != errFileNotFound {
+        t.Errorf("err = %v after the grant was revoked, want errFileNotFound", err)
+    }
+}
+
+func TestAuthorizeFileComparesLevels(t *testing.T) {
+    tests := []struct {
+        level string
+        want  int
+    }{
+        {AccessView, http.StatusOK},
+        {AccessEdit, http.StatusOK},
+        {AccessManage, http.StatusForbidden},
+    }
+
+    for _, test := range tests {
+        mock := mockDB(t)
+        expectAccess(mock, 9, 1, nil, nil, AccessEdit)
+
+        w := httptest.NewRecorder()
+        if _, ok := authorizeFile(w, httptest.NewRequest("GET", "/files/9", nil), 2, 9, test.level); ok {
+            w.WriteHeader(http.StatusOK)
+        }
+        if w.Code != test.want {
+            t.Errorf("edit grant requiring %s = %d, want %d", test.level, w.Code, test.want)
+        }
+    }
+}
+
+func grantRequest(userID int, body string) *http.Request {
+    r := httptest.NewRequest("POST", "/files/9/grants", strings.NewReader(body))
+    return asUser(mux.SetURLVars(r, map[string]string{"file_id": "9"}), userID, "user")
+}
+
+func TestGrantFileAccess(t *testing.T) {
+    tests := []struct {
+        name     string
+        body     string
+        grantee  int
+        inserted bool
+        want     int
+        mails    int
+    }{
+        {"new grant", `{"email": "friend@example.com", "permission": "view"}`, 2, true, http.StatusCreated, 1},
+        {"changed permission", `{"email": "friend@example.com", "permission": "edit"}`, 2, false, http.StatusOK, 0},
+        {"yourself", `{"email": "me@example.com", "permission": "view"}`, 1, false, http.StatusBadRequest, 0},
+        {"invalid permission", `{"email": "friend@example.com", "permission": "manage"}`, 0, false, http.StatusBadRequest, 0},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            box := mockMail(t)
+            mock := mockDB(t)
+            expectFile(mock, 9, 1, nil)
+            if test.grantee != 0 {
+                mock.ExpectQuery("SELECT id, email FROM users WHERE lower\\(email\\)").
+                    WillReturnRows(sqlmock.NewRows([]string{"id", "email"}).AddRow(test.grantee, "friend@example.com"))
+            }
+            if test.grantee == 2 {
+                mock.ExpectQuery("INSERT INTO file_grants").WithArgs(9, 2, sqlmock.AnyArg(), 1).
+                    WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(test.inserted))
+            }
+
+            w := httptest.NewRecorder()
+            GrantFileAccess(w, grantRequest(1, test.body))
+            if w.Code != test.want {
+                t.Errorf("status = %d, want %d: %s", w.Code, test.want, w.Body)
+            }
+            if len(box.sent) != test.mails {
+                t.Errorf("sent %d notifications, want %d", len(box.sent), test.mails)
+            }
+        })
+    }
+}
+
+func TestEditorsCannotShareFurther(t *testing.T) {
+    mock := mockDB(t)
+    expectAccess(mock, 9, 1, nil, nil, AccessEdit)
+
+    w := httptest.NewRecorder()
+    GrantFileAccess(w, grantRequest(2, `{"email": "other@example.com", "permission": "view"}`))
+    if w.Code != http.StatusForbidden {
+        t.Errorf("status = %d, want 403: %s", w.Code, w.Body)
+    }
+}
+
+func revokeRequest(granteeID string) *http.Request {
+    r := httptest.NewRequest("DELETE", "/files/9/grants/"+granteeID, nil)
+    return mux.SetURLVars(r, map[string]string{"file_id": "9", "user_id": granteeID})
+}
+
+func TestRevokeFileAccess(t *testing.T) {
+    t.Run("grantee removes their own access", func(t *testing.T) {
+        mock := mockDB(t)
+        mock.ExpectExec("DELETE FROM file_grants").WithArgs(9, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+
+        w := httptest.NewRecorder()
+        RevokeFileAccess(w, asUser(revokeRequest("2"), 2, "user"))
+        if w.Code != http.StatusOK {
+            t.Errorf("status = %d, want 200: %s", w.Code, w.Body)
+        }
+    })
+
+    t.Run("manager revokes a missing grant", func(t *testing.T) {
+        mock := mockDB(t)
+        expectFile(mock, 9, 1, nil)
+        mock.ExpectExec("DELETE FROM file_grants").WithArgs(9, 3).WillReturnResult(sqlmock.NewResult(0, 0))
+
+        w := httptest.NewRecorder()
+        RevokeFileAccess(w, asUser(revokeRequest("3"), 1, "user"))
+        if w.Code != http.StatusNotFound {
+            t.Errorf("status = %d, want 404: %s", w.Code, w.Body)
+        }
+    })
+
+    t.Run("grantee cannot revoke others", func(t *testing.T) {
+        mock := mockDB(t)
+        expectAccess(mock, 9, 1, nil, nil, AccessView)
+
+        w := httptest.NewRecorder()
+        RevokeFileAccess(w, asUser(revokeRequest("3"), 2, "user"))
+        if w.Code != http.StatusForbidden {
+            t.Errorf("status = %d, want 403: %s", w.Code, w.Body)
+        }
+    })
+}
+
+func renameRequest(userID int, name string) *http.Request {
+    r := httptest.NewRequest("PUT", "/files/9", strings.NewReader("new_file_name="+name))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    return asUser(mux.SetURLVars(r, map[string]string{"file_id": "9"}), userID, "user")
+}
+
+func TestEditorsRenameWithoutTakingOtherKeys(t *testing.T) {
+    tests := []struct {
+        name    string
+        renamed int64
+        want    int
+    }{
+        {"free name", 1, http.StatusOK},
+        {"another file's key", 0, http.StatusConflict},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            mockRedis(t)
+            mock := mockDB(t)
+            expectAccess(mock, 9, 1, nil, nil, AccessEdit)
+            mock.ExpectExec("UPDATE files SET file_name = \\$1 WHERE id = \\$2\\s+AND NOT EXISTS").WithArgs("q3-report.pdf", 9).
+                WillReturnResult(sqlmock.NewResult(0, test.renamed))
+
+            w := httptest.NewRecorder()
+            UpdateFileMetadata(w, renameRequest(2, "q3-report.pdf"))
+            if w.Code != test.want {
+                t.Errorf("status = %d, want %d: %s", w.Code, test.want, w.Body)
+            }
+        })
+    }
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+    "database/sql"
+    "encoding/json"
+    "log"
+    "net/http"
+    "strconv"
+    "trademarkia/internal/background"
+
+    "github.com/gorilla/mux"
+)
+
+// AdminListJobs lists the most recently updated background jobs, filtered
+// with ?status= and ?type=, up to ?limit= (default 100, at most 1000)
+func AdminListJobs(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+
+    limit := 100
+    if value := query.Get("limit"); value != "" {
+        parsed, err := strconv.Atoi(value)
+        if err != nil || parsed <= 0 || parsed > 1000 {
+            http.Error(w, "Limit must be between 1 and 1000", http.StatusBadRequest)
+            return
+        }
+        limit = parsed
+    }
+
+    jobs, err := background.ListJobs(query.Get("status"), query.Get("type"), limit)
+    if err != nil {
+        log.Println("Error retrieving jobs:", err)
+        http.Error(w, "Error retrieving jobs", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(jobs)
+}
+
+// AdminGetJob returns one background job with its attempts and last error
+func AdminGetJob(w http.ResponseWriter, r *http.Request) {
+    jobID, err := strconv.ParseInt(mux.Vars(r)["job_id"], 10, 64)
+    if err != nil {
+        http.Error(w, "Invalid job ID", http.StatusBadRequest)
+        return
+    }
+
+    job, err := background.GetJob(jobID)
+    if err == sql.ErrNoRows {
+        http.Error(w, "Job not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        log.Println("Error retrieving job:", err)
+        http.Error(w, "Error retrieving job", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(job)
+}
+
+// AdminRetryJob requeues a dead job with a fresh set of attempts
+func AdminRetryJob(w http.ResponseWriter, r *http.Request) {
+    jobID, err := strconv.ParseInt(mux.Vars(r)["job_id"], 10, 64)
+    if err != nil {
+        http.Error(w, "Invalid job ID", http.StatusBadRequest)
+        return
+    }
+
+    retried, err := background.RetryJob(jobID)
+    if err != nil {
+        log.Println("Error retrying job:", err)
+        http.Error(w, "Error retrying job", http.StatusInternalServerError)
+        return
+    }
+    if !retried {
+        http.Error(w, "Only dead jobs can be retried", http.StatusConflict)
+        return
+    }
+
+    log.Printf("Admin %d retried job %d", r.Context().Value("userID").(int), jobID)
+    w.Write([]byte("Job queued for retry"))
+}
+
+// AdminListSchedules lists the recurring jobs with their cron expression,
+// next run and the outcome of their last run
+func AdminListSchedules(w http.ResponseWriter, r *http.Request) {
+    schedules, err := background.ListSchedules()
+    if err != nil {
+        log.Println("Error retrieving schedules:", err)
+        http.Error(w, "Error retrieving schedules", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(schedules)
+}
+
+// AdminListScheduledRuns returns the 50 most recent runs of a schedule
+func AdminListScheduledRuns(w http.ResponseWriter, r *http.Request) {
+    runs, err := background.ListScheduledRuns(mux.Vars(r)["name"], 50)
+    if err == background.ErrUnknownSchedule {
+        http.Error(w, "Schedule not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        log.Println("Error retrieving scheduled runs:", err)
+        http.Error(w, "Error retrieving scheduled runs", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(runs)
+}
+
+// AdminRunSchedule queues a run of a scheduled job right away
+func AdminRunSchedule(w http.ResponseWriter, r *http.Request) {
+    name := mux.Vars(r)["name"]
+
+    jobID, err := background.RunScheduleNow(name)
+    if err == background.ErrUnknownSchedule {
+        http.Error(w, "Schedule not found", http.StatusNotFound)
+        return
+    }
+    if err == background.ErrRunPending {
+        http.Error(w, "A run of this schedule is already queued or running", http.StatusConflict)
+        return
+    }
+    if err != nil {
+        log.Println("Error queueing scheduled job:", err)
+        http.Error(w, "Error queueing scheduled job", http.StatusInternalServerError)
+        return
+    }
+
+    log.Printf("Admin %d triggered schedule %s as job %d", r.Context().Value("userID").(int), name, jobID)
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(map[string]int64{"job_id": jobID})
+}
+
+// AdminReconcileStorage queues a comparison of the bucket with the files
+// table. It only reports drift unless called with ?dry_run=false, in which
+// case orphaned objects and dangling rows are deleted.
+func AdminReconcileStorage(w http.ResponseWriter, r *http.Request) {
+    dryRun := true
+    if value := r.URL.Query().Get("dry_run"); value != "" {
+        parsed, err := strconv.ParseBool(value)
+        if err != nil {
+            http.Error(w, "dry_run must be true or false", http.StatusBadRequest)
+            return
+        }
+        dryRun = parsed
+    }
+
+    jobID, err := background.QueueReconciliation(dryRun)
+    if err == background.ErrRunPending {
+        http.Error(w, "A reconciliation is already queued or running", http.StatusConflict)
+        return
+    }
+    if err != nil {
+        log.Println("Error queueing reconciliation:", err)
+        http.Error(w, "Error queueing reconciliation", http.StatusInternalServerError)
+        return
+    }
+
+    log.Printf("Admin %d queued reconciliation job %d (dry run: %v)", r.Context().Value("userID").(int), jobID, dryRun)
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(map[string]int64{"job_id": jobID})
+}
+
+// AdminListReconcileReports returns the counts of the 50 most recent
+// reconciliations
+func AdminListReconcileReports(w http.ResponseWriter, r *http.Request) {
+    reports, err := background.ListReconcileReports(50)
+    if err != nil {
+        log.Println("Error retrieving reconciliation reports:", err)
+        http.Error(w, "Error retrieving reconciliation reports", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(reports)
+}
+
+// AdminGetReconcileReport returns one reconciliation with the orphaned keys
+// and dangling rows it found
+func AdminGetReconcileReport(w http.ResponseWriter, r *http.Request) {
+    reportID, err := strconv.ParseInt(mux.Vars(r)["report_id"], 10, 64)
+    if err != nil {
+        http.Error(w, "Invalid report ID", http.StatusBadRequest)
+        return
+    }
+
+    report, err := background.GetReconcileReport(reportID)
+    if err == sql.ErrNoRows {
+        http.Error(w, "Report not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        log.Println("Error retrieving reconciliation report:", err)
+        http.Error(w, "Error retrieving reconciliation report", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "trademarkia/config"
+    "trademarkia/internal/db"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+// Failed login tracking. Failures are counted per account and per client IP
+// in Redis so the limits hold across instances. After a few failures every
+// further attempt has to wait an exponentially growing delay, and once the
+// account limit is reached the account is locked for the lockout period.
+const (
+    loginFreeAttempts  = 3
+    loginMaxDelay      = 60 * time.Second
+    loginFailureWindow = time.Hour
+)
+
+var (
+    loginMaxAttempts   = envInt("LOGIN_MAX_ATTEMPTS", 10)
+    loginMaxIPAttempts = envInt("LOGIN_MAX_IP_ATTEMPTS", 100)
+    loginLockout       = time.Duration(envInt("LOGIN_LOCKOUT_MINUTES", 15)) * time.Minute
+
+    dummyPasswordHash     []byte
+    dummyPasswordHashOnce sync.Once
+)
+
+func envInt(key string, defaultValue int) int {
+    value, err := strconv.Atoi(config.GetEnv(key, strconv.Itoa(defaultValue)))
+    if err != nil {
+        log.Printf("Invalid value for %s, using %d", key, defaultValue)
+        return defaultValue
+    }
+    return value
+}
+
+// compareWithDummyHash burns the same bcrypt time as a real password check,
+// so unknown emails cannot be told apart by response time
+func compareWithDummyHash(password string) {
+    dummyPasswordHashOnce.Do(func() {
+        dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+    })
+    bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+}
+
+func accountKey(kind, email string) string {
+    return fmt.Sprintf("login_%s:acct:%s", kind, strings.ToLower(strings.TrimSpace(email)))
+}
+
+func ipKey(kind, ip string) string {
+    return fmt.Sprintf("login_%s:ip:%s", kind, ip)
+}
+
+// checkLoginAllowed returns how long the caller has to wait before another
+// attempt for this account or IP is allowed, or zero if it may proceed.
+// Redis errors fail open so an outage does not lock everyone out.
+func checkLoginAllowed(ctx context.Context, email, ip string) time.Duration {
+    var wait time.Duration
+    for _, key := range []string{accountKey("lock", email), accountKey("delay", email), ipKey("lock", ip)} {
+        ttl, err := db.Redis.PTTL(ctx, key).Result()
+        if err != nil {
+            log.Printf("Error checking login throttle for %s: %v", key, err)
+            continue
+        }
+        if ttl > wait {
+            wait = ttl
+        }
+    }
+    return wait
+}
+
+// recordLoginFailure counts a failed attempt and applies delays and
+// lockouts. The account and IP counters are independent, so a failure to
+// count one does not skip the other.
+func recordLoginFailure(ctx context.Context, email, ip string) {
+    failures, err := incrementWithWindow(ctx, accountKey("fail", email))
+    if err != nil {
+        log.Println("Error recording failed login:", err)
+    } else if failures >= int64(loginMaxAttempts) {
+        if err := db.Redis.Set(ctx, accountKey("lock", email), 1, loginLockout).Err(); err != nil {
+            log.Println("Error locking account:", err)
+        }
+        log.Printf("Account %s locked after %d failed login attempts", email, failures)
+    } else if failures > loginFreeAttempts {
+        delay := time.Duration(math.Pow(2, float64(failures-loginFreeAttempts))) * time.Second
+        if delay > loginMaxDelay {
+            delay = loginMaxDelay
+        }
+        if err := db.Redis.Set(ctx, accountKey("delay", email), 1, delay).Err(); err != nil {
+            log.Println("Error setting login delay:", err)
+        }
+    }
+
+    ipFailures, err := incrementWithWindow(ctx, ipKey("fail", ip))
+    if err != nil {
+        log.Println("Error recording failed login:", err)
+        return
+    }
+    if ipFailures >= int64(loginMaxIPAttempts) {
+        if err := db.Redis.Set(ctx, ipKey("lock", ip), 1, loginLockout).Err(); err != nil {
+            log.Println("Error locking IP:", err)
+        }
+        log.Printf("IP %s locked after %d failed login attempts", ip, ipFailures)
+    }
+}
+
+func incrementWithWindow(ctx context.Context, key string) (int64, error) {
+    count, err := db.Redis.Incr(ctx, key).Result()
+    if err != nil {
+        return 0, err
+    }
+    if count == 1 {
+        db.Redis.Expire(ctx, key, loginFailureWindow)
+    }
+    return count, nil
+}
+
+// clearLoginFailures resets the account's counters after a successful login
+func clearLoginFailures(ctx context.Context, email string) {
+    err := db.Redis.Del(ctx, accountKey("fail", email), accountKey("delay", email), accountKey("lock", email)).Err()
+    if err != nil {
+        log.Println("Error clearing failed logins:", err)
+    }
+}
+
+// rejectThrottledLogin writes a 429 with Retry-After
+func rejectThrottledLogin(w http.ResponseWriter, wait time.Duration) {
+    w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+    http.Error(w, "Too many failed login attempts, please try again later", http.StatusTooManyRequests)
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLoginFailuresAddDelaysThenLockTheAccount(t *testing.T) {
+    server := mockRedis(t)
+
+    for i := 0; i < loginFreeAttempts; i++ {
+        recordLoginFailure(context.Background(), "user@example.com", "10.0.0.1")
+    }
+    if wait := checkLoginAllowed(context.Background(), "user@example.com", "10.0.0.1"); wait != 0 {
+        t.Fatalf("waiting %v within the free attempts", wait)
+    }
+
+    recordLoginFailure(context.Background(), "user@example.com", "10.0.0.1")
+    if wait := checkLoginAllowed(context.Background(), "user@example.com", "10.0.0.1"); wait <= 0 || wait > 2*time.Second {
+        t.Errorf("wait after %d failures = %v, want up to 2s", loginFreeAttempts+1, wait)
+    }
+
+    for i := loginFreeAttempts + 1; i < loginMaxAttempts; i++ {
+        recordLoginFailure(context.Background(), "user@example.com", "10.0.0.1")
+    }
+    if !server.Exists(accountKey("lock", "user@example.com")) {
+        t.Fatal("account not locked after the maximum number of failures")
+    }
+    if wait := checkLoginAllowed(context.Background(), "USER@example.com ", "10.0.0.2"); wait < loginLockout-time.Second {
+        t.Errorf("wait for a locked account = %v, want the lockout", wait)
+    }
+
+    clearLoginFailures(context.Background(), "user@example.com")
+    if wait := checkLoginAllowed(context.Background(), "user@example.com", "10.0.0.2"); wait != 0 {
+        t.Errorf("wait after clearing failures = %v", wait)
+    }
+}
+
+func TestLoginFailureCountsTheIPWhenTheAccountCounterFails(t *testing.T) {
+    server := mockRedis(t)
+    // INCR fails on a value that is not a number
+    server.Set(accountKey("fail", "user@example.com"), "not a number")
+
+    recordLoginFailure(context.Background(), "user@example.com", "10.0.0.1")
+    if count, _ := server.Get(ipKey("fail", "10.0.0.1")); count != "1" {
+        t.Errorf("IP failures = %q, want 1", count)
+    }
+}
+
+func TestLoginHidesDisabledAccounts(t *testing.T) {
+    mockRedis(t)
+    mock := mockDB(t)
+    hash, _ := HashPassword("correct horse battery")
+    mock.ExpectQuery("SELECT id, password, role, disabled, email_verified, totp_enabled FROM users").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "password", "role", "disabled", "email_verified", "totp_enabled"}).
+            AddRow(1, hash, "user", true, true, false))
+
+    r := httptest.NewRequest("POST", "/login", strings.NewReader(`{"email":"user@example.com","password":"correct horse battery"}`))
+    w := httptest.NewRecorder()
+    Login(w, r)
+    if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "Invalid credentials") {
+        t.Errorf("Login to a disabled account = %d: %s", w.Code, w.Body)
+    }
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+    "context"
+    "net/http"
+    "testing"
+    "trademarkia/internal/auth"
+    "trademarkia/internal/db"
+    "trademarkia/internal/mail"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/alicebob/miniredis/v2"
+    "github.com/go-redis/redis/v8"
+)
+
+// mockDB replaces db.DB with a sqlmock connection for the duration of a test
+// and checks that every expected statement ran
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+    t.Helper()
+    conn, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatal(err)
+    }
+    previous := db.DB
+    db.DB = conn
+    t.Cleanup(func() {
+        if err := mock.ExpectationsWereMet(); err != nil {
+            t.Error(err)
+        }
+        db.DB = previous
+        conn.Close()
+    })
+    return mock
+}
+
+// asUser returns r as if JWTMiddleware had authenticated it for userID
+func asUser(r *http.Request, userID int, role string) *http.Request {
+    ctx := context.WithValue(r.Context(), "userID", userID)
+    ctx = context.WithValue(ctx, "role", role)
+    ctx = context.WithValue(ctx, "plan", "free")
+    return r.WithContext(ctx)
+}
+
+// mockRedis points db.Redis at an in-memory Redis server for the duration of
+// a test
+func mockRedis(t *testing.T) *miniredis.Miniredis {
+    t.Helper()
+    server := miniredis.RunT(t)
+    previous := db.Redis
+    db.Redis = redis.NewClient(&redis.Options{Addr: server.Addr()})
+    t.Cleanup(func() {
+        db.Redis.Close()
+        db.Redis = previous
+    })
+    return server
+}
+
+// testKeys signs tokens with a throwaway HMAC key for the duration of a test
+func testKeys(t *testing.T) {
+    t.Helper()
+    previous := auth.Keys
+    auth.Keys = auth.NewKeySet()
+    t.Cleanup(func() { auth.Keys = previous })
+    if err := auth.Keys.AddHMAC("test", []byte("test-secret")); err != nil {
+        t.Fatal(err)
+    }
+    if err := auth.Keys.SetActive("test"); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// mailbox records the messages sent through mail.Default during a test
+type mailbox struct {
+    sent []mail.Message
+}
+
+func (m *mailbox) Send(msg mail.Message) error {
+    m.sent = append(m.sent, msg)
+    return nil
+}
+
+func mockMail(t *testing.T) *mailbox {
+    previous := mail.Default
+    box := &mailbox{}
+    mail.Default = box
+    t.Cleanup(func() { mail.Default = previous })
+    return box
+}
@@ -0,0 +1,261 @@
+package handlers
+
+import (
+    "crypto/subtle"
+    "database/sql"
+    "errors"
+    "log"
+    "net/http"
+    "time"
+    "trademarkia/internal/auth"
+    "trademarkia/internal/db"
+    "trademarkia/internal/models"
+    "trademarkia/internal/oidc"
+
+    "github.com/dgrijalva/jwt-go"
+)
+
+// PurposeOIDCState marks the signed cookie that carries the OIDC flow state
+const PurposeOIDCState = "oidc_state"
+
+const (
+    oidcStateCookie = "oidc_state"
+    oidcStateTTL    = 10 * time.Minute
+)
+
+var (
+    errOIDCNoEmail     = errors.New("identity provider did not return a verified email")
+    errAccountDisabled = errors.New("account disabled")
+)
+
+// OIDCStateClaims binds the state, nonce and PKCE verifier of a login attempt to the browser
+type OIDCStateClaims struct {
+    Purpose  string `json:"purpose"`
+    State    string `json:"state"`
+    Nonce    string `json:"nonce"`
+    Verifier string `json:"verifier"`
+    jwt.StandardClaims
+}
+
+// OIDCLogin starts single sign-on by redirecting to the identity provider
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+    if oidc.Default == nil {
+        http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+        return
+    }
+
+    state, err := oidc.RandomString()
+    if err != nil {
+        log.Println("Error generating OIDC state:", err)
+        http.Error(w, "Error starting single sign-on", http.StatusInternalServerError)
+        return
+    }
+    nonce, err := oidc.RandomString()
+    if err != nil {
+        log.Println("Error generating OIDC nonce:", err)
+        http.Error(w, "Error starting single sign-on", http.StatusInternalServerError)
+        return
+    }
+    verifier, err := oidc.RandomString()
+    if err != nil {
+        log.Println("Error generating PKCE verifier:", err)
+        http.Error(w, "Error starting single sign-on", http.StatusInternalServerError)
+        return
+    }
+
+    signedState, err := auth.Keys.Sign(&OIDCStateClaims{
+        Purpose:  PurposeOIDCState,
+        State:    state,
+        Nonce:    nonce,
+        Verifier: verifier,
+        StandardClaims: jwt.StandardClaims{
+            ExpiresAt: time.Now().Add(oidcStateTTL).Unix(),
+        },
+    })
+    if err != nil {
+        log.Println("Error signing OIDC state:", err)
+        http.Error(w, "Error starting single sign-on", http.StatusInternalServerError)
+        return
+    }
+
+    http.SetCookie(w, &http.Cookie{
+        Name:     oidcStateCookie,
+        Value:    signedState,
+        Path:     "/oidc",
+        MaxAge:   int(oidcStateTTL.Seconds()),
+        HttpOnly: true,
+        Secure:   r.TLS != nil,
+        SameSite: http.SameSiteLaxMode,
+    })
+
+    http.Redirect(w, r, oidc.Default.AuthCodeURL(state, nonce, verifier), http.StatusFound)
+}
+
+// OIDCCallback completes single sign-on: it validates the state, redeems the
+// code, verifies the ID token, links or provisions the user and issues the
+// same access token as Login
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+    if oidc.Default == nil {
+        http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+        return
+    }
+
+    if errorCode := r.URL.Query().Get("error"); errorCode != "" {
+        http.Error(w, "Single sign-on failed: "+errorCode, http.StatusUnauthorized)
+        return
+    }
+
+    cookie, err := r.Cookie(oidcStateCookie)
+    if err != nil {
+        http.Error(w, "Missing single sign-on state, please start again", http.StatusBadRequest)
+        return
+    }
+    http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/oidc", MaxAge: -1})
+
+    state := &OIDCStateClaims{}
+    if err := auth.Keys.Parse(cookie.Value, state); err != nil || state.Purpose != PurposeOIDCState {
+        http.Error(w, "Invalid single sign-on state, please start again", http.StatusBadRequest)
+        return
+    }
+    if subtle.ConstantTimeCompare([]byte(state.State), []byte(r.URL.Query().Get("state"))) != 1 {
+        http.Error(w, "Single sign-on state mismatch", http.StatusBadRequest)
+        return
+    }
+
+    rawIDToken, err := oidc.Default.Exchange(r.URL.Query().Get("code"), state.Verifier)
+    if err != nil {
+        log.Println("Error exchanging OIDC code:", err)
+        http.Error(w, "Error completing single sign-on", http.StatusUnauthorized)
+        return
+    }
+
+    idToken, err := oidc.Default.VerifyIDToken(rawIDToken, state.Nonce)
+    if err != nil {
+        log.Println("Error verifying OIDC ID token:", err)
+        http.Error(w, "Error completing single sign-on", http.StatusUnauthorized)
+        return
+    }
+
+    account, err := linkOIDCUser(oidc.Default.Issuer, idToken)
+    if err == errOIDCNoEmail {
+        http.Error(w, "The identity provider did not share a verified email address", http.StatusForbidden)
+        return
+    }
+    if err == errAccountDisabled {
+        http.Error(w, "Account disabled", http.StatusForbidden)
+        return
+    }
+    if err != nil {
+        log.Println("Error linking OIDC user:", err)
+        http.Error(w, "Error completing single sign-on", http.StatusInternalServerError)
+        return
+    }
+
+    // SSO proves the first factor only; accounts with 2FA still need a code
+    if account.TOTPEnabled {
+        sendTwoFactorChallenge(w, account.ID, account.Email)
+        return
+    }
+
+    issueAccessToken(w, r, account.ID, account.Email, account.Role)
+}
+
+// oidcAccount is the account a provider subject signs in to
+type oidcAccount struct {
+    ID          int
+    Email       string
+    Role        string
+    TOTPEnabled bool
+}
+
+// linkOIDCUser finds the account linked to the provider subject. Otherwise an
+// existing account with the same verified email is linked, or a new account is
+// provisioned without a usable password.
+func linkOIDCUser(issuer string, idToken *oidc.IDToken) (*oidcAccount, error) {
+    var account oidcAccount
+    var disabled bool
+
+    err := db.DB.QueryRow("SELECT id, email, role, disabled, totp_enabled FROM users WHERE oidc_issuer = $1 AND oidc_subject = $2",
+        issuer, idToken.Subject).Scan(&account.ID, &account.Email, &account.Role, &disabled, &account.TOTPEnabled)
+    if err == nil {
+        if disabled {
+            return nil, errAccountDisabled
+        }
+        return &account, nil
+    }
+    if err != sql.ErrNoRows {
+        return nil, err
+    }
+
+    // Only trust the email for linking when the provider has verified it
+    if idToken.Email == "" || !idToken.EmailVerified {
+        return nil, errOIDCNoEmail
+    }
+    account.Email = models.NormalizeEmail(idToken.Email)
+
+    var emailVerified bool
+    err = db.DB.QueryRow("SELECT id, role, disabled, totp_enabled, email_verified FROM users WHERE lower(email) = $1", account.Email).
+        Scan(&account.ID, &account.Role, &disabled, &account.TOTPEnabled, &emailVerified)
+    if err == nil {
+        if disabled {
+            return nil, errAccountDisabled
+        }
+        if !emailVerified {
+            return takeOverUnverifiedAccount(issuer, idToken, &account)
+        }
+        _, err = db.DB.Exec("UPDATE users SET oidc_issuer = $1, oidc_subject = $2, email_verified = TRUE WHERE id = $3",
+            issuer, idToken.Subject, account.ID)
+        if err != nil {
+            return nil, err
+        }
+        log.Printf("Linked user %d to OIDC subject %s", account.ID, idToken.Subject)
+        return &account, nil
+    }
+    if err != sql.ErrNoRows {
+        return nil, err
+    }
+
+    // The empty password never matches a bcrypt hash, so the account can
+    // only sign in through SSO until a password is set via reset
+    err = db.DB.QueryRow("INSERT INTO users (email, password, email_verified, oidc_issuer, oidc_subject) VALUES ($1, '', TRUE, $2, $3) RETURNING id, role",
+        account.Email, issuer, idToken.Subject).Scan(&account.ID, &account.Role)
+    if err != nil {
+        return nil, err
+    }
+    log.Printf("Provisioned user %d from OIDC subject %s", account.ID, idToken.Subject)
+    return &account, nil
+}
+
+// takeOverUnverifiedAccount links an account whose email was never verified.
+// Anyone could have registered it with the provider user's address, so its
+// password, 2FA, sessions and API keys are dropped before the provider user
+// gets it, and only a password reset can set a new password.
+func takeOverUnverifiedAccount(issuer string, idToken *oidc.IDToken, account *oidcAccount) (*oidcAccount, error) {
+    tx, err := db.DB.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    _, err = tx.Exec(`UPDATE users SET oidc_issuer = $1, oidc_subject = $2, email_verified = TRUE,
+        password = '', totp_enabled = FALSE, totp_secret = NULL WHERE id = $3`, issuer, idToken.Subject, account.ID)
+    if err == nil {
+        _, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", account.ID)
+    }
+    if err == nil {
+        _, err = tx.Exec("UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", account.ID)
+    }
+    if err == nil {
+        _, err = tx.Exec("UPDATE api_keys SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", account.ID)
+    }
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    account.TOTPEnabled = false
+    log.Printf("Linked unverified user %d to OIDC subject %s and reset its credentials", account.ID, idToken.Subject)
+    return account, nil
+}
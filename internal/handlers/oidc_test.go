@@ -0,0 +1,93 @@
+package handlers
+
+import (
+    "database/sql"
+    "testing"
+    "trademarkia/internal/oidc"
+
+    "github.com/DATA-DOG/go-sqlmock"
+)
+
+const testIssuer = "https://idp.example.com"
+
+func TestLinkOIDCUserReportsTwoFactorForLinkedSubject(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectQuery("SELECT id, email, role, disabled, totp_enabled FROM users WHERE oidc_issuer").
+        WithArgs(testIssuer, "user-123").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "disabled", "totp_enabled"}).
+            AddRow(7, "sso@example.com", "user", false, true))
+
+    account, err := linkOIDCUser(testIssuer, &oidc.IDToken{Subject: "user-123"})
+    if err != nil {
+        t.Fatalf("linkOIDCUser returned error: %v", err)
+    }
+    if account.ID != 7 || !account.TOTPEnabled {
+        t.Errorf("account = %+v, want user 7 with 2FA enabled", account)
+    }
+}
+
+func TestLinkOIDCUserReportsTwoFactorWhenLinkingByEmail(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectQuery("SELECT id, email, role, disabled, totp_enabled FROM users WHERE oidc_issuer").
+        WillReturnError(sql.ErrNoRows)
+    mock.ExpectQuery("SELECT id, role, disabled, totp_enabled, email_verified FROM users WHERE lower\\(email\\)").
+        WithArgs("sso@example.com").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "role", "disabled", "totp_enabled", "email_verified"}).AddRow(7, "user", false, true, true))
+    mock.ExpectExec("UPDATE users SET oidc_issuer").
+        WithArgs(testIssuer, "user-123", 7).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+
+    account, err := linkOIDCUser(testIssuer, &oidc.IDToken{Subject: "user-123", Email: "sso@example.com", EmailVerified: true})
+    if err != nil {
+        t.Fatalf("linkOIDCUser returned error: %v", err)
+    }
+    if account.ID != 7 || account.Email != "sso@example.com" || !account.TOTPEnabled {
+        t.Errorf("account = %+v, want user 7 with 2FA enabled", account)
+    }
+}
+
+func TestLinkOIDCUserRejectsDisabledAccounts(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectQuery("SELECT id, email, role, disabled, totp_enabled FROM users WHERE oidc_issuer").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "disabled", "totp_enabled"}).
+            AddRow(7, "sso@example.com", "user", true, false))
+
+    if _, err := linkOIDCUser(testIssuer, &oidc.IDToken{Subject: "user-123"}); err != errAccountDisabled {
+        t.Errorf("err = %v, want errAccountDisabled", err)
+    }
+}
+
+func TestLinkOIDCUserNeedsAVerifiedEmail(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectQuery("SELECT id, email, role, disabled, totp_enabled FROM users WHERE oidc_issuer").
+        WillReturnError(sql.ErrNoRows)
+
+    if _, err := linkOIDCUser(testIssuer, &oidc.IDToken{Subject: "user-123", Email: "sso@example.com"}); err != errOIDCNoEmail {
+        t.Errorf("err = %v, want errOIDCNoEmail", err)
+    }
+}
+
+func TestLinkOIDCUserResetsUnverifiedAccounts(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectQuery("SELECT id, email, role, disabled, totp_enabled FROM users WHERE oidc_issuer").
+        WillReturnError(sql.ErrNoRows)
+    // Someone registered the address before its owner signed in through SSO
+    mock.ExpectQuery("SELECT id, role, disabled, totp_enabled, email_verified FROM users WHERE lower\\(email\\)").
+        WithArgs("sso@example.com").
+        WillReturnRows(sqlmock.NewRows([]string{"id", "role", "disabled", "totp_enabled", "email_verified"}).AddRow(7, "user", false, true, false))
+    mock.ExpectBegin()
+    mock.ExpectExec("UPDATE users SET oidc_issuer = \\$1, oidc_subject = \\$2, email_verified = TRUE,\\s+password = ''").
+        WithArgs(testIssuer, "user-123", 7).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("DELETE FROM recovery_codes").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 10))
+    mock.ExpectExec("UPDATE sessions SET revoked_at").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("UPDATE api_keys SET revoked_at").WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    account, err := linkOIDCUser(testIssuer, &oidc.IDToken{Subject: "user-123", Email: "sso@example.com", EmailVerified: true})
+    if err != nil {
+        t.Fatalf("linkOIDCUser returned error: %v", err)
+    }
+    if account.ID != 7 || account.TOTPEnabled {
+        t.Errorf("account = %+v, want user 7 without the previous 2FA", account)
+    }
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+    "database/sql"
+    "encoding/json"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+    "trademarkia/internal/background"
+    "trademarkia/internal/db"
+    "trademarkia/internal/models"
+
+    "github.com/gorilla/mux"
+)
+
+// DataExport is the status of a personal data export
+type DataExport struct {
+    ID          int        `json:"export_id"`
+    Status      string     `json:"status"`
+    Error       string     `json:"error,omitempty"`
+    DownloadURL string     `json:"download_url,omitempty"`
+    CreatedAt   time.Time  `json:"created_at"`
+    CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// AccountDeletionRequest confirms the deletion of the account with the password
+type AccountDeletionRequest struct {
+    Password string `json:"password"`
+}
+
+// RequestDataExport starts building a ZIP archive with all of the user's data
+func RequestDataExport(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    var running bool
+    err := db.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM data_exports WHERE user_id = $1 AND status IN ($2, $3))",
+        userID, background.ExportPending, background.ExportRunning).Scan(&running)
+    if err != nil {
+        log.Println("Error checking exports:", err)
+        http.Error(w, "Error requesting export", http.StatusInternalServerError)
+        return
+    }
+    if running {
+        http.Error(w, "An export is already in progress", http.StatusConflict)
+        return
+    }
+
+    // The export and its job are created together so neither is left behind
+    tx, err := db.DB.Begin()
+    if err != nil {
+        log.Println("Error starting transaction:", err)
+        http.Error(w, "Error requesting export", http.StatusInternalServerError)
+        return
+    }
+    defer tx.Rollback()
+
+    export := DataExport{Status: background.ExportPending}
+    err = tx.QueryRow("INSERT INTO data_exports (user_id, status) VALUES ($1, $2) RETURNING id, created_at",
+        userID, background.ExportPending).Scan(&export.ID, &export.CreatedAt)
+    if err == nil {
+        _, err = background.EnqueueTx(tx, background.JobDataExport, background.DataExportPayload{ExportID: export.ID})
+    }
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err != nil {
+        log.Println("Error creating export:", err)
+        http.Error(w, "Error requesting export", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(export)
+}
+
+// GetDataExport returns the status of an export, with a download link once it is ready
+func GetDataExport(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    exportID, err := strconv.Atoi(mux.Vars(r)["export_id"])
+    if err != nil {
+        http.Error(w, "Invalid export ID", http.StatusBadRequest)
+        return
+    }
+
+    var export DataExport
+    var s3Key, exportError sql.NullString
+    var completedAt sql.NullTime
+    err = db.DB.QueryRow("SELECT id, status, s3_key, error, created_at, completed_at FROM data_exports WHERE id = $1 AND user_id = $2",
+        exportID, userID).Scan(&export.ID, &export.Status, &s3Key, &exportError, &export.CreatedAt, &completedAt)
+    if err == sql.ErrNoRows {
+        http.Error(w, "Export not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        log.Println("Error retrieving export:", err)
+        http.Error(w, "Error retrieving export", http.StatusInternalServerError)
+        return
+    }
+
+    if completedAt.Valid {
+        export.CompletedAt = &completedAt.Time
+    }
+    if export.Status == background.ExportFailed {
+        export.Error = "The export could not be built, please request a new one"
+    }
+    if export.Status == background.ExportCompleted && s3Key.Valid && time.Since(completedAt.Time) < background.ExportRetention {
+        export.DownloadURL, err = GeneratePreSignedURL(s3Key.String, 1*time.Hour)
+        if err != nil {
+            log.Println("Error generating pre-signed URL:", err)
+            http.Error(w, "Error generating download link", http.StatusInternalServerError)
+            return
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(export)
+}
+
+// DeleteAccount disables the account right away and schedules the removal of
+// all of the user's objects from storage and rows from the database
+func DeleteAccount(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    var req AccountDeletionRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid input", http.StatusBadRequest)
+        return
+    }
+
+    var storedPassword string
+    if err := db.DB.QueryRow("SELECT password FROM users WHERE id = $1", userID).Scan(&storedPassword); err != nil {
+        log.Println("Error retrieving user:", err)
+        http.Error(w, "Error deleting account", http.StatusInternalServerError)
+        return
+    }
+    if storedPassword == "" {
+        http.Error(w, noPasswordMessage, http.StatusForbidden)
+        return
+    }
+    if !CheckPasswordHash(req.Password, storedPassword) {
+        http.Error(w, "Password is incorrect", http.StatusUnauthorized)
+        return
+    }
+
+    // Shared workspaces must not be left without an owner
+    var soleOwner bool
+    err := db.DB.QueryRow(`SELECT EXISTS (
+        SELECT 1 FROM workspace_members owner
+        WHERE owner.user_id = $1 AND owner.role = $2
+        AND NOT EXISTS (SELECT 1 FROM workspace_members other WHERE other.workspace_id = owner.workspace_id AND other.user_id <> $1 AND other.role = $2)
+        AND EXISTS (SELECT 1 FROM workspace_members other WHERE other.workspace_id = owner.workspace_id AND other.user_id <> $1))`,
+        userID, models.WorkspaceOwner).Scan(&soleOwner)
+    if err != nil {
+        log.Println("Error checking workspace ownership:", err)
+        http.Error(w, "Error deleting account", http.StatusInternalServerError)
+        return
+    }
+    if soleOwner {
+        http.Error(w, "Transfer ownership of your shared workspaces before deleting your account", http.StatusConflict)
+        return
+    }
+
+    tx, err := db.DB.Begin()
+    if err != nil {
+        log.Println("Error starting transaction:", err)
+        http.Error(w, "Error deleting account", http.StatusInternalServerError)
+        return
+    }
+    defer tx.Rollback()
+
+    _, err = tx.Exec("UPDATE users SET disabled = TRUE, deletion_requested_at = NOW(), updated_at = NOW() WHERE id = $1", userID)
+    if err == nil {
+        _, err = background.EnqueueTx(tx, background.JobAccountDeletion, background.AccountDeletionPayload{UserID: userID})
+    }
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err != nil {
+        log.Println("Error scheduling account deletion:", err)
+        http.Error(w, "Error deleting account", http.StatusInternalServerError)
+        return
+    }
+
+    if err := revokeUserSessions(userID, ""); err != nil {
+        log.Println("Error revoking sessions:", err)
+    }
+    if _, err := db.DB.Exec("UPDATE api_keys SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userID); err != nil {
+        log.Println("Error revoking API keys:", err)
+    }
+
+    w.WriteHeader(http.StatusAccepted)
+    w.Write([]byte("Your account has been scheduled for deletion"))
+}
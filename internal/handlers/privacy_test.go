@@ -0,0 +1,40 @@
+package handlers
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestDeleteAccountChecksThePassword(t *testing.T) {
+    hash, _ := HashPassword("password 1")
+    tests := []struct {
+        name   string
+        stored string
+        body   string
+        want   int
+    }{
+        {"wrong password", hash, `{"password": "guess 1"}`, http.StatusUnauthorized},
+        {"SSO account without a password", "", `{"password": ""}`, http.StatusForbidden},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            mock := mockDB(t)
+            mock.ExpectQuery("SELECT password FROM users WHERE id").WithArgs(1).
+                WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(test.stored))
+
+            w := httptest.NewRecorder()
+            DeleteAccount(w, asUser(httptest.NewRequest("DELETE", "/me", strings.NewReader(test.body)), 1, "user"))
+            if w.Code != test.want {
+                t.Errorf("status = %d, want %d: %s", w.Code, test.want, w.Body)
+            }
+            if test.stored == "" && !strings.Contains(w.Body.String(), "password reset") {
+                t.Errorf("SSO account was not told how to set a password: %s", w.Body)
+            }
+        })
+    }
+}
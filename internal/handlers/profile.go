@@ -0,0 +1,259 @@
+package handlers
+
+import (
+    "database/sql"
+    "encoding/json"
+    "log"
+    "net/http"
+    "trademarkia/internal/db"
+    "trademarkia/internal/mail"
+    "trademarkia/internal/models"
+)
+
+// ProfileUpdateRequest holds the profile fields a user can change with PATCH /me
+type ProfileUpdateRequest struct {
+    Username *string `json:"username"`
+}
+
+// PasswordChangeRequest is the payload for changing the password
+type PasswordChangeRequest struct {
+    CurrentPassword string `json:"current_password"`
+    NewPassword     string `json:"new_password"`
+}
+
+// EmailChangeRequest is the payload for changing the email address
+type EmailChangeRequest struct {
+    NewEmail string `json:"new_email"`
+    Password string `json:"password"`
+}
+
+// noPasswordMessage is returned to accounts provisioned through SSO, which have
+// no password to re-authenticate with until one is set via reset
+const noPasswordMessage = "This account has no password yet, set one through the password reset flow first"
+
+// loadUser reads the profile of a user
+func loadUser(userID int) (*models.User, error) {
+    var user models.User
+    var username, pendingEmail sql.NullString
+    err := db.DB.QueryRow(`SELECT id, username, email, email_verified, pending_email, role, plan, totp_enabled, created_at, updated_at
+        FROM users WHERE id = $1`, userID).
+        Scan(&user.ID, &username, &user.Email, &user.EmailVerified, &pendingEmail, &user.Role, &user.Plan, &user.TwoFactorEnabled, &user.CreatedAt, &user.UpdatedAt)
+    if err != nil {
+        return nil, err
+    }
+
+    if username.Valid {
+        user.Username = &username.String
+    }
+    if pendingEmail.Valid {
+        user.PendingEmail = &pendingEmail.String
+    }
+    return &user, nil
+}
+
+// GetProfile returns the authenticated user's profile
+func GetProfile(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    user, err := loadUser(userID)
+    if err != nil {
+        log.Println("Error retrieving profile:", err)
+        http.Error(w, "Error retrieving profile", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(user)
+}
+
+// UpdateProfile updates the authenticated user's profile fields
+func UpdateProfile(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    var req ProfileUpdateRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid input", http.StatusBadRequest)
+        return
+    }
+
+    if req.Username != nil {
+        if err := models.ValidateUsername(*req.Username); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+
+        _, err := db.DB.Exec("UPDATE users SET username = $1, updated_at = NOW() WHERE id = $2", *req.Username, userID)
+        if db.IsUniqueViolation(err) {
+            http.Error(w, "Username is already taken", http.StatusConflict)
+            return
+        }
+        if err != nil {
+            log.Println("Error updating profile:", err)
+            http.Error(w, "Error updating profile", http.StatusInternalServerError)
+            return
+        }
+    }
+
+    GetProfile(w, r)
+}
+
+// ChangePassword sets a new password after checking the current one, and
+// signs out every other session
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+    sessionID, _ := r.Context().Value("sessionID").(string)
+
+    var req PasswordChangeRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid input", http.StatusBadRequest)
+        return
+    }
+
+    var storedPassword string
+    if err := db.DB.QueryRow("SELECT password FROM users WHERE id = $1", userID).Scan(&storedPassword); err != nil {
+        log.Println("Error retrieving user:", err)
+        http.Error(w, "Error changing password", http.StatusInternalServerError)
+        return
+    }
+    if storedPassword == "" {
+        http.Error(w, noPasswordMessage, http.StatusForbidden)
+        return
+    }
+    if !CheckPasswordHash(req.CurrentPassword, storedPassword) {
+        http.Error(w, "Current password is incorrect", http.StatusUnauthorized)
+        return
+    }
+    if err := models.ValidatePassword(req.NewPassword); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    hashedPassword, err := HashPassword(req.NewPassword)
+    if err != nil {
+        http.Error(w, "Error hashing password", http.StatusInternalServerError)
+        return
+    }
+
+    if _, err := db.DB.Exec("UPDATE users SET password = $1, updated_at = NOW() WHERE id = $2", hashedPassword, userID); err != nil {
+        log.Println("Error changing password:", err)
+        http.Error(w, "Error changing password", http.StatusInternalServerError)
+        return
+    }
+
+    if err := revokeUserSessions(userID, sessionID); err != nil {
+        log.Println("Error revoking sessions:", err)
+    }
+
+    w.Write([]byte("Password changed successfully"))
+}
+
+// ChangeEmail starts an email change. The new address only replaces the
+// current one once it is confirmed through the link sent to it.
+func ChangeEmail(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    var req EmailChangeRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid input", http.StatusBadRequest)
+        return
+    }
+
+    req.NewEmail = models.NormalizeEmail(req.NewEmail)
+    if err := models.ValidateEmail(req.NewEmail); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    var storedPassword string
+    if err := db.DB.QueryRow("SELECT password FROM users WHERE id = $1", userID).Scan(&storedPassword); err != nil {
+        log.Println("Error retrieving user:", err)
+        http.Error(w, "Error changing email", http.StatusInternalServerError)
+        return
+    }
+    if storedPassword == "" {
+        http.Error(w, noPasswordMessage, http.StatusForbidden)
+        return
+    }
+    if !CheckPasswordHash(req.Password, storedPassword) {
+        http.Error(w, "Password is incorrect", http.StatusUnauthorized)
+        return
+    }
+
+    var exists bool
+    if err := db.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = $1)", req.NewEmail).Scan(&exists); err != nil {
+        log.Println("Error checking email:", err)
+        http.Error(w, "Error changing email", http.StatusInternalServerError)
+        return
+    }
+    if exists {
+        http.Error(w, "An account with this email already exists", http.StatusConflict)
+        return
+    }
+
+    if _, err := db.DB.Exec("UPDATE users SET pending_email = $1, updated_at = NOW() WHERE id = $2", req.NewEmail, userID); err != nil {
+        log.Println("Error saving pending email:", err)
+        http.Error(w, "Error changing email", http.StatusInternalServerError)
+        return
+    }
+
+    token, err := issueSingleUseToken(userID, req.NewEmail, PurposeEmailChange, verifyEmailTTL)
+    if err == nil {
+        err = mail.Default.Send(mail.Message{
+            To:      req.NewEmail,
+            Subject: "Confirm your new email address",
+            Body:    "Please confirm your new email address by opening the link below:\n\n" + tokenLink("/me/email/confirm", token) + "\n\nThe link expires in 24 hours.",
+        })
+    }
+    if err != nil {
+        log.Println("Error sending email change confirmation:", err)
+        http.Error(w, "Error sending confirmation email", http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusAccepted)
+    w.Write([]byte("A confirmation link has been sent to the new email address"))
+}
+
+// ConfirmEmailChange switches the account to the pending email address using
+// the token from the confirmation link, and notifies the previous address
+func ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+    claims, err := redeemSingleUseToken(r.URL.Query().Get("token"), PurposeEmailChange)
+    if err == errInvalidToken {
+        http.Error(w, "Invalid or expired confirmation link", http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        log.Println("Error redeeming email change token:", err)
+        http.Error(w, "Error changing email", http.StatusInternalServerError)
+        return
+    }
+
+    var previousEmail string
+    err = db.DB.QueryRow(`UPDATE users SET email = pending_email, pending_email = NULL, email_verified = TRUE, updated_at = NOW()
+        FROM (SELECT email AS previous_email FROM users WHERE id = $1) previous
+        WHERE id = $1 AND pending_email = $2 RETURNING previous.previous_email`, claims.UserID, claims.Email).Scan(&previousEmail)
+    if err == sql.ErrNoRows {
+        http.Error(w, "This email change is no longer pending", http.StatusBadRequest)
+        return
+    }
+    if db.IsUniqueViolation(err) {
+        http.Error(w, "An account with this email already exists", http.StatusConflict)
+        return
+    }
+    if err != nil {
+        log.Println("Error changing email:", err)
+        http.Error(w, "Error changing email", http.StatusInternalServerError)
+        return
+    }
+
+    err = mail.Default.Send(mail.Message{
+        To:      previousEmail,
+        Subject: "Your email address was changed",
+        Body:    "The email address of your account was changed to " + claims.Email + ". If you did not make this change, please contact support immediately.",
+    })
+    if err != nil {
+        log.Println("Error notifying previous email address:", err)
+    }
+
+    w.Write([]byte("Email changed successfully"))
+}
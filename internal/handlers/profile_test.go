@@ -0,0 +1,134 @@
+package handlers
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestChangePassword(t *testing.T) {
+    hash, _ := HashPassword("old password 1")
+    tests := []struct {
+        name   string
+        stored string
+        body   string
+        want   int
+    }{
+        {"wrong current password", hash, `{"current_password": "guess 1", "new_password": "new password 2"}`, http.StatusUnauthorized},
+        {"SSO account without a password", "", `{"current_password": "", "new_password": "new password 2"}`, http.StatusForbidden},
+        {"weak new password", hash, `{"current_password": "old password 1", "new_password": "short"}`, http.StatusBadRequest},
+        {"changed", hash, `{"current_password": "old password 1", "new_password": "new password 2"}`, http.StatusOK},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            mock := mockDB(t)
+            mock.ExpectQuery("SELECT password FROM users WHERE id").WithArgs(1).
+                WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(test.stored))
+            if test.want == http.StatusOK {
+                mock.ExpectExec("UPDATE users SET password").WithArgs(sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+                // Every other session is signed out, the current one is kept
+                mock.ExpectExec("UPDATE sessions SET revoked_at").WithArgs(1, "session-1").WillReturnResult(sqlmock.NewResult(0, 2))
+            }
+
+            r := asUser(httptest.NewRequest("POST", "/me/password", strings.NewReader(test.body)), 1, "user")
+            r = r.WithContext(context.WithValue(r.Context(), "sessionID", "session-1"))
+            w := httptest.NewRecorder()
+            ChangePassword(w, r)
+            if w.Code != test.want {
+                t.Errorf("status = %d, want %d: %s", w.Code, test.want, w.Body)
+            }
+        })
+    }
+}
+
+func TestChangeEmailRejectsBadRequests(t *testing.T) {
+    hash, _ := HashPassword("password 1")
+    tests := []struct {
+        name   string
+        body   string
+        stored string
+        taken  bool
+        want   int
+    }{
+        {"invalid address", `{"new_email": "not-an-email", "password": "password 1"}`, "", false, http.StatusBadRequest},
+        {"wrong password", `{"new_email": "new@example.com", "password": "guess 1"}`, hash, false, http.StatusUnauthorized},
+        {"SSO account without a password", `{"new_email": "new@example.com", "password": ""}`, "", false, http.StatusForbidden},
+        {"address taken", `{"new_email": "new@example.com", "password": "password 1"}`, hash, true, http.StatusConflict},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            mock := mockDB(t)
+            if test.want != http.StatusBadRequest {
+                mock.ExpectQuery("SELECT password FROM users WHERE id").WithArgs(1).
+                    WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(test.stored))
+            }
+            if test.taken {
+                mock.ExpectQuery("SELECT EXISTS").WithArgs("new@example.com").
+                    WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+            }
+
+            w := httptest.NewRecorder()
+            ChangeEmail(w, asUser(httptest.NewRequest("POST", "/me/email", strings.NewReader(test.body)), 1, "user"))
+            if w.Code != test.want {
+                t.Errorf("status = %d, want %d: %s", w.Code, test.want, w.Body)
+            }
+        })
+    }
+}
+
+func TestChangeEmailSendsTheConfirmationToTheNewAddress(t *testing.T) {
+    testKeys(t)
+    box := mockMail(t)
+    mock := mockDB(t)
+    hash, _ := HashPassword("password 1")
+    mock.ExpectQuery("SELECT password FROM users WHERE id").WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(hash))
+    mock.ExpectQuery("SELECT EXISTS").WithArgs("new@example.com").
+        WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+    // The email itself only changes once the link is confirmed
+    mock.ExpectExec("UPDATE users SET pending_email").WithArgs("new@example.com", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("INSERT INTO user_tokens").WithArgs(sqlmock.AnyArg(), 1, PurposeEmailChange, sqlmock.AnyArg()).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+
+    // Addresses are stored lowercased
+    body := `{"new_email": " New@Example.com ", "password": "password 1"}`
+    w := httptest.NewRecorder()
+    ChangeEmail(w, asUser(httptest.NewRequest("POST", "/me/email", strings.NewReader(body)), 1, "user"))
+    if w.Code != http.StatusAccepted {
+        t.Fatalf("status = %d, want 202: %s", w.Code, w.Body)
+    }
+    if len(box.sent) != 1 || box.sent[0].To != "new@example.com" || !strings.Contains(box.sent[0].Body, "/me/email/confirm?token=") {
+        t.Errorf("sent = %+v, want one confirmation link to the new address", box.sent)
+    }
+}
+
+func TestRegisterUserValidatesInput(t *testing.T) {
+    tests := []struct {
+        name string
+        body string
+    }{
+        {"malformed JSON", `{"email": `},
+        {"invalid email", `{"email": "jdoe", "password": "password 1"}`},
+        {"password without digit", `{"email": "jdoe@example.com", "password": "password"}`},
+        {"password too short", `{"email": "jdoe@example.com", "password": "pass 1"}`},
+        {"invalid username", `{"email": "jdoe@example.com", "password": "password 1", "username": "j d"}`},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            // No statement is expected, invalid input never reaches the database
+            mockDB(t)
+            w := httptest.NewRecorder()
+            RegisterUser(w, httptest.NewRequest("POST", "/register", strings.NewReader(test.body)))
+            if w.Code != http.StatusBadRequest {
+                t.Errorf("status = %d, want 400: %s", w.Code, w.Body)
+            }
+        })
+    }
+}
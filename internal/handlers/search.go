@@ -43,10 +43,22 @@ func HandleFileSearch(w http.ResponseWriter, r *http.Request) {
     offset := (pageInt - 1) * limitInt
 
     // Build the SQL query dynamically based on provided filters
-    query := "SELECT file_name, file_url, upload_date, file_size FROM files WHERE user_id = $1"
+    query := "SELECT file_name, file_url, upload_date, file_size FROM files WHERE " + visibleFilesCondition
     args := []interface{}{userID}
     argIndex := 2
 
+    // Limit the search to one of the user's workspaces
+    if workspaceID := r.URL.Query().Get("workspace_id"); workspaceID != "" {
+        id, err := strconv.Atoi(workspaceID)
+        if err != nil {
+            http.Error(w, "Invalid workspace ID", http.StatusBadRequest)
+            return
+        }
+        query += fmt.Sprintf(" AND workspace_id = $%d", argIndex)
+        args = append(args, id)
+        argIndex++
+    }
+
     // Modify the file name filter to match files that start with the provided name
     if fileName != "" {
         query += fmt.Sprintf(" AND file_name ILIKE $%d", argIndex)
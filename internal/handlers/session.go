@@ -0,0 +1,117 @@
+package handlers
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "log"
+    "net/http"
+    "time"
+    "trademarkia/internal/db"
+    "trademarkia/internal/utils"
+
+    "github.com/gorilla/mux"
+)
+
+// Session is a logged-in device. Every access token carries its session ID
+// in the jti claim, and JWTMiddleware rejects tokens of revoked sessions.
+type Session struct {
+    ID         string    `json:"id"`
+    UserAgent  string    `json:"user_agent"`
+    IP         string    `json:"ip"`
+    CreatedAt  time.Time `json:"created_at"`
+    LastUsedAt time.Time `json:"last_used_at"`
+    ExpiresAt  time.Time `json:"expires_at"`
+    Current    bool      `json:"current"`
+}
+
+// createSession records a new session for the user and returns its ID
+func createSession(r *http.Request, userID int, expiresAt time.Time) (string, error) {
+    idBytes := make([]byte, 16)
+    if _, err := rand.Read(idBytes); err != nil {
+        return "", err
+    }
+    sessionID := hex.EncodeToString(idBytes)
+
+    userAgent := r.UserAgent()
+    if len(userAgent) > 512 {
+        userAgent = userAgent[:512]
+    }
+
+    _, err := db.DB.Exec("INSERT INTO sessions (id, user_id, user_agent, ip, expires_at) VALUES ($1, $2, $3, $4, $5)",
+        sessionID, userID, userAgent, utils.ClientIP(r), expiresAt)
+    if err != nil {
+        return "", err
+    }
+    return sessionID, nil
+}
+
+// revokeUserSessions revokes every active session of the user except keepSessionID
+func revokeUserSessions(userID int, keepSessionID string) error {
+    _, err := db.DB.Exec("UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL",
+        userID, keepSessionID)
+    return err
+}
+
+// ListSessions lists the authenticated user's active sessions
+func ListSessions(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+    currentSessionID, _ := r.Context().Value("sessionID").(string)
+
+    rows, err := db.DB.Query(`SELECT id, user_agent, ip, created_at, last_used_at, expires_at FROM sessions
+        WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW() ORDER BY last_used_at DESC`, userID)
+    if err != nil {
+        log.Println("Error retrieving sessions:", err)
+        http.Error(w, "Error retrieving sessions", http.StatusInternalServerError)
+        return
+    }
+    defer rows.Close()
+
+    sessions := []Session{}
+    for rows.Next() {
+        var session Session
+        if err := rows.Scan(&session.ID, &session.UserAgent, &session.IP, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt); err != nil {
+            log.Println("Error scanning sessions:", err)
+            http.Error(w, "Error retrieving sessions", http.StatusInternalServerError)
+            return
+        }
+        session.Current = session.ID == currentSessionID
+        sessions = append(sessions, session)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(sessions)
+}
+
+// RevokeSession revokes one of the authenticated user's sessions
+func RevokeSession(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+    sessionID := mux.Vars(r)["session_id"]
+
+    result, err := db.DB.Exec("UPDATE sessions SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL", sessionID, userID)
+    if err != nil {
+        log.Println("Error revoking session:", err)
+        http.Error(w, "Error revoking session", http.StatusInternalServerError)
+        return
+    }
+    if affected, _ := result.RowsAffected(); affected == 0 {
+        http.Error(w, "Session not found", http.StatusNotFound)
+        return
+    }
+
+    w.Write([]byte("Session revoked successfully"))
+}
+
+// RevokeOtherSessions revokes every session of the authenticated user except the current one
+func RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+    currentSessionID, _ := r.Context().Value("sessionID").(string)
+
+    if err := revokeUserSessions(userID, currentSessionID); err != nil {
+        log.Println("Error revoking sessions:", err)
+        http.Error(w, "Error revoking sessions", http.StatusInternalServerError)
+        return
+    }
+
+    w.Write([]byte("All other sessions revoked successfully"))
+}
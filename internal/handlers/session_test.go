@@ -0,0 +1,78 @@
+package handlers
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/gorilla/mux"
+)
+
+func TestRevokeSession(t *testing.T) {
+    tests := []struct {
+        name     string
+        affected int64
+        want     int
+    }{
+        {"own active session", 1, http.StatusOK},
+        {"unknown, foreign or already revoked session", 0, http.StatusNotFound},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            mock := mockDB(t)
+            mock.ExpectExec("UPDATE sessions SET revoked_at = NOW\\(\\) WHERE id = \\$1 AND user_id = \\$2").
+                WithArgs("session-2", 1).
+                WillReturnResult(sqlmock.NewResult(0, test.affected))
+
+            r := mux.SetURLVars(httptest.NewRequest("DELETE", "/me/sessions/session-2", nil), map[string]string{"session_id": "session-2"})
+            w := httptest.NewRecorder()
+            RevokeSession(w, asUser(r, 1, "user"))
+            if w.Code != test.want {
+                t.Errorf("status = %d, want %d: %s", w.Code, test.want, w.Body)
+            }
+        })
+    }
+}
+
+func TestRevokeOtherSessionsKeepsTheCurrentOne(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectExec("UPDATE sessions SET revoked_at = NOW\\(\\) WHERE user_id = \\$1 AND id <> \\$2").
+        WithArgs(1, "session-1").
+        WillReturnResult(sqlmock.NewResult(0, 3))
+
+    r := asUser(httptest.NewRequest("DELETE", "/me/sessions", nil), 1, "user")
+    r = r.WithContext(context.WithValue(r.Context(), "sessionID", "session-1"))
+    w := httptest.NewRecorder()
+    RevokeOtherSessions(w, r)
+    if w.Code != http.StatusOK {
+        t.Errorf("status = %d, want 200: %s", w.Code, w.Body)
+    }
+}
+
+func TestListSessionsMarksTheCurrentOne(t *testing.T) {
+    mock := mockDB(t)
+    now := time.Now()
+    mock.ExpectQuery("SELECT id, user_agent, ip, created_at, last_used_at, expires_at FROM sessions").
+        WithArgs(1).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "user_agent", "ip", "created_at", "last_used_at", "expires_at"}).
+            AddRow("session-1", "curl", "10.0.0.1", now, now, now.Add(time.Hour)).
+            AddRow("session-2", "firefox", "10.0.0.2", now, now, now.Add(time.Hour)))
+
+    r := asUser(httptest.NewRequest("GET", "/me/sessions", nil), 1, "user")
+    r = r.WithContext(context.WithValue(r.Context(), "sessionID", "session-2"))
+    w := httptest.NewRecorder()
+    ListSessions(w, r)
+
+    var sessions []Session
+    if err := json.NewDecoder(w.Body).Decode(&sessions); err != nil {
+        t.Fatal(err)
+    }
+    if len(sessions) != 2 || sessions[0].Current || !sessions[1].Current {
+        t.Errorf("sessions = %+v, want only session-2 current", sessions)
+    }
+}
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "mime"
+    "net/http"
+    "path"
+    "strconv"
+    "strings"
+    "trademarkia/internal/auth"
+    "trademarkia/internal/db"
+    "trademarkia/internal/throttle"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "github.com/gorilla/mux"
+)
+
+// BandwidthLimits are a plan's transfer rates in bytes per second. Zero
+// means unlimited.
+type BandwidthLimits struct {
+    Upload   int `json:"upload_bytes_per_second"`
+    Download int `json:"download_bytes_per_second"`
+}
+
+const mebibyte = 1 << 20
+
+// planBandwidth holds the limits per plan, overridable with
+// BANDWIDTH_<PLAN>_UPLOAD and BANDWIDTH_<PLAN>_DOWNLOAD
+var planBandwidth = map[string]BandwidthLimits{
+    auth.PlanFree:       bandwidthFromEnv(auth.PlanFree, 1*mebibyte, 2*mebibyte),
+    auth.PlanPro:        bandwidthFromEnv(auth.PlanPro, 5*mebibyte, 10*mebibyte),
+    auth.PlanEnterprise: bandwidthFromEnv(auth.PlanEnterprise, 20*mebibyte, 40*mebibyte),
+}
+
+// bandwidth shares each user's upload and download rate across all of their
+// concurrent transfers on this instance
+var bandwidth = throttle.NewRegistry()
+
+func bandwidthFromEnv(plan string, upload, download int) BandwidthLimits {
+    prefix := "BANDWIDTH_" + strings.ToUpper(plan)
+    return BandwidthLimits{
+        Upload:   envInt(prefix+"_UPLOAD", upload),
+        Download: envInt(prefix+"_DOWNLOAD", download),
+    }
+}
+
+func bandwidthFor(r *http.Request) BandwidthLimits {
+    plan, _ := r.Context().Value("plan").(string)
+    if limits, ok := planBandwidth[plan]; ok {
+        return limits
+    }
+    return planBandwidth[auth.PlanFree]
+}
+
+// transferBucket returns the user's bucket for one direction, or nil when
+// the plan has no limit
+func transferBucket(userID int, direction string, rate int) *throttle.Bucket {
+    if rate <= 0 {
+        return nil
+    }
+    return bandwidth.Bucket(fmt.Sprintf("%s:%d", direction, userID), rate)
+}
+
+// throttledBody limits the rate at which a request body is read
+type throttledBody struct {
+    *throttle.Reader
+    io.Closer
+}
+
+// throttleUpload replaces the request body with one read at the user's
+// upload rate, and returns the reader to count the bytes received
+func throttleUpload(r *http.Request, userID int) *throttle.Reader {
+    reader := throttle.NewReader(r.Context(), r.Body, transferBucket(userID, "upload", bandwidthFor(r).Upload))
+    r.Body = throttledBody{Reader: reader, Closer: r.Body}
+    return reader
+}
+
+// recordTransfer adds to the user's transfer counters for the current month
+func recordTransfer(userID int, uploaded, downloaded int64) {
+    if uploaded == 0 && downloaded == 0 {
+        return
+    }
+    _, err := db.DB.Exec(`INSERT INTO transfer_usage (user_id, month, bytes_uploaded, bytes_downloaded)
+        VALUES ($1, date_trunc('month', NOW())::date, $2, $3)
+        ON CONFLICT (user_id, month) DO UPDATE SET
+            bytes_uploaded = transfer_usage.bytes_uploaded + EXCLUDED.bytes_uploaded,
+            bytes_downloaded = transfer_usage.bytes_downloaded + EXCLUDED.bytes_downloaded`,
+        userID, uploaded, downloaded)
+    if err != nil {
+        log.Println("Error recording transfer usage:", err)
+    }
+}
+
+// DownloadFile streams a file from S3 through the server at the user's
+// download rate and counts it towards their monthly transfer
+func DownloadFile(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    fileID, err := strconv.Atoi(mux.Vars(r)["file_id"])
+    if err != nil {
+        http.Error(w, "Invalid file ID", http.StatusBadRequest)
+        return
+    }
+
+    file, ok := authorizeFile(w, r, userID, fileID, AccessView)
+    if !ok {
+        return
+    }
+
+    object, err := s3session.GetObjectWithContext(r.Context(), &s3.GetObjectInput{
+        Bucket: aws.String("trademarkiaa"),
+        Key:    aws.String(file.ObjectKey),
+    })
+    if err != nil {
+        log.Println("Error downloading file from S3:", err)
+        http.Error(w, "Error downloading file", http.StatusBadGateway)
+        return
+    }
+    defer object.Body.Close()
+
+    if object.ContentType != nil {
+        w.Header().Set("Content-Type", *object.ContentType)
+    }
+    if object.ContentLength != nil {
+        w.Header().Set("Content-Length", strconv.FormatInt(*object.ContentLength, 10))
+    }
+    w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(file.FileName)}))
+
+    writer := throttle.NewWriter(r.Context(), w, transferBucket(userID, "download", bandwidthFor(r).Download))
+    if _, err := io.Copy(writer, object.Body); err != nil {
+        log.Printf("Download of file %d stopped after %d bytes: %v", fileID, writer.N, err)
+    }
+    recordTransfer(userID, 0, writer.N)
+}
+
+// MonthlyTransfer is a user's transfer volume for one month
+type MonthlyTransfer struct {
+    Month           string `json:"month"`
+    BytesUploaded   int64  `json:"bytes_uploaded"`
+    BytesDownloaded int64  `json:"bytes_downloaded"`
+}
+
+// Usage is the response of GET /me/usage
+type Usage struct {
+    Plan         string            `json:"plan"`
+    Limits       BandwidthLimits   `json:"limits"`
+    StorageBytes int64             `json:"storage_bytes"`
+    CurrentMonth MonthlyTransfer   `json:"current_month"`
+    History      []MonthlyTransfer `json:"history"`
+}
+
+// GetUsage returns the user's bandwidth limits, storage and transfer
+// volume for the current and the previous 11 months
+func GetUsage(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    plan, _ := r.Context().Value("plan").(string)
+    usage := Usage{
+        Plan:    plan,
+        Limits:  bandwidthFor(r),
+        History: []MonthlyTransfer{},
+    }
+
+    // Months follow the database clock, like the counters themselves
+    err := db.DB.QueryRow("SELECT to_char(NOW(), 'YYYY-MM'), COALESCE(SUM(file_size), 0) FROM files WHERE user_id = $1", userID).
+        Scan(&usage.CurrentMonth.Month, &usage.StorageBytes)
+    if err != nil {
+        log.Println("Error retrieving storage usage:", err)
+        http.Error(w, "Error retrieving usage", http.StatusInternalServerError)
+        return
+    }
+
+    rows, err := db.DB.Query(`SELECT to_char(month, 'YYYY-MM'), bytes_uploaded, bytes_downloaded FROM transfer_usage
+        WHERE user_id = $1 AND month > date_trunc('month', NOW()) - INTERVAL '12 months'
+        ORDER BY month DESC`, userID)
+    if err != nil {
+        log.Println("Error retrieving transfer usage:", err)
+        http.Error(w, "Error retrieving usage", http.StatusInternalServerError)
+        return
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var month MonthlyTransfer
+        if err := rows.Scan(&month.Month, &month.BytesUploaded, &month.BytesDownloaded); err != nil {
+            log.Println("Error scanning transfer usage:", err)
+            http.Error(w, "Error retrieving usage", http.StatusInternalServerError)
+            return
+        }
+        if month.Month == usage.CurrentMonth.Month {
+            usage.CurrentMonth = month
+        }
+        usage.History = append(usage.History, month)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,310 @@
+package handlers
+
+import (
+    "database/sql"
+    "encoding/json"
+    "log"
+    "net/http"
+    "time"
+    "trademarkia/config"
+    "trademarkia/internal/auth"
+    "trademarkia/internal/db"
+    "trademarkia/internal/utils"
+)
+
+// PurposeTwoFactorChallenge marks the short-lived token returned by Login for 2FA accounts
+const PurposeTwoFactorChallenge = "2fa_challenge"
+
+const (
+    twoFactorChallengeTTL = 5 * time.Minute
+    recoveryCodeCount     = 10
+)
+
+// TwoFactorChallenge is returned by Login when the account has 2FA enabled
+type TwoFactorChallenge struct {
+    TwoFactorRequired bool   `json:"two_factor_required"`
+    ChallengeToken    string `json:"challenge_token"`
+}
+
+// TwoFactorEnrollment is returned when a user starts TOTP enrollment
+type TwoFactorEnrollment struct {
+    Secret          string `json:"secret"`
+    ProvisioningURI string `json:"provisioning_uri"`
+}
+
+// TwoFactorCodeRequest carries a TOTP code, or a recovery code in its place
+type TwoFactorCodeRequest struct {
+    ChallengeToken string `json:"challenge_token,omitempty"`
+    Code           string `json:"code"`
+    RecoveryCode   string `json:"recovery_code,omitempty"`
+    Password       string `json:"password,omitempty"`
+}
+
+func sendTwoFactorChallenge(w http.ResponseWriter, userID int, email string) {
+    token, err := issueSingleUseToken(userID, email, PurposeTwoFactorChallenge, twoFactorChallengeTTL)
+    if err != nil {
+        log.Println("Error issuing 2FA challenge:", err)
+        http.Error(w, "Error generating token", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(TwoFactorChallenge{TwoFactorRequired: true, ChallengeToken: token})
+}
+
+// EnrollTwoFactor generates a new TOTP secret for the user. 2FA is not
+// enabled until the secret is confirmed with a valid code.
+func EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    var email string
+    var enabled bool
+    err := db.DB.QueryRow("SELECT email, totp_enabled FROM users WHERE id = $1", userID).Scan(&email, &enabled)
+    if err != nil {
+        log.Println("Error retrieving user:", err)
+        http.Error(w, "Error retrieving user", http.StatusInternalServerError)
+        return
+    }
+    if enabled {
+        http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+        return
+    }
+
+    secret, err := auth.GenerateTOTPSecret()
+    if err != nil {
+        log.Println("Error generating TOTP secret:", err)
+        http.Error(w, "Error generating secret", http.StatusInternalServerError)
+        return
+    }
+
+    if _, err := db.DB.Exec("UPDATE users SET totp_secret = $1 WHERE id = $2", secret, userID); err != nil {
+        log.Println("Error saving TOTP secret:", err)
+        http.Error(w, "Error saving secret", http.StatusInternalServerError)
+        return
+    }
+
+    issuer := config.GetEnv("TOTP_ISSUER", "Trademarkia")
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(TwoFactorEnrollment{
+        Secret:          secret,
+        ProvisioningURI: auth.TOTPProvisioningURI(issuer, email, secret),
+    })
+}
+
+// ConfirmTwoFactor enables 2FA once the user proves their authenticator works,
+// and returns the one-time recovery codes
+func ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    var req TwoFactorCodeRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid input", http.StatusBadRequest)
+        return
+    }
+
+    var secret sql.NullString
+    var enabled bool
+    err := db.DB.QueryRow("SELECT totp_secret, totp_enabled FROM users WHERE id = $1", userID).Scan(&secret, &enabled)
+    if err != nil {
+        log.Println("Error retrieving user:", err)
+        http.Error(w, "Error retrieving user", http.StatusInternalServerError)
+        return
+    }
+    if enabled {
+        http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+        return
+    }
+    if !secret.Valid {
+        http.Error(w, "Start enrollment first", http.StatusBadRequest)
+        return
+    }
+
+    step, ok := auth.ValidateTOTP(secret.String, req.Code, time.Now())
+    if !ok {
+        http.Error(w, "Invalid code", http.StatusUnauthorized)
+        return
+    }
+
+    codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+    if err != nil {
+        log.Println("Error generating recovery codes:", err)
+        http.Error(w, "Error generating recovery codes", http.StatusInternalServerError)
+        return
+    }
+
+    tx, err := db.DB.Begin()
+    if err != nil {
+        log.Println("Error starting transaction:", err)
+        http.Error(w, "Error enabling two-factor authentication", http.StatusInternalServerError)
+        return
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.Exec("UPDATE users SET totp_enabled = TRUE, totp_last_step = $1 WHERE id = $2", step, userID); err != nil {
+        log.Println("Error enabling 2FA:", err)
+        http.Error(w, "Error enabling two-factor authentication", http.StatusInternalServerError)
+        return
+    }
+    if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+        log.Println("Error clearing recovery codes:", err)
+        http.Error(w, "Error enabling two-factor authentication", http.StatusInternalServerError)
+        return
+    }
+    for _, code := range codes {
+        if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)", userID, auth.HashRecoveryCode(code)); err != nil {
+            log.Println("Error saving recovery code:", err)
+            http.Error(w, "Error enabling two-factor authentication", http.StatusInternalServerError)
+            return
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        log.Println("Error committing transaction:", err)
+        http.Error(w, "Error enabling two-factor authentication", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "message":        "Two-factor authentication enabled. Store these recovery codes somewhere safe, they are shown only once.",
+        "recovery_codes": codes,
+    })
+}
+
+// DisableTwoFactor turns 2FA off after checking the password and a current
+// code. Accounts provisioned through SSO have no password, so for them the
+// code or a recovery code is the only proof required.
+func DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    var req TwoFactorCodeRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid input", http.StatusBadRequest)
+        return
+    }
+
+    var storedPassword string
+    var enabled bool
+    err := db.DB.QueryRow("SELECT password, totp_enabled FROM users WHERE id = $1", userID).Scan(&storedPassword, &enabled)
+    if err != nil {
+        log.Println("Error retrieving user:", err)
+        http.Error(w, "Error retrieving user", http.StatusInternalServerError)
+        return
+    }
+    if !enabled {
+        http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+        return
+    }
+    if storedPassword != "" && !CheckPasswordHash(req.Password, storedPassword) {
+        http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+        return
+    }
+
+    ok, err := checkSecondFactor(userID, req)
+    if err != nil {
+        log.Println("Error checking second factor:", err)
+        http.Error(w, "Error disabling two-factor authentication", http.StatusInternalServerError)
+        return
+    }
+    if !ok {
+        http.Error(w, "Invalid code", http.StatusUnauthorized)
+        return
+    }
+
+    if _, err := db.DB.Exec("UPDATE users SET totp_enabled = FALSE, totp_secret = NULL WHERE id = $1", userID); err != nil {
+        log.Println("Error disabling 2FA:", err)
+        http.Error(w, "Error disabling two-factor authentication", http.StatusInternalServerError)
+        return
+    }
+    if _, err := db.DB.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+        log.Println("Error clearing recovery codes:", err)
+    }
+
+    w.Write([]byte("Two-factor authentication disabled"))
+}
+
+// LoginTwoFactor exchanges a challenge token and a valid code for an access token.
+// Each challenge can be used once, so a wrong code means logging in again.
+func LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+    var req TwoFactorCodeRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid input", http.StatusBadRequest)
+        return
+    }
+
+    claims, err := redeemSingleUseToken(req.ChallengeToken, PurposeTwoFactorChallenge)
+    if err == errInvalidToken {
+        http.Error(w, "Invalid or expired challenge, please log in again", http.StatusUnauthorized)
+        return
+    }
+    if err != nil {
+        log.Println("Error redeeming 2FA challenge:", err)
+        http.Error(w, "Error verifying code", http.StatusInternalServerError)
+        return
+    }
+
+    ok, err := checkSecondFactor(claims.UserID, req)
+    if err != nil {
+        log.Println("Error checking second factor:", err)
+        http.Error(w, "Error verifying code", http.StatusInternalServerError)
+        return
+    }
+    if !ok {
+        // A wrong code counts as a failed login, otherwise an attacker who
+        // knows the password could guess codes without ever being throttled
+        recordLoginFailure(r.Context(), claims.Email, utils.ClientIP(r))
+        http.Error(w, "Invalid code, please log in again", http.StatusUnauthorized)
+        return
+    }
+
+    var role string
+    var disabled bool
+    err = db.DB.QueryRow("SELECT role, disabled FROM users WHERE id = $1", claims.UserID).Scan(&role, &disabled)
+    if err != nil {
+        log.Println("Error retrieving user:", err)
+        http.Error(w, "Error verifying code", http.StatusInternalServerError)
+        return
+    }
+    if disabled {
+        http.Error(w, "Account disabled", http.StatusForbidden)
+        return
+    }
+
+    clearLoginFailures(r.Context(), claims.Email)
+    issueAccessToken(w, r, claims.UserID, claims.Email, role)
+}
+
+// checkSecondFactor validates either a TOTP code or an unused recovery code.
+// A TOTP step is only accepted once, so an observed code cannot be replayed.
+func checkSecondFactor(userID int, req TwoFactorCodeRequest) (bool, error) {
+    if req.RecoveryCode != "" {
+        result, err := db.DB.Exec("UPDATE recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+            userID, auth.HashRecoveryCode(req.RecoveryCode))
+        if err != nil {
+            return false, err
+        }
+        affected, _ := result.RowsAffected()
+        return affected == 1, nil
+    }
+
+    var secret sql.NullString
+    var lastStep int64
+    err := db.DB.QueryRow("SELECT totp_secret, totp_last_step FROM users WHERE id = $1 AND totp_enabled = TRUE", userID).Scan(&secret, &lastStep)
+    if err == sql.ErrNoRows || (err == nil && !secret.Valid) {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+
+    step, ok := auth.ValidateTOTP(secret.String, req.Code, time.Now())
+    if !ok || step <= lastStep {
+        return false, nil
+    }
+
+    result, err := db.DB.Exec("UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1", step, userID)
+    if err != nil {
+        return false, err
+    }
+    affected, _ := result.RowsAffected()
+    return affected == 1, nil
+}
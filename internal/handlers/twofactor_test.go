@@ -0,0 +1,52 @@
+package handlers
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestDisableTwoFactor(t *testing.T) {
+    hash, _ := HashPassword("password 1")
+    tests := []struct {
+        name    string
+        stored  string
+        body    string
+        codeOK  bool
+        checked bool
+        want    int
+    }{
+        {"wrong password", hash, `{"password": "guess 1", "recovery_code": "abcd-efgh"}`, true, false, http.StatusUnauthorized},
+        {"password and recovery code", hash, `{"password": "password 1", "recovery_code": "abcd-efgh"}`, true, true, http.StatusOK},
+        {"SSO account with a recovery code", "", `{"recovery_code": "abcd-efgh"}`, true, true, http.StatusOK},
+        {"SSO account with a wrong recovery code", "", `{"recovery_code": "abcd-efgh"}`, false, true, http.StatusUnauthorized},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            mock := mockDB(t)
+            mock.ExpectQuery("SELECT password, totp_enabled FROM users WHERE id").WithArgs(1).
+                WillReturnRows(sqlmock.NewRows([]string{"password", "totp_enabled"}).AddRow(test.stored, true))
+            if test.checked {
+                used := int64(0)
+                if test.codeOK {
+                    used = 1
+                }
+                mock.ExpectExec("UPDATE recovery_codes SET used_at").WithArgs(1, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, used))
+            }
+            if test.want == http.StatusOK {
+                mock.ExpectExec("UPDATE users SET totp_enabled = FALSE").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+                mock.ExpectExec("DELETE FROM recovery_codes").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 9))
+            }
+
+            w := httptest.NewRecorder()
+            DisableTwoFactor(w, asUser(httptest.NewRequest("POST", "/2fa/disable", strings.NewReader(test.body)), 1, "user"))
+            if w.Code != test.want {
+                t.Errorf("status = %d, want %d: %s", w.Code, test.want, w.Body)
+            }
+        })
+    }
+}
@@ -6,22 +6,21 @@ import (
     "log"
     "net/http"
     "time"
+    "trademarkia/config"
+    "trademarkia/internal/auth"
     "trademarkia/internal/db"
+    "trademarkia/internal/models"
+    "trademarkia/internal/utils"
 
     "github.com/dgrijalva/jwt-go"
     "golang.org/x/crypto/bcrypt"
 )
 
-var jwtKey = []byte("my_secret_key")
-
-// User struct defines the registration credentials
-type User struct {
-    ID        int       `json:"id"`
-    Username  string    `json:"username"`
-    Email     string    `json:"email"`
-    Password  string    `json:"password"`
-    CreatedAt time.Time `json:"created_at"`
-    UpdatedAt time.Time `json:"updated_at"`
+// RegistrationRequest defines the registration credentials
+type RegistrationRequest struct {
+    Username string `json:"username"`
+    Email    string `json:"email"`
+    Password string `json:"password"`
 }
 
 // Credentials struct for login
@@ -34,6 +33,11 @@ type Credentials struct {
 type Claims struct {
     UserID int    `json:"user_id"`
     Email  string `json:"email"`
+    Role   string `json:"role"`
+
+    // Purpose is empty for access tokens and set for single-use tokens,
+    // which JWTMiddleware refuses to accept
+    Purpose string `json:"purpose,omitempty"`
     jwt.StandardClaims
 }
 
@@ -54,13 +58,33 @@ func CheckPasswordHash(password, hash string) bool {
 
 // RegisterUser handles user registration
 func RegisterUser(w http.ResponseWriter, r *http.Request) {
-    var user User
+    var user RegistrationRequest
     err := json.NewDecoder(r.Body).Decode(&user)
     if err != nil {
         http.Error(w, "Invalid input", http.StatusBadRequest)
         return
     }
 
+    user.Email = models.NormalizeEmail(user.Email)
+    if err := models.ValidateEmail(user.Email); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err := models.ValidatePassword(user.Password); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    // The username is optional at registration
+    var username *string
+    if user.Username != "" {
+        if err := models.ValidateUsername(user.Username); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        username = &user.Username
+    }
+
     // Hash the password before storing it
     hashedPassword, err := HashPassword(user.Password)
     if err != nil {
@@ -69,13 +93,23 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
     }
 
     // Insert user into the database
-    _, err = db.DB.Exec("INSERT INTO users (email, password) VALUES ($1, $2)", user.Email, hashedPassword)
+    var userID int
+    err = db.DB.QueryRow("INSERT INTO users (username, email, password) VALUES ($1, $2, $3) RETURNING id", username, user.Email, hashedPassword).Scan(&userID)
+    if db.IsUniqueViolation(err) {
+        http.Error(w, "An account with this email or username already exists", http.StatusConflict)
+        return
+    }
     if err != nil {
         log.Println("Error saving user:", err)
         http.Error(w, "Error saving user", http.StatusInternalServerError)
         return
     }
 
+    if err := sendVerificationEmail(userID, user.Email); err != nil {
+        log.Println("Error sending verification email:", err)
+    }
+
+    w.WriteHeader(http.StatusCreated)
     w.Write([]byte("User registered successfully"))
 }
 
@@ -88,29 +122,76 @@ func Login(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    ip := utils.ClientIP(r)
+    if wait := checkLoginAllowed(r.Context(), creds.Email, ip); wait > 0 {
+        rejectThrottledLogin(w, wait)
+        return
+    }
+
     var storedPassword string
     var userID int
-    err = db.DB.QueryRow("SELECT id, password FROM users WHERE email=$1", creds.Email).Scan(&userID, &storedPassword)
-    if err == sql.ErrNoRows || !CheckPasswordHash(creds.Password, storedPassword) {
+    var role string
+    var disabled, emailVerified, totpEnabled bool
+    err = db.DB.QueryRow("SELECT id, password, role, disabled, email_verified, totp_enabled FROM users WHERE lower(email) = $1", models.NormalizeEmail(creds.Email)).
+        Scan(&userID, &storedPassword, &role, &disabled, &emailVerified, &totpEnabled)
+    if err != nil && err != sql.ErrNoRows {
+        log.Println("Error retrieving user:", err)
+        http.Error(w, "Error logging in", http.StatusInternalServerError)
+        return
+    }
+
+    // Unknown emails still pay for a bcrypt comparison and count as failures,
+    // so they look the same as a wrong password from the outside. Disabled
+    // accounts get the same answer, so it does not confirm the password.
+    if err == sql.ErrNoRows {
+        compareWithDummyHash(creds.Password)
+    }
+    if err == sql.ErrNoRows || !CheckPasswordHash(creds.Password, storedPassword) || disabled {
+        recordLoginFailure(r.Context(), creds.Email, ip)
         http.Error(w, "Invalid credentials", http.StatusUnauthorized)
         return
     }
 
+    if !emailVerified && config.GetEnv("REQUIRE_EMAIL_VERIFICATION", "false") == "true" {
+        http.Error(w, "Email address not verified", http.StatusForbidden)
+        return
+    }
+
+    // Accounts with two-factor authentication get a challenge instead of a token
+    if totpEnabled {
+        sendTwoFactorChallenge(w, userID, creds.Email)
+        return
+    }
+
+    clearLoginFailures(r.Context(), creds.Email)
+    issueAccessToken(w, r, userID, creds.Email, role)
+}
+
+// issueAccessToken starts a session, signs an access token for it and writes it to the response
+func issueAccessToken(w http.ResponseWriter, r *http.Request, userID int, email string, role string) {
     // Set the expiration time for the token (1 hour from now)
     expirationTime := time.Now().Add(1 * time.Hour).Unix()
 
+    sessionID, err := createSession(r, userID, time.Unix(expirationTime, 0))
+    if err != nil {
+        log.Println("Error creating session:", err)
+        http.Error(w, "Error generating token", http.StatusInternalServerError)
+        return
+    }
+
     // Create the JWT claims, including the user_id and expiration time
     claims := &Claims{
         UserID: userID,
-        Email:  creds.Email,
+        Email:  email,
+        Role:   role,
         StandardClaims: jwt.StandardClaims{
+            Id:        sessionID,
             ExpiresAt: expirationTime,
         },
     }
 
-    // Generate the token
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    tokenString, err := token.SignedString(jwtKey)
+    // Generate the token with the active signing key
+    tokenString, err := auth.Keys.Sign(claims)
     if err != nil {
         http.Error(w, "Error generating token", http.StatusInternalServerError)
         return
@@ -0,0 +1,357 @@
+package handlers
+
+import (
+    "database/sql"
+    "encoding/json"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "trademarkia/internal/cache"
+    "trademarkia/internal/db"
+    "trademarkia/internal/models"
+
+    "github.com/gorilla/mux"
+)
+
+// WorkspaceRequest is the payload for creating a workspace
+type WorkspaceRequest struct {
+    Name string `json:"name"`
+}
+
+// WorkspaceMemberRequest adds a member by email or changes a member's role
+type WorkspaceMemberRequest struct {
+    Email string `json:"email"`
+    Role  string `json:"role"`
+}
+
+// CreateWorkspace creates a workspace with the caller as its owner
+func CreateWorkspace(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    var req WorkspaceRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid input", http.StatusBadRequest)
+        return
+    }
+    req.Name = strings.TrimSpace(req.Name)
+    if err := models.ValidateWorkspaceName(req.Name); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    tx, err := db.DB.Begin()
+    if err != nil {
+        log.Println("Error starting transaction:", err)
+        http.Error(w, "Error creating workspace", http.StatusInternalServerError)
+        return
+    }
+    defer tx.Rollback()
+
+    workspace := models.Workspace{Name: req.Name, Role: models.WorkspaceOwner}
+    err = tx.QueryRow("INSERT INTO workspaces (name, created_by) VALUES ($1, $2) RETURNING id, created_at", req.Name, userID).
+        Scan(&workspace.ID, &workspace.CreatedAt)
+    if err == nil {
+        _, err = tx.Exec("INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)",
+            workspace.ID, userID, models.WorkspaceOwner)
+    }
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err != nil {
+        log.Println("Error creating workspace:", err)
+        http.Error(w, "Error creating workspace", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(workspace)
+}
+
+// ListWorkspaces lists the workspaces the caller is a member of, with their role
+func ListWorkspaces(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    rows, err := db.DB.Query(`SELECT workspaces.id, workspaces.name, workspace_members.role, workspaces.created_at
+        FROM workspaces JOIN workspace_members ON workspace_members.workspace_id = workspaces.id
+        WHERE workspace_members.user_id = $1 ORDER BY workspaces.name`, userID)
+    if err != nil {
+        log.Println("Error retrieving workspaces:", err)
+        http.Error(w, "Error retrieving workspaces", http.StatusInternalServerError)
+        return
+    }
+    defer rows.Close()
+
+    workspaces := []models.Workspace{}
+    for rows.Next() {
+        var workspace models.Workspace
+        if err := rows.Scan(&workspace.ID, &workspace.Name, &workspace.Role, &workspace.CreatedAt); err != nil {
+            log.Println("Error scanning workspaces:", err)
+            http.Error(w, "Error retrieving workspaces", http.StatusInternalServerError)
+            return
+        }
+        workspaces = append(workspaces, workspace)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(workspaces)
+}
+
+// DeleteWorkspace deletes a workspace. Only owners can delete it, and only
+// once all of its files have been removed.
+func DeleteWorkspace(w http.ResponseWriter, r *http.Request) {
+    workspaceID, ok := authorizeWorkspace(w, r, models.WorkspaceOwner)
+    if !ok {
+        return
+    }
+
+    var hasFiles bool
+    if err := db.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM files WHERE workspace_id = $1)", workspaceID).Scan(&hasFiles); err != nil {
+        log.Println("Error checking workspace files:", err)
+        http.Error(w, "Error deleting workspace", http.StatusInternalServerError)
+        return
+    }
+    if hasFiles {
+        http.Error(w, "Delete the workspace's files first", http.StatusConflict)
+        return
+    }
+
+    if _, err := db.DB.Exec("DELETE FROM workspaces WHERE id = $1", workspaceID); err != nil {
+        log.Println("Error deleting workspace:", err)
+        http.Error(w, "Error deleting workspace", http.StatusInternalServerError)
+        return
+    }
+
+    w.Write([]byte("Workspace deleted successfully"))
+}
+
+// ListWorkspaceMembers lists the members of a workspace the caller belongs to
+func ListWorkspaceMembers(w http.ResponseWriter, r *http.Request) {
+    workspaceID, ok := authorizeWorkspace(w, r, models.WorkspaceViewer)
+    if !ok {
+        return
+    }
+
+    rows, err := db.DB.Query(`SELECT users.id, users.email, workspace_members.role, workspace_members.created_at
+        FROM workspace_members JOIN users ON users.id = workspace_members.user_id
+        WHERE workspace_members.workspace_id = $1 ORDER BY workspace_members.created_at`, workspaceID)
+    if err != nil {
+        log.Println("Error retrieving workspace members:", err)
+        http.Error(w, "Error retrieving workspace members", http.StatusInternalServerError)
+        return
+    }
+    defer rows.Close()
+
+    members := []models.WorkspaceMember{}
+    for rows.Next() {
+        var member models.WorkspaceMember
+        if err := rows.Scan(&member.UserID, &member.Email, &member.Role, &member.CreatedAt); err != nil {
+            log.Println("Error scanning workspace members:", err)
+            http.Error(w, "Error retrieving workspace members", http.StatusInternalServerError)
+            return
+        }
+        members = append(members, member)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(members)
+}
+
+// AddWorkspaceMember adds a registered user to a workspace. Only owners can add members.
+func AddWorkspaceMember(w http.ResponseWriter, r *http.Request) {
+    workspaceID, ok := authorizeWorkspace(w, r, models.WorkspaceOwner)
+    if !ok {
+        return
+    }
+
+    var req WorkspaceMemberRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid input", http.StatusBadRequest)
+        return
+    }
+    if !models.ValidWorkspaceRole(req.Role) {
+        http.Error(w, "Role must be owner, editor or viewer", http.StatusBadRequest)
+        return
+    }
+
+    var memberID int
+    err := db.DB.QueryRow("SELECT id FROM users WHERE lower(email) = $1 AND NOT disabled", models.NormalizeEmail(req.Email)).Scan(&memberID)
+    if err == sql.ErrNoRows {
+        http.Error(w, "No user with this email", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        log.Println("Error retrieving user:", err)
+        http.Error(w, "Error adding member", http.StatusInternalServerError)
+        return
+    }
+
+    _, err = db.DB.Exec("INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)", workspaceID, memberID, req.Role)
+    if db.IsUniqueViolation(err) {
+        http.Error(w, "User is already a member of this workspace", http.StatusConflict)
+        return
+    }
+    if err != nil {
+        log.Println("Error adding workspace member:", err)
+        http.Error(w, "Error adding member", http.StatusInternalServerError)
+        return
+    }
+    cache.InvalidateListings(r.Context(), memberID)
+
+    w.WriteHeader(http.StatusCreated)
+    w.Write([]byte("Member added successfully"))
+}
+
+// UpdateWorkspaceMember changes a member's role. Only owners can change
+// roles, and a workspace always keeps at least one owner.
+func UpdateWorkspaceMember(w http.ResponseWriter, r *http.Request) {
+    workspaceID, ok := authorizeWorkspace(w, r, models.WorkspaceOwner)
+    if !ok {
+        return
+    }
+
+    memberID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+    if err != nil {
+        http.Error(w, "Invalid user ID", http.StatusBadRequest)
+        return
+    }
+
+    var req WorkspaceMemberRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid input", http.StatusBadRequest)
+        return
+    }
+    if !models.ValidWorkspaceRole(req.Role) {
+        http.Error(w, "Role must be owner, editor or viewer", http.StatusBadRequest)
+        return
+    }
+
+    changeWorkspaceMember(w, r, workspaceID, memberID, req.Role)
+}
+
+// RemoveWorkspaceMember removes a member from a workspace. Owners can remove
+// anyone and every member can leave, as long as an owner remains.
+func RemoveWorkspaceMember(w http.ResponseWriter, r *http.Request) {
+    userID := r.Context().Value("userID").(int)
+
+    memberID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+    if err != nil {
+        http.Error(w, "Invalid user ID", http.StatusBadRequest)
+        return
+    }
+
+    requiredRole := models.WorkspaceOwner
+    if memberID == userID {
+        requiredRole = models.WorkspaceViewer
+    }
+    workspaceID, ok := authorizeWorkspace(w, r, requiredRole)
+    if !ok {
+        return
+    }
+
+    changeWorkspaceMember(w, r, workspaceID, memberID, "")
+}
+
+// changeWorkspaceMember sets a member's role, or removes them when role is
+// empty. The workspace row is locked so concurrent changes cannot remove the
+// last owner.
+func changeWorkspaceMember(w http.ResponseWriter, r *http.Request, workspaceID, memberID int, role string) {
+    tx, err := db.DB.Begin()
+    if err != nil {
+        log.Println("Error starting transaction:", err)
+        http.Error(w, "Error updating member", http.StatusInternalServerError)
+        return
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.Exec("SELECT id FROM workspaces WHERE id = $1 FOR UPDATE", workspaceID); err != nil {
+        log.Println("Error locking workspace:", err)
+        http.Error(w, "Error updating member", http.StatusInternalServerError)
+        return
+    }
+
+    var currentRole string
+    err = tx.QueryRow("SELECT role FROM workspace_members WHERE workspace_id = $1 AND user_id = $2", workspaceID, memberID).Scan(&currentRole)
+    if err == sql.ErrNoRows {
+        http.Error(w, "Member not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        log.Println("Error retrieving workspace member:", err)
+        http.Error(w, "Error updating member", http.StatusInternalServerError)
+        return
+    }
+
+    if currentRole == models.WorkspaceOwner && role != models.WorkspaceOwner {
+        var owners int
+        err := tx.QueryRow("SELECT COUNT(*) FROM workspace_members WHERE workspace_id = $1 AND role = $2", workspaceID, models.WorkspaceOwner).Scan(&owners)
+        if err != nil {
+            log.Println("Error counting workspace owners:", err)
+            http.Error(w, "Error updating member", http.StatusInternalServerError)
+            return
+        }
+        if owners <= 1 {
+            http.Error(w, "A workspace must keep at least one owner", http.StatusConflict)
+            return
+        }
+    }
+
+    if role == "" {
+        _, err = tx.Exec("DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2", workspaceID, memberID)
+    } else {
+        _, err = tx.Exec("UPDATE workspace_members SET role = $1 WHERE workspace_id = $2 AND user_id = $3", role, workspaceID, memberID)
+    }
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err != nil {
+        log.Println("Error updating workspace member:", err)
+        http.Error(w, "Error updating member", http.StatusInternalServerError)
+        return
+    }
+
+    if role == "" {
+        cache.InvalidateListings(r.Context(), memberID)
+        w.Write([]byte("Member removed successfully"))
+    } else {
+        w.Write([]byte("Member role updated successfully"))
+    }
+}
+
+// authorizeWorkspace parses the workspace ID from the URL and checks that the
+// caller holds at least the required role in it. Viewer is the lowest role,
+// so requiring it only checks membership. Non-members get a 404.
+func authorizeWorkspace(w http.ResponseWriter, r *http.Request, required string) (int, bool) {
+    userID := r.Context().Value("userID").(int)
+
+    workspaceID, err := strconv.Atoi(mux.Vars(r)["workspace_id"])
+    if err != nil {
+        http.Error(w, "Invalid workspace ID", http.StatusBadRequest)
+        return 0, false
+    }
+
+    role, err := workspaceRole(userID, workspaceID)
+    if err != nil {
+        log.Println("Error checking workspace membership:", err)
+        http.Error(w, "Error checking workspace membership", http.StatusInternalServerError)
+        return 0, false
+    }
+    if role == "" {
+        http.Error(w, "Workspace not found", http.StatusNotFound)
+        return 0, false
+    }
+
+    allowed := true
+    switch required {
+    case models.WorkspaceOwner:
+        allowed = role == models.WorkspaceOwner
+    case models.WorkspaceEditor:
+        allowed = models.CanEditWorkspace(role)
+    }
+    if !allowed {
+        http.Error(w, "Your workspace role does not allow this", http.StatusForbidden)
+        return 0, false
+    }
+    return workspaceID, true
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+    "trademarkia/internal/models"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/gorilla/mux"
+)
+
+func TestAuthorizeWorkspace(t *testing.T) {
+    tests := []struct {
+        role     string
+        required string
+        want     int
+    }{
+        {models.WorkspaceOwner, models.WorkspaceOwner, http.StatusOK},
+        {models.WorkspaceEditor, models.WorkspaceOwner, http.StatusForbidden},
+        {models.WorkspaceEditor, models.WorkspaceEditor, http.StatusOK},
+        {models.WorkspaceViewer, models.WorkspaceEditor, http.StatusForbidden},
+        {models.WorkspaceViewer, models.WorkspaceViewer, http.StatusOK},
+        // Non-members cannot tell the workspace exists
+        {"", models.WorkspaceViewer, http.StatusNotFound},
+    }
+
+    for _, test := range tests {
+        mock := mockDB(t)
+        rows := sqlmock.NewRows([]string{"role"})
+        if test.role != "" {
+            rows.AddRow(test.role)
+        }
+        mock.ExpectQuery("SELECT role FROM workspace_members").WithArgs(4, 1).WillReturnRows(rows)
+
+        r := mux.SetURLVars(httptest.NewRequest("GET", "/workspaces/4", nil), map[string]string{"workspace_id": "4"})
+        w := httptest.NewRecorder()
+        workspaceID, ok := authorizeWorkspace(w, asUser(r, 1, "user"), test.required)
+        if ok {
+            w.WriteHeader(http.StatusOK)
+        }
+        if w.Code != test.want || (ok && workspaceID != 4) {
+            t.Errorf("role %q requiring %q = %d, want %d", test.role, test.required, w.Code, test.want)
+        }
+    }
+}
+
+func TestWorkspaceKeepsItsLastOwner(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectBegin()
+    mock.ExpectExec("SELECT id FROM workspaces WHERE id = \\$1 FOR UPDATE").WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("SELECT role FROM workspace_members").WithArgs(4, 1).
+        WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(models.WorkspaceOwner))
+    mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM workspace_members").WithArgs(4, models.WorkspaceOwner).
+        WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+    mock.ExpectRollback()
+
+    w := httptest.NewRecorder()
+    changeWorkspaceMember(w, httptest.NewRequest("PUT", "/workspaces/4/members/1", nil), 4, 1, models.WorkspaceEditor)
+    if w.Code != http.StatusConflict {
+        t.Errorf("demoting the last owner = %d, want 409: %s", w.Code, w.Body)
+    }
+}
+
+func TestWorkspaceMemberCanLeave(t *testing.T) {
+    mock := mockDB(t)
+    // Leaving only requires membership
+    mock.ExpectQuery("SELECT role FROM workspace_members").WithArgs(4, 2).
+        WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(models.WorkspaceViewer))
+    mock.ExpectBegin()
+    mock.ExpectExec("SELECT id FROM workspaces WHERE id = \\$1 FOR UPDATE").WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectQuery("SELECT role FROM workspace_members").WithArgs(4, 2).
+        WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(models.WorkspaceViewer))
+    mock.ExpectExec("DELETE FROM workspace_members").WithArgs(4, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    r := mux.SetURLVars(httptest.NewRequest("DELETE", "/workspaces/4/members/2", nil), map[string]string{"workspace_id": "4", "user_id": "2"})
+    w := httptest.NewRecorder()
+    RemoveWorkspaceMember(w, asUser(r, 2, "user"))
+    if w.Code != http.StatusOK {
+        t.Errorf("leaving the workspace = %d, want 200: %s", w.Code, w.Body)
+    }
+}
+
+func TestViewerCannotRemoveOtherMembers(t *testing.T) {
+    mock := mockDB(t)
+    mock.ExpectQuery("SELECT role FROM workspace_members").WithArgs(4, 2).
+        WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(models.WorkspaceViewer))
+
+    r := mux.SetURLVars(httptest.NewRequest("DELETE", "/workspaces/4/members/3", nil), map[string]string{"workspace_id": "4", "user_id": "3"})
+    w := httptest.NewRecorder()
+    RemoveWorkspaceMember(w, asUser(r, 2, "user"))
+    if w.Code != http.StatusForbidden {
+        t.Errorf("viewer removing a member = %d, want 403: %s", w.Code, w.Body)
+    }
+}
+
+// expectFile answers the record lookup of fetchFile
+func expectFile(mock sqlmock.Sqlmock, fileID, ownerID int, workspaceID interface{}) {
+    mock.ExpectQuery("SELECT user_id, workspace_id, file_name, object_key, file_url, upload_date, file_size\\s+FROM files").WithArgs(fileID).
+        WillReturnRows(sqlmock.NewRows([]string{"user_id", "workspace_id", "file_name", "object_key", "file_url", "upload_date", "file_size"}).
+            AddRow(ownerID, workspaceID, "report.pdf", "report.pdf", nil, time.Now(), 10))
+}
+
+// expectAccess answers the file record lookup of fileAccess and its
+// membership and grant lookup, which the uploader of a personal file skips
+func expectAccess(mock sqlmock.Sqlmock, fileID, ownerID int, workspaceID, role, grant interface{}) {
+    expectFile(mock, fileID, ownerID, workspaceID)
+    mock.ExpectQuery("SELECT role FROM workspace_members WHERE workspace_id = \\$2").
+        WillReturnRows(sqlmock.NewRows([]string{"role", "permission"}).AddRow(role, grant))
+}
+
+func TestWorkspaceFileAccessFollowsTheMemberRole(t *testing.T) {
+    tests := []struct {
+        role string
+        want string
+    }{
+        {models.WorkspaceOwner, AccessManage},
+        {models.WorkspaceEditor, AccessManage},
+        {models.WorkspaceViewer, AccessView},
+    }
+
+    for _, test := range tests {
+        mock := mockDB(t)
+        expectAccess(mock, 9, 1, 4, test.role, nil)
+
+        _, access, err := fileAccess(context.Background(), 2, 9)
+        if err != nil || access != test.want {
+            t.Errorf("%s access = %q, %v, want %q", test.role, access, err, test.want)
+        }
+    }
+}
+
+func TestWorkspaceFilesAreHiddenFromNonMembers(t *testing.T) {
+    mock := mockDB(t)
+    expectAccess(mock, 9, 2, 4, nil, nil)
+
+    // Not even the uploader sees a workspace file once they left the workspace
+    if _, _, err := fileAccess(context.Background(), 2, 9); err != errFileNotFound {
+        t.Errorf("err = %v, want errFileNotFound", err)
+    }
+}
@@ -0,0 +1,101 @@
+package mail
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "net/smtp"
+    "regexp"
+    "strings"
+    "time"
+    "trademarkia/config"
+)
+
+// Message is a plain text email
+type Message struct {
+    To      string
+    Subject string
+    Body    string
+}
+
+// Mailer sends emails
+type Mailer interface {
+    Send(msg Message) error
+}
+
+// Default is the mailer used by the handlers
+var Default Mailer = LogMailer{}
+
+// Init configures Default from the SMTP_* environment variables. When
+// SMTP_HOST is not set, emails are written to the log instead.
+func Init() {
+    host := config.GetEnv("SMTP_HOST", "")
+    if host == "" {
+        log.Println("SMTP_HOST is not set, emails will be logged instead of sent")
+        Default = LogMailer{}
+        return
+    }
+
+    Default = &SMTPMailer{
+        Addr:     net.JoinHostPort(host, config.GetEnv("SMTP_PORT", "587")),
+        Username: config.GetEnv("SMTP_USERNAME", ""),
+        Password: config.GetEnv("SMTP_PASSWORD", ""),
+        From:     config.GetEnv("SMTP_FROM", "no-reply@trademarkia.local"),
+    }
+}
+
+// SMTPMailer delivers email through an SMTP relay. STARTTLS is used
+// whenever the server offers it.
+type SMTPMailer struct {
+    Addr     string
+    Username string
+    Password string
+    From     string
+}
+
+// Send delivers msg through the configured relay
+func (m *SMTPMailer) Send(msg Message) error {
+    if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+        return fmt.Errorf("invalid email header")
+    }
+
+    var auth smtp.Auth
+    if m.Username != "" {
+        host, _, err := net.SplitHostPort(m.Addr)
+        if err != nil {
+            return err
+        }
+        auth = smtp.PlainAuth("", m.Username, m.Password, host)
+    }
+
+    if err := smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, buildMessage(m.From, msg)); err != nil {
+        return fmt.Errorf("failed to send email to %s: %v", msg.To, err)
+    }
+    return nil
+}
+
+func buildMessage(from string, msg Message) []byte {
+    var b strings.Builder
+    b.WriteString("From: " + from + "\r\n")
+    b.WriteString("To: " + msg.To + "\r\n")
+    b.WriteString("Subject: " + msg.Subject + "\r\n")
+    b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+    b.WriteString("MIME-Version: 1.0\r\n")
+    b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+    b.WriteString("\r\n")
+    b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+    return []byte(b.String())
+}
+
+// LogMailer writes emails to the log, for local development
+type LogMailer struct{}
+
+// tokenParam matches the token of a verification, reset or confirmation link
+var tokenParam = regexp.MustCompile(`([?&]token=)[^&\s]+`)
+
+// Send logs msg. Link tokens are redacted, since anyone who can read the log
+// could otherwise reset the recipient's password.
+func (LogMailer) Send(msg Message) error {
+    log.Printf("Email to %s: %s\n%s", msg.To, msg.Subject, tokenParam.ReplaceAllString(msg.Body, "${1}REDACTED"))
+    return nil
+}
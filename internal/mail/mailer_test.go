@@ -0,0 +1,95 @@
+package mail
+
+import (
+    "log"
+    "net"
+    "net/textproto"
+    "os"
+    "strings"
+    "testing"
+)
+
+// fakeSMTPServer accepts a single SMTP session and returns the DATA it received
+func fakeSMTPServer(t *testing.T) (string, <-chan string) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("Failed to start fake SMTP server: %v", err)
+    }
+
+    received := make(chan string, 1)
+    go func() {
+        defer listener.Close()
+        conn, err := listener.Accept()
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+
+        text := textproto.NewConn(conn)
+        text.PrintfLine("220 fake.smtp ESMTP")
+        for {
+            line, err := text.ReadLine()
+            if err != nil {
+                return
+            }
+            switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+            case "EHLO", "HELO":
+                text.PrintfLine("250 fake.smtp")
+            case "MAIL", "RCPT", "RSET", "NOOP":
+                text.PrintfLine("250 OK")
+            case "DATA":
+                text.PrintfLine("354 Go ahead")
+                data, err := text.ReadDotLines()
+                if err != nil {
+                    return
+                }
+                received <- strings.Join(data, "\n")
+                text.PrintfLine("250 Queued")
+            case "QUIT":
+                text.PrintfLine("221 Bye")
+                return
+            default:
+                text.PrintfLine("502 Not implemented")
+            }
+        }
+    }()
+
+    return listener.Addr().String(), received
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+    addr, received := fakeSMTPServer(t)
+
+    mailer := &SMTPMailer{Addr: addr, From: "no-reply@example.com"}
+    err := mailer.Send(Message{To: "user@example.com", Subject: "Verify your email", Body: "Click the link\nThanks"})
+    if err != nil {
+        t.Fatalf("Send returned error: %v", err)
+    }
+
+    data := <-received
+    for _, want := range []string{"To: user@example.com", "Subject: Verify your email", "Click the link"} {
+        if !strings.Contains(data, want) {
+            t.Errorf("Message is missing %q, got:\n%s", want, data)
+        }
+    }
+}
+
+func TestSMTPMailerRejectsHeaderInjection(t *testing.T) {
+    mailer := &SMTPMailer{Addr: "127.0.0.1:1", From: "no-reply@example.com"}
+    err := mailer.Send(Message{To: "user@example.com\r\nBcc: victim@example.com", Subject: "Hi"})
+    if err == nil {
+        t.Error("Expected an error for a recipient containing CRLF")
+    }
+}
+
+func TestLogMailerRedactsTokens(t *testing.T) {
+    var out strings.Builder
+    log.SetOutput(&out)
+    defer log.SetOutput(os.Stderr)
+
+    LogMailer{}.Send(Message{To: "user@example.com", Subject: "Reset your password",
+        Body: "Open http://localhost:8080/password/reset?token=eyJhbGciOi.secret-part to continue"})
+    if strings.Contains(out.String(), "secret-part") || !strings.Contains(out.String(), "/password/reset?token=REDACTED to continue") {
+        t.Errorf("Logged email leaks the token:\n%s", out.String())
+    }
+}
@@ -2,15 +2,18 @@ package middlewares
 
 import (
     "context"
+    "database/sql"
+    "log"
     "net/http"
     "strings"
+    "trademarkia/internal/auth"
+    "trademarkia/internal/db"
     "trademarkia/internal/handlers"
-    "github.com/dgrijalva/jwt-go"
+    "trademarkia/internal/utils"
 )
 
-var jwtKey = []byte("my_secret_key")
-
-// JWTMiddleware authenticates requests and extracts user information
+// JWTMiddleware authenticates requests and extracts user information.
+// It accepts either "Bearer <jwt>" or "ApiKey <key>" in the Authorization header.
 func JWTMiddleware(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         // Extract token from Authorization header
@@ -20,6 +23,11 @@ func JWTMiddleware(next http.Handler) http.Handler {
             return
         }
 
+        if strings.HasPrefix(tokenString, "ApiKey ") {
+            authenticateAPIKey(w, r, next, strings.TrimPrefix(tokenString, "ApiKey "))
+            return
+        }
+
         // Ensure the token starts with "Bearer "
         if !strings.HasPrefix(tokenString, "Bearer ") {
             http.Error(w, "Invalid token format", http.StatusUnauthorized)
@@ -29,17 +37,118 @@ func JWTMiddleware(next http.Handler) http.Handler {
         tokenString = strings.TrimPrefix(tokenString, "Bearer ")
 
         claims := &handlers.Claims{}
-        token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-            return jwtKey, nil
-        })
-
-        if err != nil || !token.Valid {
+        err := auth.Keys.Parse(tokenString, claims)
+        if err != nil || claims.Purpose != "" {
             http.Error(w, "Invalid token", http.StatusUnauthorized)
             return
         }
 
-        // Add user_id to context for further use
+        // Every access token belongs to a session. The session state, role and
+        // disabled flag are read from the database rather than the claims, so
+        // revocations, demotions and disabled accounts take effect immediately.
+        var role, plan string
+        var disabled, revoked bool
+        err = db.DB.QueryRow(`SELECT u.role, u.plan, u.disabled, s.revoked_at IS NOT NULL
+            FROM sessions s JOIN users u ON u.id = s.user_id
+            WHERE s.id = $1 AND s.user_id = $2`, claims.Id, claims.UserID).Scan(&role, &plan, &disabled, &revoked)
+        if err == sql.ErrNoRows || (err == nil && revoked) {
+            http.Error(w, "Session expired or revoked, please log in again", http.StatusUnauthorized)
+            return
+        }
+        if err == nil && disabled {
+            http.Error(w, "Account disabled", http.StatusUnauthorized)
+            return
+        }
+        if err != nil {
+            log.Println("Error looking up session:", err)
+            http.Error(w, "Error verifying token", http.StatusInternalServerError)
+            return
+        }
+
+        // Only touch the session once a minute to keep writes down
+        _, err = db.DB.Exec("UPDATE sessions SET last_used_at = NOW(), ip = $2 WHERE id = $1 AND last_used_at < NOW() - INTERVAL '1 minute'",
+            claims.Id, utils.ClientIP(r))
+        if err != nil {
+            log.Println("Error updating session:", err)
+        }
+
+        // Add user_id, role, plan and session to context for further use
         ctx := context.WithValue(r.Context(), "userID", claims.UserID)
+        ctx = context.WithValue(ctx, "role", role)
+        ctx = context.WithValue(ctx, "plan", plan)
+        ctx = context.WithValue(ctx, "sessionID", claims.Id)
         next.ServeHTTP(w, r.WithContext(ctx))
     })
 }
+
+// authenticateAPIKey resolves an API key to its owner and scopes
+func authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, key string) {
+    prefix, ok := auth.APIKeyPrefix(key)
+    if !ok {
+        http.Error(w, "Invalid API key", http.StatusUnauthorized)
+        return
+    }
+
+    var keyID, userID int
+    var keyHash, scopes, role, plan string
+    var disabled bool
+    err := db.DB.QueryRow(`SELECT k.id, k.user_id, k.key_hash, k.scopes, u.role, u.plan, u.disabled
+        FROM api_keys k JOIN users u ON u.id = k.user_id
+        WHERE k.prefix = $1 AND k.revoked_at IS NULL`, prefix).Scan(&keyID, &userID, &keyHash, &scopes, &role, &plan, &disabled)
+    if err == sql.ErrNoRows || (err == nil && (disabled || !auth.CheckAPIKeyHash(key, keyHash))) {
+        http.Error(w, "Invalid API key", http.StatusUnauthorized)
+        return
+    }
+    if err != nil {
+        log.Println("Error looking up API key:", err)
+        http.Error(w, "Error verifying API key", http.StatusInternalServerError)
+        return
+    }
+
+    if _, err := db.DB.Exec("UPDATE api_keys SET last_used_at = NOW() WHERE id = $1", keyID); err != nil {
+        log.Println("Error updating API key usage:", err)
+    }
+
+    // Add user_id, role, plan and the key's scopes to context, same as for a JWT
+    ctx := context.WithValue(r.Context(), "userID", userID)
+    ctx = context.WithValue(ctx, "role", role)
+    ctx = context.WithValue(ctx, "plan", plan)
+    ctx = context.WithValue(ctx, "scopes", strings.Split(scopes, ","))
+    next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// RequireScope rejects API key requests whose key was not granted scope.
+// Requests authenticated with a JWT carry no scope restriction.
+func RequireScope(scope string, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        scopes, restricted := r.Context().Value("scopes").([]string)
+        if restricted && !hasScope(scopes, scope) {
+            http.Error(w, "API key lacks the required scope: "+scope, http.StatusForbidden)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// RequireRole rejects requests from users that hold none of the given roles
+func RequireRole(roles []string, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        role, _ := r.Context().Value("role").(string)
+        for _, allowed := range roles {
+            if role == allowed {
+                next.ServeHTTP(w, r)
+                return
+            }
+        }
+        http.Error(w, "Insufficient permissions", http.StatusForbidden)
+    })
+}
+
+func hasScope(scopes []string, scope string) bool {
+    for _, s := range scopes {
+        if s == scope {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,189 @@
+package middlewares
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+    "trademarkia/internal/auth"
+    "trademarkia/internal/db"
+    "trademarkia/internal/handlers"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/dgrijalva/jwt-go"
+)
+
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+    t.Helper()
+    conn, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatal(err)
+    }
+    previous := db.DB
+    db.DB = conn
+    t.Cleanup(func() {
+        if err := mock.ExpectationsWereMet(); err != nil {
+            t.Error(err)
+        }
+        db.DB = previous
+        conn.Close()
+    })
+    return mock
+}
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func TestAPIKeyScopesAreEnforced(t *testing.T) {
+    key, prefix, hash, err := auth.GenerateAPIKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    columns := []string{"id", "user_id", "key_hash", "scopes", "role", "plan", "disabled"}
+
+    tests := []struct {
+        name   string
+        key    string
+        scope  string
+        rows   *sqlmock.Rows
+        want   int
+        onUsed bool
+    }{
+        {"granted scope", key, auth.ScopeRead, sqlmock.NewRows(columns).AddRow(3, 1, hash, "read,share", "user", "free", false), http.StatusOK, true},
+        {"missing scope", key, auth.ScopeUpload, sqlmock.NewRows(columns).AddRow(3, 1, hash, "read,share", "user", "free", false), http.StatusForbidden, true},
+        {"admin scope is never granted", key, auth.ScopeAdmin, sqlmock.NewRows(columns).AddRow(3, 1, hash, "read", "admin", "free", false), http.StatusForbidden, true},
+        {"wrong secret", "tmk_" + prefix + "_wrong", auth.ScopeRead, sqlmock.NewRows(columns).AddRow(3, 1, hash, "read", "user", "free", false), http.StatusUnauthorized, false},
+        {"revoked key", key, auth.ScopeRead, sqlmock.NewRows(columns), http.StatusUnauthorized, false},
+        {"disabled owner", key, auth.ScopeRead, sqlmock.NewRows(columns).AddRow(3, 1, hash, "read", "user", "free", true), http.StatusUnauthorized, false},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            mock := mockDB(t)
+            mock.ExpectQuery("FROM api_keys k JOIN users u").WithArgs(prefix).WillReturnRows(test.rows)
+            if test.onUsed {
+                mock.ExpectExec("UPDATE api_keys SET last_used_at").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+            }
+
+            r := httptest.NewRequest("GET", "/files", nil)
+            r.Header.Set("Authorization", "ApiKey "+test.key)
+            w := httptest.NewRecorder()
+            JWTMiddleware(RequireScope(test.scope, ok)).ServeHTTP(w, r)
+            if w.Code != test.want {
+                t.Errorf("status = %d, want %d: %s", w.Code, test.want, w.Body)
+            }
+        })
+    }
+}
+
+func TestMalformedAPIKeyIsRejectedWithoutLookup(t *testing.T) {
+    mockDB(t)
+    r := httptest.NewRequest("GET", "/files", nil)
+    r.Header.Set("Authorization", "ApiKey not-a-key")
+    w := httptest.NewRecorder()
+    JWTMiddleware(ok).ServeHTTP(w, r)
+    if w.Code != http.StatusUnauthorized {
+        t.Errorf("status = %d, want 401", w.Code)
+    }
+}
+
+func TestRequireRole(t *testing.T) {
+    staff := []string{auth.RoleAdmin, auth.RoleAuditor}
+    tests := []struct {
+        role string
+        want int
+    }{
+        {auth.RoleAdmin, http.StatusOK},
+        {auth.RoleAuditor, http.StatusOK},
+        {auth.RoleUser, http.StatusForbidden},
+        {"", http.StatusForbidden},
+    }
+
+    for _, test := range tests {
+        r := httptest.NewRequest("GET", "/admin/users", nil)
+        if test.role != "" {
+            r = r.WithContext(context.WithValue(r.Context(), "role", test.role))
+        }
+        w := httptest.NewRecorder()
+        RequireRole(staff, ok).ServeHTTP(w, r)
+        if w.Code != test.want {
+            t.Errorf("RequireRole with role %q = %d, want %d", test.role, w.Code, test.want)
+        }
+    }
+}
+
+// signToken signs claims for session sessionID with a throwaway key set
+func signToken(t *testing.T, sessionID, purpose string) string {
+    t.Helper()
+    previous := auth.Keys
+    auth.Keys = auth.NewKeySet()
+    t.Cleanup(func() { auth.Keys = previous })
+    if err := auth.Keys.AddHMAC("test", []byte("test-secret")); err != nil {
+        t.Fatal(err)
+    }
+    if err := auth.Keys.SetActive("test"); err != nil {
+        t.Fatal(err)
+    }
+
+    token, err := auth.Keys.Sign(&handlers.Claims{
+        UserID:         1,
+        Purpose:        purpose,
+        StandardClaims: jwt.StandardClaims{Id: sessionID, ExpiresAt: time.Now().Add(time.Hour).Unix()},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return token
+}
+
+func TestJWTIsCheckedAgainstItsSession(t *testing.T) {
+    columns := []string{"role", "plan", "disabled", "revoked"}
+    tests := []struct {
+        name    string
+        rows    *sqlmock.Rows
+        want    int
+        touched bool
+    }{
+        {"active session", sqlmock.NewRows(columns).AddRow("user", "free", false, false), http.StatusOK, true},
+        {"revoked session", sqlmock.NewRows(columns).AddRow("user", "free", false, true), http.StatusUnauthorized, false},
+        {"unknown session", sqlmock.NewRows(columns), http.StatusUnauthorized, false},
+        {"disabled account", sqlmock.NewRows(columns).AddRow("user", "free", true, false), http.StatusUnauthorized, false},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            token := signToken(t, "session-1", "")
+            mock := mockDB(t)
+            mock.ExpectQuery("FROM sessions s JOIN users u").WithArgs("session-1", 1).WillReturnRows(test.rows)
+            if test.touched {
+                mock.ExpectExec("UPDATE sessions SET last_used_at").WillReturnResult(sqlmock.NewResult(0, 1))
+            }
+
+            var sessionID interface{}
+            next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { sessionID = r.Context().Value("sessionID") })
+            r := httptest.NewRequest("GET", "/files", nil)
+            r.Header.Set("Authorization", "Bearer "+token)
+            w := httptest.NewRecorder()
+            JWTMiddleware(next).ServeHTTP(w, r)
+            if w.Code != test.want {
+                t.Errorf("status = %d, want %d: %s", w.Code, test.want, w.Body)
+            }
+            if test.want == http.StatusOK && sessionID != "session-1" {
+                t.Errorf("sessionID in context = %v, want session-1", sessionID)
+            }
+        })
+    }
+}
+
+func TestSingleUseTokensAreNotAccessTokens(t *testing.T) {
+    token := signToken(t, "", handlers.PurposePasswordReset)
+    mockDB(t)
+
+    r := httptest.NewRequest("GET", "/files", nil)
+    r.Header.Set("Authorization", "Bearer "+token)
+    w := httptest.NewRecorder()
+    JWTMiddleware(ok).ServeHTTP(w, r)
+    if w.Code != http.StatusUnauthorized {
+        t.Errorf("status = %d, want 401", w.Code)
+    }
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// File is the metadata of an uploaded file. WorkspaceID is nil for personal
+// files. ObjectKey is the file's S3 key, which stays the same when the file
+// is renamed.
+type File struct {
+    ID          int       `json:"file_id"`
+    UserID      int       `json:"user_id"`
+    WorkspaceID *int64    `json:"workspace_id,omitempty"`
+    FileName    string    `json:"file_name"`
+    ObjectKey   string    `json:"-"`
+    FileURL     string    `json:"file_url"`
+    UploadDate  time.Time `json:"upload_date"`
+    FileSize    int64     `json:"file_size"`
+}
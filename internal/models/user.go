@@ -0,0 +1,88 @@
+package models
+
+import (
+    "errors"
+    "net/mail"
+    "regexp"
+    "strings"
+    "time"
+    "unicode"
+)
+
+// User is a registered account as returned by the profile endpoints.
+// The password hash and TOTP secret never leave the server.
+type User struct {
+    ID               int       `json:"id"`
+    Username         *string   `json:"username"`
+    Email            string    `json:"email"`
+    EmailVerified    bool      `json:"email_verified"`
+    PendingEmail     *string   `json:"pending_email,omitempty"`
+    Role             string    `json:"role"`
+    Plan             string    `json:"plan"`
+    TwoFactorEnabled bool      `json:"two_factor_enabled"`
+    CreatedAt        time.Time `json:"created_at"`
+    UpdatedAt        time.Time `json:"updated_at"`
+}
+
+const (
+    minPasswordLength = 8
+    // bcrypt ignores everything after the first 72 bytes
+    maxPasswordLength = 72
+    maxEmailLength    = 254
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,32}$`)
+
+// NormalizeEmail trims and lowercases an address, the form in which emails
+// are stored and looked up
+func NormalizeEmail(email string) string {
+    return strings.ToLower(strings.TrimSpace(email))
+}
+
+// ValidateEmail checks that email is a bare address such as user@example.com
+func ValidateEmail(email string) error {
+    if email == "" {
+        return errors.New("email is required")
+    }
+    if len(email) > maxEmailLength {
+        return errors.New("email is too long")
+    }
+    addr, err := mail.ParseAddress(email)
+    if err != nil || addr.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+        return errors.New("email is not a valid address")
+    }
+    return nil
+}
+
+// ValidatePassword enforces the password policy: 8 to 72 characters
+// containing at least one letter and one digit
+func ValidatePassword(password string) error {
+    if len(password) < minPasswordLength {
+        return errors.New("password must be at least 8 characters long")
+    }
+    if len(password) > maxPasswordLength {
+        return errors.New("password must be at most 72 bytes long")
+    }
+
+    var hasLetter, hasDigit bool
+    for _, c := range password {
+        switch {
+        case unicode.IsLetter(c):
+            hasLetter = true
+        case unicode.IsDigit(c):
+            hasDigit = true
+        }
+    }
+    if !hasLetter || !hasDigit {
+        return errors.New("password must contain at least one letter and one digit")
+    }
+    return nil
+}
+
+// ValidateUsername allows 3 to 32 letters, digits, dots, dashes and underscores
+func ValidateUsername(username string) error {
+    if !usernamePattern.MatchString(username) {
+        return errors.New("username must be 3 to 32 characters of letters, digits, '.', '-' or '_'")
+    }
+    return nil
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+    "errors"
+    "strings"
+    "time"
+)
+
+// Roles a member can hold in a workspace
+const (
+    WorkspaceOwner  = "owner"
+    WorkspaceEditor = "editor"
+    WorkspaceViewer = "viewer"
+)
+
+const maxWorkspaceNameLength = 100
+
+// Workspace is a shared space whose files are visible to all of its members
+type Workspace struct {
+    ID        int       `json:"workspace_id"`
+    Name      string    `json:"name"`
+    Role      string    `json:"role,omitempty"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// WorkspaceMember is a user's membership in a workspace
+type WorkspaceMember struct {
+    UserID    int       `json:"user_id"`
+    Email     string    `json:"email"`
+    Role      string    `json:"role"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// ValidWorkspaceRole reports whether role is a known workspace role
+func ValidWorkspaceRole(role string) bool {
+    return role == WorkspaceOwner || role == WorkspaceEditor || role == WorkspaceViewer
+}
+
+// CanEditWorkspace reports whether the role may upload, rename and share files
+func CanEditWorkspace(role string) bool {
+    return role == WorkspaceOwner || role == WorkspaceEditor
+}
+
+// ValidateWorkspaceName requires a non-blank name of at most 100 characters
+func ValidateWorkspaceName(name string) error {
+    if strings.TrimSpace(name) == "" {
+        return errors.New("workspace name is required")
+    }
+    if len(name) > maxWorkspaceNameLength {
+        return errors.New("workspace name must be at most 100 characters long")
+    }
+    return nil
+}
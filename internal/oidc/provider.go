@@ -0,0 +1,353 @@
+package oidc
+
+import (
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math/big"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+    "trademarkia/config"
+
+    "github.com/dgrijalva/jwt-go"
+)
+
+// Default is the configured identity provider, nil when SSO is disabled
+var Default *Provider
+
+// jwksRefreshInterval is the minimum time between JWKS fetches, so tokens
+// with an unknown kid cannot make every request hit the provider
+var jwksRefreshInterval = time.Minute
+
+// Provider is an OpenID Connect identity provider used with the
+// authorization code flow and PKCE
+type Provider struct {
+    Issuer       string
+    ClientID     string
+    ClientSecret string
+    RedirectURL  string
+    Scopes       []string
+
+    authorizationEndpoint string
+    tokenEndpoint         string
+    jwksURI               string
+
+    client *http.Client
+
+    mu          sync.Mutex
+    keys        map[string]*rsa.PublicKey
+    keysFetched time.Time
+}
+
+type discoveryDocument struct {
+    Issuer                string `json:"issuer"`
+    AuthorizationEndpoint string `json:"authorization_endpoint"`
+    TokenEndpoint         string `json:"token_endpoint"`
+    JWKSURI               string `json:"jwks_uri"`
+}
+
+// Init configures Default from the OIDC_* environment variables. SSO stays
+// disabled when OIDC_ISSUER is not set.
+func Init() error {
+    issuer := config.GetEnv("OIDC_ISSUER", "")
+    if issuer == "" {
+        return nil
+    }
+
+    provider, err := NewProvider(issuer,
+        config.GetEnv("OIDC_CLIENT_ID", ""),
+        config.GetEnv("OIDC_CLIENT_SECRET", ""),
+        config.GetEnv("OIDC_REDIRECT_URL", config.GetEnv("APP_BASE_URL", "http://localhost:8080")+"/oidc/callback"))
+    if err != nil {
+        return err
+    }
+
+    Default = provider
+    return nil
+}
+
+// NewProvider loads the provider's discovery document from
+// <issuer>/.well-known/openid-configuration
+func NewProvider(issuer, clientID, clientSecret, redirectURL string) (*Provider, error) {
+    if clientID == "" {
+        return nil, errors.New("OIDC client ID is required")
+    }
+
+    p := &Provider{
+        Issuer:       strings.TrimSuffix(issuer, "/"),
+        ClientID:     clientID,
+        ClientSecret: clientSecret,
+        RedirectURL:  redirectURL,
+        Scopes:       []string{"openid", "email", "profile"},
+        client:       &http.Client{Timeout: 10 * time.Second},
+    }
+
+    var doc discoveryDocument
+    if err := p.getJSON(p.Issuer+"/.well-known/openid-configuration", &doc); err != nil {
+        return nil, fmt.Errorf("OIDC discovery failed: %v", err)
+    }
+    if strings.TrimSuffix(doc.Issuer, "/") != p.Issuer {
+        return nil, fmt.Errorf("OIDC discovery returned issuer %q, expected %q", doc.Issuer, p.Issuer)
+    }
+    if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+        return nil, errors.New("OIDC discovery document is missing required endpoints")
+    }
+
+    p.authorizationEndpoint = doc.AuthorizationEndpoint
+    p.tokenEndpoint = doc.TokenEndpoint
+    p.jwksURI = doc.JWKSURI
+    return p, nil
+}
+
+func (p *Provider) getJSON(u string, v interface{}) error {
+    resp, err := p.client.Get(u)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("GET %s returned %s", u, resp.Status)
+    }
+    return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// RandomString returns a URL-safe random string for state, nonce and PKCE verifiers
+func RandomString() (string, error) {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge derives the S256 PKCE challenge from a verifier
+func CodeChallenge(verifier string) string {
+    sum := sha256.Sum256([]byte(verifier))
+    return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the URL to redirect the user to for authentication
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) string {
+    params := url.Values{}
+    params.Set("response_type", "code")
+    params.Set("client_id", p.ClientID)
+    params.Set("redirect_uri", p.RedirectURL)
+    params.Set("scope", strings.Join(p.Scopes, " "))
+    params.Set("state", state)
+    params.Set("nonce", nonce)
+    params.Set("code_challenge", CodeChallenge(verifier))
+    params.Set("code_challenge_method", "S256")
+
+    separator := "?"
+    if strings.Contains(p.authorizationEndpoint, "?") {
+        separator = "&"
+    }
+    return p.authorizationEndpoint + separator + params.Encode()
+}
+
+type tokenResponse struct {
+    IDToken          string `json:"id_token"`
+    Error            string `json:"error"`
+    ErrorDescription string `json:"error_description"`
+}
+
+// Exchange redeems an authorization code and returns the raw ID token
+func (p *Provider) Exchange(code, verifier string) (string, error) {
+    form := url.Values{}
+    form.Set("grant_type", "authorization_code")
+    form.Set("code", code)
+    form.Set("redirect_uri", p.RedirectURL)
+    form.Set("code_verifier", verifier)
+    form.Set("client_id", p.ClientID)
+
+    req, err := http.NewRequest("POST", p.tokenEndpoint, strings.NewReader(form.Encode()))
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.Header.Set("Accept", "application/json")
+    if p.ClientSecret != "" {
+        req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+    }
+
+    resp, err := p.client.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+
+    var token tokenResponse
+    if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+        return "", fmt.Errorf("decoding token response: %v", err)
+    }
+    if resp.StatusCode != http.StatusOK || token.Error != "" {
+        return "", fmt.Errorf("token endpoint returned %s: %s %s", resp.Status, token.Error, token.ErrorDescription)
+    }
+    if token.IDToken == "" {
+        return "", errors.New("token response did not include an id_token")
+    }
+    return token.IDToken, nil
+}
+
+// audience accepts both forms of the aud claim, a string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+    var single string
+    if err := json.Unmarshal(data, &single); err == nil {
+        *a = audience{single}
+        return nil
+    }
+    var multiple []string
+    if err := json.Unmarshal(data, &multiple); err != nil {
+        return err
+    }
+    *a = multiple
+    return nil
+}
+
+func (a audience) contains(value string) bool {
+    for _, v := range a {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
+
+// IDToken holds the validated claims of an ID token
+type IDToken struct {
+    Issuer          string   `json:"iss"`
+    Subject         string   `json:"sub"`
+    Audience        audience `json:"aud"`
+    AuthorizedParty string   `json:"azp"`
+    ExpiresAt       int64    `json:"exp"`
+    IssuedAt        int64    `json:"iat"`
+    Nonce           string   `json:"nonce"`
+    Email           string   `json:"email"`
+    EmailVerified   bool     `json:"email_verified"`
+    Name            string   `json:"name"`
+}
+
+// allowed clock skew between us and the provider
+const clockSkew = time.Minute
+
+// Valid implements jwt.Claims; the issuer, audience and nonce are checked in VerifyIDToken
+func (t *IDToken) Valid() error {
+    now := time.Now()
+    if t.ExpiresAt == 0 || now.After(time.Unix(t.ExpiresAt, 0).Add(clockSkew)) {
+        return errors.New("ID token is expired")
+    }
+    if t.IssuedAt != 0 && now.Add(clockSkew).Before(time.Unix(t.IssuedAt, 0)) {
+        return errors.New("ID token was issued in the future")
+    }
+    return nil
+}
+
+// VerifyIDToken checks the ID token signature against the provider's JWKS
+// and validates the issuer, audience, expiry and nonce
+func (p *Provider) VerifyIDToken(raw, nonce string) (*IDToken, error) {
+    claims := &IDToken{}
+    parser := &jwt.Parser{ValidMethods: []string{"RS256"}}
+    if _, err := parser.ParseWithClaims(raw, claims, p.keyfunc); err != nil {
+        return nil, fmt.Errorf("invalid ID token: %v", err)
+    }
+
+    if strings.TrimSuffix(claims.Issuer, "/") != p.Issuer {
+        return nil, fmt.Errorf("ID token issuer %q does not match %q", claims.Issuer, p.Issuer)
+    }
+    if !claims.Audience.contains(p.ClientID) {
+        return nil, errors.New("ID token audience does not include this client")
+    }
+    if len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID {
+        return nil, errors.New("ID token azp does not match this client")
+    }
+    if claims.Nonce == "" || claims.Nonce != nonce {
+        return nil, errors.New("ID token nonce does not match")
+    }
+    if claims.Subject == "" {
+        return nil, errors.New("ID token has no subject")
+    }
+    return claims, nil
+}
+
+// keyfunc looks up the token's kid in the provider JWKS, refetching it once
+// when the kid is unknown so provider key rotation is picked up. The JWKS is
+// fetched at most once per jwksRefreshInterval.
+func (p *Provider) keyfunc(token *jwt.Token) (interface{}, error) {
+    kid, _ := token.Header["kid"].(string)
+
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    if key, ok := p.lookupKey(kid); ok {
+        return key, nil
+    }
+    if !p.keysFetched.IsZero() && time.Since(p.keysFetched) < jwksRefreshInterval {
+        return nil, fmt.Errorf("no provider key found for kid %q", kid)
+    }
+    if err := p.refreshKeys(); err != nil {
+        return nil, err
+    }
+    if key, ok := p.lookupKey(kid); ok {
+        return key, nil
+    }
+    return nil, fmt.Errorf("no provider key found for kid %q", kid)
+}
+
+func (p *Provider) lookupKey(kid string) (*rsa.PublicKey, bool) {
+    if kid == "" && len(p.keys) == 1 {
+        for _, key := range p.keys {
+            return key, true
+        }
+    }
+    key, ok := p.keys[kid]
+    return key, ok
+}
+
+type jsonWebKey struct {
+    KeyType string `json:"kty"`
+    KeyID   string `json:"kid"`
+    Use     string `json:"use"`
+    N       string `json:"n"`
+    E       string `json:"e"`
+}
+
+func (p *Provider) refreshKeys() error {
+    var set struct {
+        Keys []jsonWebKey `json:"keys"`
+    }
+    // Failed fetches count too, so an unreachable provider is not retried
+    // on every request
+    p.keysFetched = time.Now()
+    if err := p.getJSON(p.jwksURI, &set); err != nil {
+        return fmt.Errorf("fetching provider JWKS: %v", err)
+    }
+
+    keys := make(map[string]*rsa.PublicKey)
+    for _, jwk := range set.Keys {
+        if jwk.KeyType != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+            continue
+        }
+        n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+        if err != nil {
+            continue
+        }
+        e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+        if err != nil {
+            continue
+        }
+        keys[jwk.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+    }
+
+    p.keys = keys
+    return nil
+}
@@ -0,0 +1,195 @@
+package oidc
+
+import (
+    "crypto/rand"
+    "crypto/rsa"
+    "encoding/base64"
+    "encoding/json"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/dgrijalva/jwt-go"
+)
+
+// mockIdP is a minimal OpenID provider that issues an ID token for a single
+// authorization code, checking the PKCE verifier on redemption
+type mockIdP struct {
+    server    *httptest.Server
+    key       *rsa.PrivateKey
+    challenge string
+    nonce     string
+    fetches   int32
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatalf("Failed to generate IdP key: %v", err)
+    }
+
+    idp := &mockIdP{key: key}
+    mux := http.NewServeMux()
+
+    mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(map[string]string{
+            "issuer":                 idp.server.URL,
+            "authorization_endpoint": idp.server.URL + "/authorize",
+            "token_endpoint":         idp.server.URL + "/token",
+            "jwks_uri":               idp.server.URL + "/jwks",
+        })
+    })
+
+    mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt32(&idp.fetches, 1)
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "keys": []map[string]string{{
+                "kty": "RSA",
+                "kid": "idp-key",
+                "use": "sig",
+                "n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+                "e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+            }},
+        })
+    })
+
+    mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+        r.ParseForm()
+        if r.Form.Get("code") != "good-code" || CodeChallenge(r.Form.Get("code_verifier")) != idp.challenge {
+            w.WriteHeader(http.StatusBadRequest)
+            json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+            return
+        }
+
+        token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+            "iss":            idp.server.URL,
+            "sub":            "user-123",
+            "aud":            []string{"test-client"},
+            "exp":            time.Now().Add(time.Minute).Unix(),
+            "iat":            time.Now().Unix(),
+            "nonce":          idp.nonce,
+            "email":          "sso@example.com",
+            "email_verified": true,
+        })
+        token.Header["kid"] = "idp-key"
+        signed, _ := token.SignedString(key)
+        json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+    })
+
+    idp.server = httptest.NewServer(mux)
+    t.Cleanup(idp.server.Close)
+    return idp
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+    idp := newMockIdP(t)
+
+    provider, err := NewProvider(idp.server.URL, "test-client", "secret", "http://localhost:8080/oidc/callback")
+    if err != nil {
+        t.Fatalf("NewProvider returned error: %v", err)
+    }
+
+    state, _ := RandomString()
+    nonce, _ := RandomString()
+    verifier, _ := RandomString()
+
+    authURL, err := url.Parse(provider.AuthCodeURL(state, nonce, verifier))
+    if err != nil {
+        t.Fatal(err)
+    }
+    query := authURL.Query()
+    if query.Get("state") != state || query.Get("code_challenge_method") != "S256" {
+        t.Errorf("Unexpected authorization URL: %s", authURL)
+    }
+
+    // The IdP remembers what it was sent on the authorization request
+    idp.challenge = query.Get("code_challenge")
+    idp.nonce = query.Get("nonce")
+
+    if _, err := provider.Exchange("good-code", "wrong-verifier"); err == nil {
+        t.Error("Exchange succeeded with the wrong PKCE verifier")
+    }
+
+    rawIDToken, err := provider.Exchange("good-code", verifier)
+    if err != nil {
+        t.Fatalf("Exchange returned error: %v", err)
+    }
+
+    idToken, err := provider.VerifyIDToken(rawIDToken, nonce)
+    if err != nil {
+        t.Fatalf("VerifyIDToken returned error: %v", err)
+    }
+    if idToken.Subject != "user-123" || idToken.Email != "sso@example.com" || !idToken.EmailVerified {
+        t.Errorf("Unexpected ID token claims: %+v", idToken)
+    }
+
+    if _, err := provider.VerifyIDToken(rawIDToken, "other-nonce"); err == nil {
+        t.Error("VerifyIDToken accepted a token with the wrong nonce")
+    }
+}
+
+func TestVerifyIDTokenRejectsForeignSignature(t *testing.T) {
+    idp := newMockIdP(t)
+
+    provider, err := NewProvider(idp.server.URL, "test-client", "", "http://localhost:8080/oidc/callback")
+    if err != nil {
+        t.Fatalf("NewProvider returned error: %v", err)
+    }
+
+    otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+        "iss":   idp.server.URL,
+        "sub":   "attacker",
+        "aud":   "test-client",
+        "exp":   time.Now().Add(time.Minute).Unix(),
+        "nonce": "n",
+    })
+    token.Header["kid"] = "idp-key"
+    forged, _ := token.SignedString(otherKey)
+
+    if _, err := provider.VerifyIDToken(forged, "n"); err == nil {
+        t.Error("VerifyIDToken accepted a token signed with a foreign key")
+    }
+}
+
+func TestUnknownKidRefetchesJWKSAtMostOncePerInterval(t *testing.T) {
+    idp := newMockIdP(t)
+
+    provider, err := NewProvider(idp.server.URL, "test-client", "", "http://localhost:8080/oidc/callback")
+    if err != nil {
+        t.Fatalf("NewProvider returned error: %v", err)
+    }
+
+    token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+        "iss":   idp.server.URL,
+        "sub":   "user-123",
+        "aud":   "test-client",
+        "exp":   time.Now().Add(time.Minute).Unix(),
+        "nonce": "n",
+    })
+    token.Header["kid"] = "rotated-key"
+    raw, _ := token.SignedString(idp.key)
+
+    for i := 0; i < 3; i++ {
+        if _, err := provider.VerifyIDToken(raw, "n"); err == nil {
+            t.Fatal("VerifyIDToken accepted a token with an unknown kid")
+        }
+    }
+    if fetches := atomic.LoadInt32(&idp.fetches); fetches != 1 {
+        t.Errorf("Expected 1 JWKS fetch within the refresh interval, got %d", fetches)
+    }
+
+    defer func(interval time.Duration) { jwksRefreshInterval = interval }(jwksRefreshInterval)
+    jwksRefreshInterval = 0
+    provider.VerifyIDToken(raw, "n")
+    if fetches := atomic.LoadInt32(&idp.fetches); fetches != 2 {
+        t.Errorf("Expected the JWKS to be refetched once the interval passed, got %d fetches", fetches)
+    }
+}
@@ -0,0 +1,173 @@
+package throttle
+
+import (
+    "context"
+    "io"
+    "sync"
+    "time"
+)
+
+// Bucket is a token bucket of bytes. Tokens refill at Rate bytes per second
+// up to Burst, and callers wait until enough tokens are available.
+type Bucket struct {
+    mu       sync.Mutex
+    rate     float64
+    burst    int
+    tokens   float64
+    last     time.Time
+    lastUsed time.Time
+}
+
+// NewBucket returns a full bucket allowing rate bytes per second. The burst
+// is one second worth of bytes.
+func NewBucket(rate int) *Bucket {
+    now := time.Now()
+    return &Bucket{rate: float64(rate), burst: rate, tokens: float64(rate), last: now, lastUsed: now}
+}
+
+// reserve takes n tokens, letting the balance go negative, and returns how
+// long the caller has to wait for the debt to be paid back
+func (b *Bucket) reserve(n int) time.Duration {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    now := time.Now()
+    b.tokens += now.Sub(b.last).Seconds() * b.rate
+    if b.tokens > float64(b.burst) {
+        b.tokens = float64(b.burst)
+    }
+    b.last = now
+    b.lastUsed = now
+
+    b.tokens -= float64(n)
+    if b.tokens >= 0 {
+        return 0
+    }
+    return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// WaitN blocks until n bytes may pass, or the context is done
+func (b *Bucket) WaitN(ctx context.Context, n int) error {
+    wait := b.reserve(n)
+    if wait <= 0 {
+        return nil
+    }
+
+    timer := time.NewTimer(wait)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// chunk is the most that is read or written between waits, so a single
+// large buffer cannot go out as one burst
+func (b *Bucket) chunk(n int) int {
+    if n > b.burst {
+        return b.burst
+    }
+    return n
+}
+
+// Reader throttles reads from an underlying reader and counts the bytes read
+type Reader struct {
+    ctx    context.Context
+    r      io.Reader
+    bucket *Bucket
+    N      int64
+}
+
+// NewReader wraps r so reads are limited by bucket
+func NewReader(ctx context.Context, r io.Reader, bucket *Bucket) *Reader {
+    return &Reader{ctx: ctx, r: r, bucket: bucket}
+}
+
+func (t *Reader) Read(p []byte) (int, error) {
+    if t.bucket != nil {
+        p = p[:t.bucket.chunk(len(p))]
+    }
+    n, err := t.r.Read(p)
+    t.N += int64(n)
+    if n > 0 && t.bucket != nil {
+        if waitErr := t.bucket.WaitN(t.ctx, n); waitErr != nil {
+            return n, waitErr
+        }
+    }
+    return n, err
+}
+
+// Writer throttles writes to an underlying writer and counts the bytes written
+type Writer struct {
+    ctx    context.Context
+    w      io.Writer
+    bucket *Bucket
+    N      int64
+}
+
+// NewWriter wraps w so writes are limited by bucket
+func NewWriter(ctx context.Context, w io.Writer, bucket *Bucket) *Writer {
+    return &Writer{ctx: ctx, w: w, bucket: bucket}
+}
+
+func (t *Writer) Write(p []byte) (int, error) {
+    written := 0
+    for written < len(p) {
+        size := len(p) - written
+        if t.bucket != nil {
+            size = t.bucket.chunk(size)
+            if err := t.bucket.WaitN(t.ctx, size); err != nil {
+                return written, err
+            }
+        }
+        n, err := t.w.Write(p[written : written+size])
+        written += n
+        t.N += int64(n)
+        if err != nil {
+            return written, err
+        }
+    }
+    return written, nil
+}
+
+// Registry hands out one bucket per key, so concurrent transfers of the same
+// user share their bandwidth. Idle buckets are dropped.
+type Registry struct {
+    mu          sync.Mutex
+    buckets     map[string]*Bucket
+    lastCleanup time.Time
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+    return &Registry{buckets: make(map[string]*Bucket)}
+}
+
+// Bucket returns the bucket for key, creating it with the given rate. A
+// bucket whose rate changed, such as after a plan change, is replaced.
+func (reg *Registry) Bucket(key string, rate int) *Bucket {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+
+    now := time.Now()
+    if now.Sub(reg.lastCleanup) > time.Minute {
+        reg.lastCleanup = now
+        for k, b := range reg.buckets {
+            b.mu.Lock()
+            idle := now.Sub(b.lastUsed) > time.Minute
+            b.mu.Unlock()
+            if idle {
+                delete(reg.buckets, k)
+            }
+        }
+    }
+
+    bucket, ok := reg.buckets[key]
+    if !ok || bucket.rate != float64(rate) {
+        bucket = NewBucket(rate)
+        reg.buckets[key] = bucket
+    }
+    return bucket
+}
@@ -0,0 +1,54 @@
+package throttle
+
+import (
+    "bytes"
+    "context"
+    "io"
+    "testing"
+    "time"
+)
+
+func TestWriterLimitsRate(t *testing.T) {
+    bucket := NewBucket(10000)
+    var out bytes.Buffer
+    w := NewWriter(context.Background(), &out, bucket)
+
+    start := time.Now()
+    // The first 10000 bytes are the burst, the next 5000 take half a second
+    if _, err := w.Write(make([]byte, 15000)); err != nil {
+        t.Fatal(err)
+    }
+    elapsed := time.Since(start)
+
+    if w.N != 15000 || out.Len() != 15000 {
+        t.Errorf("Wrote %d bytes, want 15000", w.N)
+    }
+    if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+        t.Errorf("Write took %v, want about 500ms", elapsed)
+    }
+}
+
+func TestReaderStopsWhenContextIsDone(t *testing.T) {
+    bucket := NewBucket(1000)
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+
+    r := NewReader(ctx, bytes.NewReader(make([]byte, 5000)), bucket)
+    _, err := io.Copy(io.Discard, r)
+    if err != context.DeadlineExceeded {
+        t.Errorf("Copy returned %v, want context.DeadlineExceeded", err)
+    }
+    if r.N >= 5000 {
+        t.Errorf("Read all %d bytes despite the cancelled context", r.N)
+    }
+}
+
+func TestRegistrySharesBuckets(t *testing.T) {
+    reg := NewRegistry()
+    if reg.Bucket("upload:1", 100) != reg.Bucket("upload:1", 100) {
+        t.Error("Same key and rate returned different buckets")
+    }
+    if reg.Bucket("upload:1", 100) == reg.Bucket("upload:1", 200) {
+        t.Error("Changed rate reused the old bucket")
+    }
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+    "log"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+    "trademarkia/config"
+)
+
+var (
+    trustedProxies     []*net.IPNet
+    trustedProxiesOnce sync.Once
+)
+
+// loadTrustedProxies parses TRUSTED_PROXIES, a comma separated list of IP
+// addresses or CIDR ranges of the reverse proxies in front of the server
+func loadTrustedProxies() {
+    for _, entry := range strings.Split(config.GetEnv("TRUSTED_PROXIES", ""), ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        if !strings.Contains(entry, "/") {
+            if strings.Contains(entry, ":") {
+                entry += "/128"
+            } else {
+                entry += "/32"
+            }
+        }
+        _, network, err := net.ParseCIDR(entry)
+        if err != nil {
+            log.Printf("Ignoring invalid trusted proxy %q: %v", entry, err)
+            continue
+        }
+        trustedProxies = append(trustedProxies, network)
+    }
+}
+
+// SetTrustedProxies replaces the trusted proxies loaded from TRUSTED_PROXIES
+func SetTrustedProxies(networks []*net.IPNet) {
+    trustedProxiesOnce.Do(func() {})
+    trustedProxies = networks
+}
+
+func isTrustedProxy(ip net.IP) bool {
+    trustedProxiesOnce.Do(loadTrustedProxies)
+    for _, network := range trustedProxies {
+        if network.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// ClientIP returns the address of the client that made the request.
+// X-Forwarded-For is only honoured when the connection comes from a trusted
+// proxy, and is read right to left so that addresses a client prepends
+// itself are never used.
+func ClientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+
+    remote := net.ParseIP(host)
+    if remote == nil || !isTrustedProxy(remote) {
+        return host
+    }
+
+    hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+    for i := len(hops) - 1; i >= 0; i-- {
+        ip := net.ParseIP(strings.TrimSpace(hops[i]))
+        if ip == nil {
+            // A malformed entry means the chain cannot be trusted past this point
+            break
+        }
+        if !isTrustedProxy(ip) {
+            return ip.String()
+        }
+        host = ip.String()
+    }
+    return host
+}
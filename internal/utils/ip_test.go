@@ -0,0 +1,38 @@
+package utils
+
+import (
+    "net"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestClientIP(t *testing.T) {
+    _, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+    SetTrustedProxies([]*net.IPNet{proxies})
+    defer SetTrustedProxies(nil)
+
+    tests := []struct {
+        name       string
+        remoteAddr string
+        forwarded  string
+        want       string
+    }{
+        {"direct connection", "203.0.113.7:4321", "", "203.0.113.7"},
+        {"untrusted peer cannot spoof", "203.0.113.7:4321", "198.51.100.1", "203.0.113.7"},
+        {"trusted proxy", "10.0.0.2:80", "198.51.100.1", "198.51.100.1"},
+        {"spoofed prefix is skipped", "10.0.0.2:80", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+        {"chain of proxies", "10.0.0.2:80", "198.51.100.1, 10.0.0.3", "198.51.100.1"},
+        {"malformed entry", "10.0.0.2:80", "garbage", "10.0.0.2"},
+    }
+
+    for _, tt := range tests {
+        r := httptest.NewRequest("GET", "/", nil)
+        r.RemoteAddr = tt.remoteAddr
+        if tt.forwarded != "" {
+            r.Header.Set("X-Forwarded-For", tt.forwarded)
+        }
+        if got := ClientIP(r); got != tt.want {
+            t.Errorf("%s: ClientIP = %q, want %q", tt.name, got, tt.want)
+        }
+    }
+}
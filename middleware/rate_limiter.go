@@ -1,57 +1,417 @@
 package middleware
 
 import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math"
     "net/http"
+    "os"
+    "strconv"
     "sync"
     "time"
+    "trademarkia/config"
+    "trademarkia/internal/auth"
+    "trademarkia/internal/db"
+    "trademarkia/internal/utils"
+
+    "github.com/go-redis/redis/v8"
 )
 
-var userRequests sync.Map
+// Rate limiting uses GCRA (the generic cell rate algorithm), a token bucket
+// that only stores one timestamp per key: the theoretical arrival time (TAT)
+// of the next request. Each request moves the TAT forward by the emission
+// interval (period / limit), and a request is rejected when that would put
+// the TAT more than the burst allowance ahead of now.
 
-type requestCount struct {
-    Count    int
-    LastSeen time.Time
+// Limit is a rate of Requests per Period, allowing up to Burst requests at once
+type Limit struct {
+    Requests int
+    Period   time.Duration
+    Burst    int
 }
 
-const requestLimit = 100
-const windowDuration = time.Hour
+// UnmarshalJSON reads a limit such as {"requests": 100, "period": "1h", "burst": 20}.
+// Burst defaults to Requests.
+func (l *Limit) UnmarshalJSON(data []byte) error {
+    var raw struct {
+        Requests int    `json:"requests"`
+        Period   string `json:"period"`
+        Burst    int    `json:"burst"`
+    }
+    if err := json.Unmarshal(data, &raw); err != nil {
+        return err
+    }
 
-// RateLimitMiddleware enforces a rate limit per user.
-func RateLimitMiddleware(next http.Handler) http.Handler {
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        userIP := getUserIP(r)
+    period, err := time.ParseDuration(raw.Period)
+    if err != nil || period <= 0 {
+        return fmt.Errorf("invalid period %q", raw.Period)
+    }
+    if raw.Requests <= 0 || raw.Burst < 0 {
+        return errors.New("requests must be positive and burst must not be negative")
+    }
+    if raw.Burst == 0 {
+        raw.Burst = raw.Requests
+    }
+
+    *l = Limit{Requests: raw.Requests, Period: period, Burst: raw.Burst}
+    return nil
+}
+
+// interval is the time one request uses up
+func (l Limit) interval() time.Duration {
+    return l.Period / time.Duration(l.Requests)
+}
+
+// tolerance is how far ahead of now the TAT may run
+func (l Limit) tolerance() time.Duration {
+    return l.interval() * time.Duration(l.Burst)
+}
+
+// Result is the outcome of a rate limit check. ResetAfter is how long until
+// the bucket is full again.
+type Result struct {
+    Allowed    bool
+    Remaining  int
+    RetryAfter time.Duration
+    ResetAfter time.Duration
+}
+
+// Limiter checks and records a request against the limit for a key
+type Limiter interface {
+    Allow(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// gcraScript runs the check atomically in Redis, using the Redis clock so
+// every instance agrees on the time. Times are in microseconds.
+var gcraScript = redis.NewScript(`
+redis.replicate_commands()
+local interval = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+local tat = tonumber(redis.call('GET', KEYS[1]))
+if not tat or tat < now then
+    tat = now
+end
 
-        value, _ := userRequests.LoadOrStore(userIP, &requestCount{
-            Count:    0,
-            LastSeen: time.Now(),
-        })
+local new_tat = tat + interval
+local allow_at = new_tat - tolerance
+if allow_at > now then
+    return {0, 0, allow_at - now, tat - now}
+end
 
-        reqData := value.(*requestCount)
+redis.call('SET', KEYS[1], new_tat, 'PX', math.ceil((new_tat - now) / 1000))
+return {1, math.floor((tolerance - (new_tat - now)) / interval), 0, new_tat - now}
+`)
 
-        if time.Since(reqData.LastSeen) > windowDuration {
-            reqData.Count = 0
-            reqData.LastSeen = time.Now()
+// RedisLimiter keeps the limiter state in Redis, so limits hold across instances
+type RedisLimiter struct {
+    Client *redis.Client
+}
+
+// Allow implements Limiter
+func (l *RedisLimiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+    values, err := gcraScript.Run(ctx, l.Client, []string{"ratelimit:" + key},
+        limit.interval().Microseconds(), limit.tolerance().Microseconds()).Int64Slice()
+    if err != nil {
+        return Result{}, err
+    }
+    if len(values) != 4 {
+        return Result{}, fmt.Errorf("unexpected rate limit script result %v", values)
+    }
+
+    return Result{
+        Allowed:    values[0] == 1,
+        Remaining:  int(values[1]),
+        RetryAfter: time.Duration(values[2]) * time.Microsecond,
+        ResetAfter: time.Duration(values[3]) * time.Microsecond,
+    }, nil
+}
+
+// MemoryLimiter keeps the limiter state in process memory. Limits are per
+// instance, so it is used when Redis is unavailable.
+type MemoryLimiter struct {
+    mu          sync.Mutex
+    tats        map[string]time.Time
+    lastCleanup time.Time
+    now         func() time.Time
+}
+
+// NewMemoryLimiter returns an empty in-memory limiter
+func NewMemoryLimiter() *MemoryLimiter {
+    return &MemoryLimiter{tats: make(map[string]time.Time), now: time.Now}
+}
+
+// Allow implements Limiter
+func (l *MemoryLimiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    now := l.now()
+    l.cleanup(now)
+
+    tat, ok := l.tats[key]
+    if !ok || tat.Before(now) {
+        tat = now
+    }
+
+    newTAT := tat.Add(limit.interval())
+    allowAt := newTAT.Add(-limit.tolerance())
+    if allowAt.After(now) {
+        return Result{Allowed: false, RetryAfter: allowAt.Sub(now), ResetAfter: tat.Sub(now)}, nil
+    }
+
+    l.tats[key] = newTAT
+    remaining := int((limit.tolerance() - newTAT.Sub(now)) / limit.interval())
+    return Result{Allowed: true, Remaining: remaining, ResetAfter: newTAT.Sub(now)}, nil
+}
+
+// cleanup drops keys whose TAT has passed, since they are back at a full bucket
+func (l *MemoryLimiter) cleanup(now time.Time) {
+    if now.Sub(l.lastCleanup) < time.Minute {
+        return
+    }
+    l.lastCleanup = now
+    for key, tat := range l.tats {
+        if tat.Before(now) {
+            delete(l.tats, key)
         }
+    }
+}
+
+// fallbackLimiter uses Redis and switches to the in-memory limiter for any
+// request where Redis fails, so an outage neither blocks nor unthrottles traffic
+type fallbackLimiter struct {
+    primary  Limiter
+    fallback Limiter
+}
+
+func (l *fallbackLimiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+    result, err := l.primary.Allow(ctx, key, limit)
+    if err == nil {
+        return result, nil
+    }
+    log.Println("Rate limiter falling back to memory:", err)
+    return l.fallback.Allow(ctx, key, limit)
+}
+
+// Rate limit policies. Each group of routes has its own policy and its own
+// bucket per caller, so uploads cannot use up the budget for listing files.
+const (
+    PolicyDefault = "default"
+    PolicyAuth    = "auth"
+    PolicyUpload  = "upload"
+    PolicyShare   = "share"
+    PolicyIP      = "ip"
+)
+
+// Policy holds the limits of a group of routes. Default applies to
+// anonymous callers and to plans without their own entry.
+type Policy struct {
+    Default Limit            `json:"default"`
+    Plans   map[string]Limit `json:"plans"`
+}
 
-        if reqData.Count >= requestLimit {
-            http.Error(w, "Too many requests, please try again later.", http.StatusTooManyRequests)
+// limitFor returns the limit that applies to a plan
+func (p Policy) limitFor(plan string) Limit {
+    if limit, ok := p.Plans[plan]; ok {
+        return limit
+    }
+    return p.Default
+}
+
+// Policies are the active rate limit policies, keyed by name
+var Policies = map[string]Policy{
+    PolicyDefault: {
+        Default: Limit{Requests: 1000, Period: time.Hour, Burst: 100},
+        Plans: map[string]Limit{
+            auth.PlanPro:        {Requests: 5000, Period: time.Hour, Burst: 300},
+            auth.PlanEnterprise: {Requests: 20000, Period: time.Hour, Burst: 1000},
+        },
+    },
+    // Login, registration and password flows are called anonymously, so
+    // they are limited per client IP
+    PolicyAuth: {
+        Default: Limit{Requests: 20, Period: time.Minute, Burst: 10},
+    },
+    PolicyUpload: {
+        Default: Limit{Requests: 20, Period: time.Hour, Burst: 5},
+        Plans: map[string]Limit{
+            auth.PlanPro:        {Requests: 200, Period: time.Hour, Burst: 20},
+            auth.PlanEnterprise: {Requests: 1000, Period: time.Hour, Burst: 50},
+        },
+    },
+    // Every request is also limited per client IP before it is
+    // authenticated, so invalid and revoked tokens cannot be sent freely
+    PolicyIP: {
+        Default: Limit{Requests: 600, Period: time.Minute, Burst: 200},
+    },
+    PolicyShare: {
+        Default: Limit{Requests: 100, Period: time.Hour, Burst: 20},
+        Plans: map[string]Limit{
+            auth.PlanPro:        {Requests: 1000, Period: time.Hour, Burst: 100},
+            auth.PlanEnterprise: {Requests: 5000, Period: time.Hour, Burst: 300},
+        },
+    },
+}
+
+var (
+    limiter     Limiter
+    limiterOnce sync.Once
+)
+
+// loadDefaultLimit overrides the default limit of the default policy with
+// RATE_LIMIT_REQUESTS per RATE_LIMIT_PERIOD (default 1h), allowing
+// RATE_LIMIT_BURST at once (default RATE_LIMIT_REQUESTS)
+func loadDefaultLimit() error {
+    if config.GetEnv("RATE_LIMIT_REQUESTS", "") == "" {
+        return nil
+    }
+
+    requests, err := strconv.Atoi(config.GetEnv("RATE_LIMIT_REQUESTS", ""))
+    if err != nil || requests <= 0 {
+        return errors.New("RATE_LIMIT_REQUESTS must be a positive number")
+    }
+    period, err := time.ParseDuration(config.GetEnv("RATE_LIMIT_PERIOD", "1h"))
+    if err != nil || period <= 0 {
+        return errors.New("RATE_LIMIT_PERIOD must be a positive duration")
+    }
+    burst, err := strconv.Atoi(config.GetEnv("RATE_LIMIT_BURST", strconv.Itoa(requests)))
+    if err != nil || burst <= 0 {
+        return errors.New("RATE_LIMIT_BURST must be a positive number")
+    }
+
+    policy := Policies[PolicyDefault]
+    policy.Default = Limit{Requests: requests, Period: period, Burst: burst}
+    Policies[PolicyDefault] = policy
+    return nil
+}
+
+// loadPolicies replaces built-in policies with those in the JSON file at
+// RATE_LIMIT_CONFIG, for example
+// {"upload": {"default": {"requests": 10, "period": "1h"}, "plans": {"pro": {"requests": 100, "period": "1h", "burst": 10}}}}
+func loadPolicies() error {
+    path := config.GetEnv("RATE_LIMIT_CONFIG", "")
+    if path == "" {
+        return nil
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    var configured map[string]Policy
+    if err := json.Unmarshal(data, &configured); err != nil {
+        return fmt.Errorf("parsing %s: %v", path, err)
+    }
+
+    for name, policy := range configured {
+        if policy.Default.Requests == 0 {
+            return fmt.Errorf("policy %q has no default limit", name)
+        }
+        Policies[name] = policy
+    }
+    log.Printf("Loaded %d rate limit policies from %s", len(configured), path)
+    return nil
+}
+
+// InitRateLimiter loads the policies and picks the limiter backend. It uses
+// Redis when db.Redis is set, falling back to memory.
+func InitRateLimiter() {
+    limiterOnce.Do(func() {
+        if err := loadPolicies(); err != nil {
+            log.Println("Error loading rate limit policies, using the built-in ones:", err)
+        }
+        if err := loadDefaultLimit(); err != nil {
+            log.Println("Error loading the default rate limit, using the built-in one:", err)
+        }
+
+        if db.Redis == nil {
+            limiter = NewMemoryLimiter()
             return
         }
+        limiter = &fallbackLimiter{primary: &RedisLimiter{Client: db.Redis}, fallback: NewMemoryLimiter()}
+    })
+}
 
-        reqData.Count++
-        userRequests.Store(userIP, reqData)
+// rateLimitKey identifies the caller: the authenticated user when the
+// request has passed the JWT middleware, otherwise the client IP
+func rateLimitKey(r *http.Request) string {
+    if userID, ok := r.Context().Value("userID").(int); ok {
+        return fmt.Sprintf("user:%d", userID)
+    }
+    return "ip:" + utils.ClientIP(r)
+}
+
+// seconds rounds a duration up to whole seconds for the headers
+func seconds(d time.Duration) string {
+    return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+type rateLimitError struct {
+    Error      string `json:"error"`
+    Message    string `json:"message"`
+    Policy     string `json:"policy"`
+    RetryAfter int    `json:"retry_after"`
+}
+
+// RateLimit enforces the named policy per user, or per client IP on
+// unauthenticated routes, using the limit of the user's plan. Place it
+// inside JWTMiddleware to limit by user. Every response carries the
+// RateLimit-* headers; rejected requests get a JSON 429 with Retry-After.
+func RateLimit(policyName string, next http.Handler) http.Handler {
+    InitRateLimiter()
+
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        policy, ok := Policies[policyName]
+        if !ok {
+            policy = Policies[PolicyDefault]
+        }
+        plan, _ := r.Context().Value("plan").(string)
+        limit := policy.limitFor(plan)
+
+        result, err := limiter.Allow(r.Context(), policyName+":"+rateLimitKey(r), limit)
+        if err != nil {
+            // Let the request through and report a full bucket, so clients
+            // still see the headers
+            log.Println("Error checking rate limit:", err)
+            result = Result{Allowed: true, Remaining: limit.Burst}
+        }
+
+        w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%s", limit.Burst, seconds(limit.tolerance())))
+        w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+        w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+        w.Header().Set("RateLimit-Reset", seconds(result.ResetAfter))
+
+        if !result.Allowed {
+            retryAfter := int(math.Ceil(result.RetryAfter.Seconds()))
+            w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+            w.Header().Set("Content-Type", "application/json")
+            w.WriteHeader(http.StatusTooManyRequests)
+            json.NewEncoder(w).Encode(rateLimitError{
+                Error:      "rate_limited",
+                Message:    "Too many requests, please try again later.",
+                Policy:     policyName,
+                RetryAfter: retryAfter,
+            })
+            return
+        }
 
         next.ServeHTTP(w, r)
     })
 }
 
-func getUserIP(r *http.Request) string {
-    ip := r.Header.Get("X-Real-Ip")
-    if ip == "" {
-        ip = r.Header.Get("X-Forwarded-For")
-    }
-    if ip == "" {
-        ip = r.RemoteAddr
-    }
-    return ip
+// IPRateLimit enforces the ip policy per client IP. It runs in front of
+// JWTMiddleware, which rejects bad tokens before any per-user limit applies.
+func IPRateLimit(next http.Handler) http.Handler {
+    return RateLimit(PolicyIP, next)
+}
+
+// RateLimitMiddleware enforces the default policy
+func RateLimitMiddleware(next http.Handler) http.Handler {
+    return RateLimit(PolicyDefault, next)
 }
@@ -0,0 +1,168 @@
+package middleware
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "testing"
+    "time"
+)
+
+func TestMemoryLimiterBurstAndRefill(t *testing.T) {
+    now := time.Unix(1700000000, 0)
+    l := NewMemoryLimiter()
+    l.now = func() time.Time { return now }
+
+    limit := Limit{Requests: 10, Period: 10 * time.Second, Burst: 3}
+
+    for i := 0; i < 3; i++ {
+        result, _ := l.Allow(context.Background(), "user:1", limit)
+        if !result.Allowed {
+            t.Fatalf("Request %d within the burst was rejected", i+1)
+        }
+        if result.Remaining != 2-i {
+            t.Errorf("Request %d: remaining = %d, want %d", i+1, result.Remaining, 2-i)
+        }
+    }
+
+    result, _ := l.Allow(context.Background(), "user:1", limit)
+    if result.Allowed {
+        t.Fatal("Request over the burst was allowed")
+    }
+    if result.RetryAfter != time.Second {
+        t.Errorf("RetryAfter = %v, want 1s", result.RetryAfter)
+    }
+
+    // Other keys have their own bucket
+    if result, _ := l.Allow(context.Background(), "user:2", limit); !result.Allowed {
+        t.Error("Request for another key was rejected")
+    }
+
+    // One interval later exactly one more request fits
+    now = now.Add(time.Second)
+    if result, _ := l.Allow(context.Background(), "user:1", limit); !result.Allowed {
+        t.Error("Request after one interval was rejected")
+    }
+    if result, _ := l.Allow(context.Background(), "user:1", limit); result.Allowed {
+        t.Error("Second request after one interval was allowed")
+    }
+}
+
+func TestRateLimitHeadersAndPlans(t *testing.T) {
+    InitRateLimiter()
+    limiter = NewMemoryLimiter()
+    Policies["test"] = Policy{
+        Default: Limit{Requests: 60, Period: time.Minute, Burst: 1},
+        Plans:   map[string]Limit{"pro": {Requests: 60, Period: time.Minute, Burst: 2}},
+    }
+    defer delete(Policies, "test")
+
+    handler := RateLimit("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    request := func(userID int, plan string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest("GET", "/files", nil)
+        ctx := context.WithValue(r.Context(), "userID", userID)
+        ctx = context.WithValue(ctx, "plan", plan)
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, r.WithContext(ctx))
+        return w
+    }
+
+    w := request(1, "free")
+    if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "1" || w.Header().Get("RateLimit-Remaining") != "0" {
+        t.Fatalf("Unexpected first response: %d %v", w.Code, w.Header())
+    }
+
+    w = request(1, "free")
+    if w.Code != http.StatusTooManyRequests {
+        t.Fatalf("Second free request got %d, want 429", w.Code)
+    }
+    if w.Header().Get("Retry-After") != "1" || w.Header().Get("Content-Type") != "application/json" {
+        t.Errorf("Unexpected 429 headers: %v", w.Header())
+    }
+    var body rateLimitError
+    if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Policy != "test" || body.RetryAfter != 1 {
+        t.Errorf("Unexpected 429 body: %+v, %v", body, err)
+    }
+
+    // The pro plan gets a larger burst
+    for i := 0; i < 2; i++ {
+        if w := request(2, "pro"); w.Code != http.StatusOK {
+            t.Errorf("Pro request %d got %d", i+1, w.Code)
+        }
+    }
+}
+
+func TestIPRateLimitCountsRejectedTokens(t *testing.T) {
+    InitRateLimiter()
+    limiter = NewMemoryLimiter()
+    defer func(policy Policy) { Policies[PolicyIP] = policy }(Policies[PolicyIP])
+    Policies[PolicyIP] = Policy{Default: Limit{Requests: 60, Period: time.Minute, Burst: 2}}
+
+    // Stands in for JWTMiddleware turning away a revoked token
+    unauthorized := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        http.Error(w, "Invalid token", http.StatusUnauthorized)
+    })
+    handler := IPRateLimit(unauthorized)
+
+    codes := make([]int, 3)
+    for i := range codes {
+        r := httptest.NewRequest("GET", "/files", nil)
+        r.RemoteAddr = "203.0.113.7:4000"
+        r.Header.Set("Authorization", "Bearer revoked")
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+        codes[i] = w.Code
+    }
+    if codes[0] != http.StatusUnauthorized || codes[1] != http.StatusUnauthorized || codes[2] != http.StatusTooManyRequests {
+        t.Errorf("status codes = %v, want two 401s then 429", codes)
+    }
+}
+
+type failingLimiter struct{}
+
+func (failingLimiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+    return Result{}, errors.New("connection refused")
+}
+
+func TestRateLimitSendsHeadersWhenTheLimiterFails(t *testing.T) {
+    InitRateLimiter()
+    defer func(previous Limiter) { limiter = previous }(limiter)
+    limiter = failingLimiter{}
+
+    w := httptest.NewRecorder()
+    RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+        ServeHTTP(w, httptest.NewRequest("GET", "/files", nil))
+    if w.Code != http.StatusOK {
+        t.Fatalf("status = %d, want the request to be let through", w.Code)
+    }
+    burst := strconv.Itoa(Policies[PolicyDefault].Default.Burst)
+    if w.Header().Get("RateLimit-Limit") != burst || w.Header().Get("RateLimit-Remaining") != burst || w.Header().Get("RateLimit-Policy") == "" {
+        t.Errorf("Unexpected headers: %v", w.Header())
+    }
+}
+
+func TestDefaultLimitFromEnvironment(t *testing.T) {
+    defer func(policy Policy) { Policies[PolicyDefault] = policy }(Policies[PolicyDefault])
+
+    t.Setenv("RATE_LIMIT_REQUESTS", "50")
+    t.Setenv("RATE_LIMIT_PERIOD", "1m")
+    if err := loadDefaultLimit(); err != nil {
+        t.Fatal(err)
+    }
+    policy := Policies[PolicyDefault]
+    if policy.Default != (Limit{Requests: 50, Period: time.Minute, Burst: 50}) {
+        t.Errorf("default limit = %+v, want 50 per minute with a burst of 50", policy.Default)
+    }
+    // Plans keep their own limits
+    if policy.Plans["pro"].Requests != 5000 {
+        t.Errorf("pro limit = %+v, want the built-in one", policy.Plans["pro"])
+    }
+
+    t.Setenv("RATE_LIMIT_BURST", "-1")
+    if err := loadDefaultLimit(); err == nil {
+        t.Error("loadDefaultLimit accepted a negative burst")
+    }
+}
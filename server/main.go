@@ -4,10 +4,14 @@ import (
     "log"
     "net/http"
     "github.com/gorilla/mux" 
+    "trademarkia/internal/auth"
+    "trademarkia/internal/cache"
     "trademarkia/internal/db"
     "trademarkia/internal/handlers"
+    "trademarkia/internal/mail"
+    "trademarkia/internal/oidc"
     "trademarkia/internal/middlewares"
-    //"trademarkia/middleware"
+    "trademarkia/middleware"
     "trademarkia/internal/background" 
 )
 
@@ -17,18 +21,106 @@ func main() {
         log.Fatal("Error connecting to the database: ", err)
     }
 
-    background.StartFileDeletionWorker()
+    db.InitRedis()
+    cache.Init()
+    middleware.InitRateLimiter()
+
+    err = db.Migrate()
+    if err != nil {
+        log.Fatal("Error migrating the database: ", err)
+    }
+
+    err = auth.InitKeys()
+    if err != nil {
+        log.Fatal("Error loading signing keys: ", err)
+    }
+
+    mail.Init()
+
+    err = oidc.Init()
+    if err != nil {
+        log.Fatal("Error configuring single sign-on: ", err)
+    }
+
+    background.StartJobWorkers()
+    background.StartScheduler()
+    background.StartOutboxRelay()
 
     router := mux.NewRouter()
+    router.Use(middleware.IPRateLimit)
+
+    router.Handle("/register", middleware.RateLimit(middleware.PolicyAuth, http.HandlerFunc(handlers.RegisterUser))).Methods("POST")
+    router.Handle("/login", middleware.RateLimit(middleware.PolicyAuth, http.HandlerFunc(handlers.Login))).Methods("POST")
+    router.Handle("/login/2fa", middleware.RateLimit(middleware.PolicyAuth, http.HandlerFunc(handlers.LoginTwoFactor))).Methods("POST")
+    router.Handle("/oidc/login", middleware.RateLimit(middleware.PolicyAuth, http.HandlerFunc(handlers.OIDCLogin))).Methods("GET")
+    router.Handle("/oidc/callback", middleware.RateLimit(middleware.PolicyAuth, http.HandlerFunc(handlers.OIDCCallback))).Methods("GET")
+    router.Handle("/.well-known/jwks.json", middleware.RateLimitMiddleware(http.HandlerFunc(handlers.JWKS))).Methods("GET")
+    router.Handle("/verify-email", middleware.RateLimitMiddleware(http.HandlerFunc(handlers.VerifyEmail))).Methods("GET")
+    router.Handle("/verify-email/resend", middleware.RateLimit(middleware.PolicyAuth, http.HandlerFunc(handlers.ResendVerificationEmail))).Methods("POST")
+    router.Handle("/password/forgot", middleware.RateLimit(middleware.PolicyAuth, http.HandlerFunc(handlers.ForgotPassword))).Methods("POST")
+    router.Handle("/password/reset", middleware.RateLimit(middleware.PolicyAuth, http.HandlerFunc(handlers.ResetPasswordForm))).Methods("GET")
+    router.Handle("/password/reset", middleware.RateLimit(middleware.PolicyAuth, http.HandlerFunc(handlers.ResetPassword))).Methods("POST")
+    router.Handle("/me/email/confirm", middleware.RateLimitMiddleware(http.HandlerFunc(handlers.ConfirmEmailChange))).Methods("GET")
+
+    router.Handle("/upload", middlewares.JWTMiddleware(middleware.RateLimit(middleware.PolicyUpload, middlewares.RequireScope(auth.ScopeUpload, http.HandlerFunc(handlers.HandleFileUpload))))).Methods("POST")
+    router.Handle("/search", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeRead, http.HandlerFunc(handlers.HandleFileSearch))))).Methods("GET")
+    router.Handle("/files", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeRead, http.HandlerFunc(handlers.GetFiles))))).Methods("GET")
+    router.Handle("/share/{file_id}", middlewares.JWTMiddleware(middleware.RateLimit(middleware.PolicyShare, middlewares.RequireScope(auth.ScopeShare, http.HandlerFunc(handlers.ShareFile))))).Methods("GET")
+    router.Handle("/download/{file_id}", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeRead, http.HandlerFunc(handlers.DownloadFile))))).Methods("GET")
+    router.Handle("/file/update/{file_id}", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeUpload, http.HandlerFunc(handlers.UpdateFileMetadata))))).Methods("POST")
+    router.Handle("/files/{file_id}/grants", middlewares.JWTMiddleware(middleware.RateLimit(middleware.PolicyShare, middlewares.RequireScope(auth.ScopeShare, http.HandlerFunc(handlers.GrantFileAccess))))).Methods("POST")
+    router.Handle("/files/{file_id}/grants", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeShare, http.HandlerFunc(handlers.ListFileGrants))))).Methods("GET")
+    router.Handle("/files/{file_id}/grants/{user_id}", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeShare, http.HandlerFunc(handlers.RevokeFileAccess))))).Methods("DELETE")
+    router.Handle("/shared-with-me", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeRead, http.HandlerFunc(handlers.ListSharedWithMe))))).Methods("GET")
+
+    router.Handle("/api-keys", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeManageKeys, http.HandlerFunc(handlers.CreateAPIKey))))).Methods("POST")
+    router.Handle("/api-keys", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeManageKeys, http.HandlerFunc(handlers.ListAPIKeys))))).Methods("GET")
+    router.Handle("/api-keys/{key_id}", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeManageKeys, http.HandlerFunc(handlers.RevokeAPIKey))))).Methods("DELETE")
+
+    router.Handle("/2fa/enroll", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAccount, http.HandlerFunc(handlers.EnrollTwoFactor))))).Methods("POST")
+    router.Handle("/2fa/confirm", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAccount, http.HandlerFunc(handlers.ConfirmTwoFactor))))).Methods("POST")
+    router.Handle("/2fa/disable", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAccount, http.HandlerFunc(handlers.DisableTwoFactor))))).Methods("POST")
+
+    router.Handle("/me", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeRead, http.HandlerFunc(handlers.GetProfile))))).Methods("GET")
+    router.Handle("/me", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAccount, http.HandlerFunc(handlers.UpdateProfile))))).Methods("PATCH")
+    router.Handle("/me/password", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAccount, http.HandlerFunc(handlers.ChangePassword))))).Methods("POST")
+    router.Handle("/me/email", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAccount, http.HandlerFunc(handlers.ChangeEmail))))).Methods("POST")
+    router.Handle("/me/sessions", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAccount, http.HandlerFunc(handlers.ListSessions))))).Methods("GET")
+    router.Handle("/me/sessions", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAccount, http.HandlerFunc(handlers.RevokeOtherSessions))))).Methods("DELETE")
+    router.Handle("/me/sessions/{session_id}", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAccount, http.HandlerFunc(handlers.RevokeSession))))).Methods("DELETE")
+    router.Handle("/me/usage", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeRead, http.HandlerFunc(handlers.GetUsage))))).Methods("GET")
+    router.Handle("/me/export", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAccount, http.HandlerFunc(handlers.RequestDataExport))))).Methods("POST")
+    router.Handle("/me/export/{export_id}", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAccount, http.HandlerFunc(handlers.GetDataExport))))).Methods("GET")
+    router.Handle("/me", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAccount, http.HandlerFunc(handlers.DeleteAccount))))).Methods("DELETE")
+
+    router.Handle("/workspaces", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAccount, http.HandlerFunc(handlers.CreateWorkspace))))).Methods("POST")
+    router.Handle("/workspaces", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeRead, http.HandlerFunc(handlers.ListWorkspaces))))).Methods("GET")
+    router.Handle("/workspaces/{workspace_id}", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAccount, http.HandlerFunc(handlers.DeleteWorkspace))))).Methods("DELETE")
+    router.Handle("/workspaces/{workspace_id}/members", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeRead, http.HandlerFunc(handlers.ListWorkspaceMembers))))).Methods("GET")
+    router.Handle("/workspaces/{workspace_id}/members", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAccount, http.HandlerFunc(handlers.AddWorkspaceMember))))).Methods("POST")
+    router.Handle("/workspaces/{workspace_id}/members/{user_id}", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAccount, http.HandlerFunc(handlers.UpdateWorkspaceMember))))).Methods("PUT")
+    router.Handle("/workspaces/{workspace_id}/members/{user_id}", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAccount, http.HandlerFunc(handlers.RemoveWorkspaceMember))))).Methods("DELETE")
 
-    router.HandleFunc("/register", handlers.RegisterUser).Methods("POST")
-    router.HandleFunc("/login", handlers.Login).Methods("POST")
+    adminOnly := []string{auth.RoleAdmin}
+    staff := []string{auth.RoleAdmin, auth.RoleAuditor}
 
-    router.Handle("/upload", middlewares.JWTMiddleware(http.HandlerFunc(handlers.HandleFileUpload))).Methods("POST")
-    router.Handle("/search", middlewares.JWTMiddleware(http.HandlerFunc(handlers.HandleFileSearch))).Methods("GET")
-    router.Handle("/files", middlewares.JWTMiddleware(http.HandlerFunc(handlers.GetFiles))).Methods("GET")
-    router.Handle("/share/{file_id}", middlewares.JWTMiddleware(http.HandlerFunc(handlers.ShareFile))).Methods("GET")
-    router.Handle("/file/update/{file_id}", middlewares.JWTMiddleware(http.HandlerFunc(handlers.UpdateFileMetadata))).Methods("POST")
+    router.Handle("/admin/users", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAdmin, middlewares.RequireRole(staff, http.HandlerFunc(handlers.AdminListUsers)))))).Methods("GET")
+    router.Handle("/admin/users/{user_id}/disable", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAdmin, middlewares.RequireRole(adminOnly, http.HandlerFunc(handlers.AdminDisableUser)))))).Methods("POST")
+    router.Handle("/admin/users/{user_id}/enable", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAdmin, middlewares.RequireRole(adminOnly, http.HandlerFunc(handlers.AdminEnableUser)))))).Methods("POST")
+    router.Handle("/admin/users/{user_id}/unlock", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAdmin, middlewares.RequireRole(adminOnly, http.HandlerFunc(handlers.AdminUnlockUser)))))).Methods("POST")
+    router.Handle("/admin/users/{user_id}/role", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAdmin, middlewares.RequireRole(adminOnly, http.HandlerFunc(handlers.AdminSetUserRole)))))).Methods("PUT")
+    router.Handle("/admin/users/{user_id}/plan", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAdmin, middlewares.RequireRole(adminOnly, http.HandlerFunc(handlers.AdminSetUserPlan)))))).Methods("PUT")
+    router.Handle("/admin/files/{file_id}", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAdmin, middlewares.RequireRole(staff, http.HandlerFunc(handlers.AdminGetFile)))))).Methods("GET")
+    router.Handle("/admin/files/{file_id}", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAdmin, middlewares.RequireRole(adminOnly, http.HandlerFunc(handlers.AdminDeleteFile)))))).Methods("DELETE")
+    router.Handle("/admin/jobs", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAdmin, middlewares.RequireRole(staff, http.HandlerFunc(handlers.AdminListJobs)))))).Methods("GET")
+    router.Handle("/admin/jobs/{job_id}", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAdmin, middlewares.RequireRole(staff, http.HandlerFunc(handlers.AdminGetJob)))))).Methods("GET")
+    router.Handle("/admin/jobs/{job_id}/retry", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAdmin, middlewares.RequireRole(adminOnly, http.HandlerFunc(handlers.AdminRetryJob)))))).Methods("POST")
+    router.Handle("/admin/schedules", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAdmin, middlewares.RequireRole(staff, http.HandlerFunc(handlers.AdminListSchedules)))))).Methods("GET")
+    router.Handle("/admin/schedules/{name}/runs", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAdmin, middlewares.RequireRole(staff, http.HandlerFunc(handlers.AdminListScheduledRuns)))))).Methods("GET")
+    router.Handle("/admin/schedules/{name}/run", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAdmin, middlewares.RequireRole(adminOnly, http.HandlerFunc(handlers.AdminRunSchedule)))))).Methods("POST")
+    router.Handle("/admin/reconciliations", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAdmin, middlewares.RequireRole(staff, http.HandlerFunc(handlers.AdminListReconcileReports)))))).Methods("GET")
+    router.Handle("/admin/reconciliations", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAdmin, middlewares.RequireRole(adminOnly, http.HandlerFunc(handlers.AdminReconcileStorage)))))).Methods("POST")
+    router.Handle("/admin/reconciliations/{report_id}", middlewares.JWTMiddleware(middleware.RateLimitMiddleware(middlewares.RequireScope(auth.ScopeAdmin, middlewares.RequireRole(staff, http.HandlerFunc(handlers.AdminGetReconcileReport)))))).Methods("GET")
 
     // Starting the server
     log.Println("Server is running on port 8080...")